@@ -5,6 +5,4 @@ source .env
 
 export GO111MODULE=on
 
-go build -o csvReader cmd/main.go
-go build -o crmIntegrator crm/main.go
-
+go build -o csvcrm ./cmd/csvcrm
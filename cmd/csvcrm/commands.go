@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/database"
+)
+
+// errUsage is returned for a command line that can't be run, once the problem has been printed.
+var errUsage = errors.New("usage")
+
+// cli runs the commands against the database, prompting on in and writing results to out.
+type cli struct {
+	// ctx is what the commands query the database with, cancelled to stop them part way.
+	ctx    context.Context
+	db     database.AdminDB
+	in     *bufio.Reader
+	out    io.Writer
+	errOut io.Writer
+	// setup, if set, adds flags to each command's own, returning what to do with them once they have been parsed.
+	// It is how the database is configured and opened.
+	setup func(*flag.FlagSet) func() error
+}
+
+func newCLI(db database.AdminDB, in io.Reader, out, errOut io.Writer) *cli {
+	return &cli{ctx: context.Background(), db: db, in: bufio.NewReader(in), out: out, errOut: errOut}
+}
+
+// run runs the command named by the first argument.
+func (c *cli) run(args []string) error {
+	if len(args) == 0 {
+		return c.usageError("no command given")
+	}
+
+	switch args[0] {
+	case "status":
+		return c.status(args[1:])
+	case "requeue":
+		return c.requeue(args[1:])
+	case "purge":
+		return c.purge(args[1:])
+	case "export":
+		return c.export(args[1:])
+	case "dead-letter":
+		if len(args) < 2 {
+			return c.usageError("dead-letter needs a command, list or retry")
+		}
+		switch args[1] {
+		case "list":
+			return c.deadLetterList(args[2:])
+		case "retry":
+			return c.deadLetterRetry(args[2:])
+		}
+		return c.usageError(fmt.Sprintf("unknown dead-letter command %q, must be list or retry", args[1]))
+	}
+	return c.usageError(fmt.Sprintf("unknown command %q", args[0]))
+}
+
+// status prints how many customers are in each state.
+func (c *cli) status(args []string) error {
+	if _, err := c.parse("status", args, nil); err != nil {
+		return err
+	}
+
+	counts, err := c.db.CountCustomers(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	var total int64
+	for _, state := range database.States {
+		fmt.Fprintf(w, "%s\t%d\t\n", state, counts[state])
+		total += counts[state]
+	}
+	fmt.Fprintf(w, "total\t%d\t\n", total)
+	return w.Flush()
+}
+
+// requeue puts customers that haven't been uploaded back in line to be uploaded.
+func (c *cli) requeue(args []string) error {
+	o, err := c.parse("requeue", args, nil)
+	if err != nil {
+		return err
+	}
+
+	switch o.where.filter.State {
+	case database.StateUploaded:
+		return c.usageError("uploaded customers can't be requeued")
+	case "":
+		// Count only what RequeueMatching will change.
+		o.where.filter.State = database.StateNotUploaded
+	}
+	return c.change("requeue", o, c.db.RequeueMatching)
+}
+
+// purge deletes customers, every customer if there are no -where flags.
+func (c *cli) purge(args []string) error {
+	o, err := c.parse("purge", args, nil)
+	if err != nil {
+		return err
+	}
+	return c.change("purge", o, c.db.Purge)
+}
+
+// export writes the customers out as CSV, or JSON with one customer per line.
+func (c *cli) export(args []string) error {
+	var format string
+	o, err := c.parse("export", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", "csv", "Output format, either 'csv' or 'json'.")
+	})
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "csv":
+		w := csv.NewWriter(c.out)
+		_ = w.Write([]string{"id", "first_name", "last_name", "email", "phone", "state", "crm_id", "attempts", "last_error", "last_attempt_ts"})
+		err = c.each(o.where.filter, o.limit, func(cs database.CustomerStatus) error {
+			return w.Write([]string{strconv.FormatInt(cs.Id, 10), cs.FirstName, cs.LastName, cs.Email, cs.Phone,
+				cs.State, cs.CRMID, strconv.Itoa(cs.Attempts), cs.LastError, formatTime(cs.LastAttempt)})
+		})
+		w.Flush()
+		if err != nil {
+			return err
+		}
+		return w.Error()
+	case "json":
+		enc := json.NewEncoder(c.out)
+		return c.each(o.where.filter, o.limit, func(cs database.CustomerStatus) error {
+			return enc.Encode(cs)
+		})
+	}
+	return c.usageError(fmt.Sprintf("unknown format %q, must be csv or json", format))
+}
+
+// deadLetterList prints the customers that gave up being uploaded, and why.
+func (c *cli) deadLetterList(args []string) error {
+	o, err := c.parse("dead-letter list", args, nil)
+	if err != nil {
+		return err
+	}
+	if err := o.onlyState(c, database.StateDeadLetter); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tATTEMPTS\tLAST ATTEMPT\tLAST ERROR")
+	err = c.each(o.where.filter, o.limit, func(cs database.CustomerStatus) error {
+		_, err := fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", cs.Id, cs.Email, cs.Attempts, formatTime(cs.LastAttempt), cs.LastError)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// deadLetterRetry requeues dead-lettered customers.
+func (c *cli) deadLetterRetry(args []string) error {
+	o, err := c.parse("dead-letter retry", args, nil)
+	if err != nil {
+		return err
+	}
+	if err := o.onlyState(c, database.StateDeadLetter); err != nil {
+		return err
+	}
+	return c.change("requeue", o, c.db.RequeueMatching)
+}
+
+// change counts the customers matching the options, and unless it's a dry run, confirms and makes the change.
+func (c *cli) change(verb string, o *options, do func(context.Context, database.CustomerFilter) (int64, error)) error {
+	n, err := c.db.CountMatching(c.ctx, o.where.filter)
+	if err != nil {
+		return err
+	}
+
+	matching := "customers"
+	if len(o.where.conditions) > 0 {
+		matching += " where " + o.where.String()
+	} else if verb == "purge" {
+		matching = "customers, every customer in the database"
+	}
+
+	switch {
+	case o.dryRun:
+		fmt.Fprintf(c.out, "would %s %d %s\n", verb, n, matching)
+		return nil
+	case n == 0:
+		fmt.Fprintf(c.out, "no %s to %s\n", matching, verb)
+		return nil
+	}
+
+	if !o.yes {
+		ok, err := c.confirm(fmt.Sprintf("%s %d %s?", strings.ToUpper(verb[:1])+verb[1:], n, matching))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(c.out, "nothing changed")
+			return nil
+		}
+	}
+
+	n, err = do(c.ctx, o.where.filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%sd %d customers\n", verb, n)
+	return nil
+}
+
+// confirm asks the question, reporting whether it was answered yes. No answer is no. It stops waiting for an answer
+// once the cli's context is done.
+func (c *cli) confirm(question string) (bool, error) {
+	fmt.Fprintf(c.out, "%s [y/N] ", question)
+	type reply struct {
+		answer string
+		err    error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		answer, err := c.in.ReadString('\n')
+		replies <- reply{answer, err}
+	}()
+
+	var r reply
+	select {
+	case r = <-replies:
+	case <-c.ctx.Done():
+		fmt.Fprintln(c.out)
+		return false, c.ctx.Err()
+	}
+	if r.err != nil && r.err != io.EOF {
+		return false, fmt.Errorf("while reading answer: %s", r.err)
+	}
+	switch strings.ToLower(strings.TrimSpace(r.answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// each calls fn with every customer matching the filter, up to limit if it isn't 0, a page at a time.
+func (c *cli) each(f database.CustomerFilter, limit int, fn func(database.CustomerStatus) error) error {
+	seen := 0
+	for {
+		f.Limit = database.MaxListLimit
+		if limit > 0 && limit-seen < f.Limit {
+			f.Limit = limit - seen
+		}
+
+		page, err := c.db.ListCustomers(c.ctx, f)
+		if err != nil {
+			return err
+		}
+		for _, cs := range page {
+			if err := fn(cs); err != nil {
+				return err
+			}
+		}
+
+		seen += len(page)
+		if len(page) < f.Limit || (limit > 0 && seen >= limit) {
+			return nil
+		}
+		f.After = page[len(page)-1].Id
+	}
+}
+
+// options are the flags shared by the commands.
+type options struct {
+	where  where
+	dryRun bool
+	yes    bool
+	limit  int
+}
+
+// parse parses the command's flags, adding any of its own with more.
+func (c *cli) parse(name string, args []string, more func(*flag.FlagSet)) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.errOut)
+	switch name {
+	case "status":
+	case "requeue", "purge", "dead-letter retry":
+		fs.Var(&o.where, "where", "Only customers matching key=value, for state, email, crm_id, error or id (a single id or a range like 100-200). May be repeated.")
+		fs.BoolVar(&o.dryRun, "dry-run", false, "Report how many customers would be changed without changing them.")
+		fs.BoolVar(&o.yes, "yes", false, "Don't ask for confirmation.")
+	default:
+		fs.Var(&o.where, "where", "Only customers matching key=value, for state, email, crm_id, error or id (a single id or a range like 100-200). May be repeated.")
+		fs.IntVar(&o.limit, "limit", 0, "The most customers to list, 0 for all of them.")
+	}
+	if more != nil {
+		more(fs)
+	}
+	var ready func() error
+	if c.setup != nil {
+		ready = c.setup(fs)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, errUsage
+	}
+	if fs.NArg() > 0 {
+		return nil, c.usageError(fmt.Sprintf("%s takes no arguments, use -where to choose customers", name))
+	}
+	if ready != nil {
+		if err := ready(); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// onlyState restricts the options to customers in the state, refusing a -where for any other.
+func (o *options) onlyState(c *cli, state string) error {
+	if o.where.filter.State != "" && o.where.filter.State != state {
+		return c.usageError(fmt.Sprintf("only %s customers can be chosen here", state))
+	}
+	o.where.filter.State = state
+	return nil
+}
+
+func (c *cli) usageError(msg string) error {
+	fmt.Fprintln(c.errOut, msg)
+	return errUsage
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/database"
+)
+
+type fakeDB struct {
+	customers []database.CustomerStatus
+	filters   []database.CustomerFilter
+	counted   database.CustomerFilter
+	changed   *database.CustomerFilter
+	err       error
+}
+
+func (f *fakeDB) CountCustomers(context.Context) (map[string]int64, error) {
+	return map[string]int64{database.StatePending: 2, database.StateDeadLetter: 1, database.StateUploaded: 7}, f.err
+}
+
+// ListCustomers pages through the customers as the database would, ignoring everything in the filter but the page.
+func (f *fakeDB) ListCustomers(_ context.Context, filter database.CustomerFilter) ([]database.CustomerStatus, error) {
+	f.filters = append(f.filters, filter)
+	var page []database.CustomerStatus
+	for _, c := range f.customers {
+		if c.Id > filter.After && len(page) < filter.Limit {
+			page = append(page, c)
+		}
+	}
+	return page, f.err
+}
+
+func (f *fakeDB) GetCustomer(_ context.Context, id int64) (*database.CustomerStatus, error) {
+	return nil, database.ErrNotFound
+}
+
+func (f *fakeDB) GetCustomerByCRMID(_ context.Context, crmID string) (*database.CustomerStatus, error) {
+	return nil, database.ErrNotFound
+}
+
+func (f *fakeDB) Requeue(_ context.Context, ids ...int64) (int64, error) {
+	return int64(len(ids)), f.err
+}
+
+func (f *fakeDB) Skip(_ context.Context, ids ...int64) (int64, error) {
+	return int64(len(ids)), f.err
+}
+
+func (f *fakeDB) UploadAttempts(_ context.Context, id int64) ([]database.UploadAttempt, error) {
+	return nil, f.err
+}
+
+func (f *fakeDB) CountMatching(_ context.Context, filter database.CustomerFilter) (int64, error) {
+	f.counted = filter
+	return int64(len(f.customers)), f.err
+}
+
+func (f *fakeDB) RequeueMatching(_ context.Context, filter database.CustomerFilter) (int64, error) {
+	f.changed = &filter
+	return int64(len(f.customers)), f.err
+}
+
+func (f *fakeDB) Purge(_ context.Context, filter database.CustomerFilter) (int64, error) {
+	f.changed = &filter
+	return int64(len(f.customers)), f.err
+}
+
+var _ = Describe("csvcrm", func() {
+	var (
+		db          *fakeDB
+		in          string
+		out, errOut *bytes.Buffer
+	)
+
+	run := func(args ...string) error {
+		return newCLI(db, strings.NewReader(in), out, errOut).run(args)
+	}
+
+	BeforeEach(func() {
+		db = &fakeDB{customers: []database.CustomerStatus{
+			{Id: 1, FirstName: "jon", LastName: "doe", Email: "jon.doe@mail.com", State: database.StateDeadLetter, Attempts: 10, LastError: "503"},
+			{Id: 2, FirstName: "jane", LastName: "doe", Email: "jane.doe@mail.com", State: database.StatePending},
+			{Id: 3, FirstName: "jim", Email: "jim@mail.com", State: database.StatePending},
+		}}
+		in = ""
+		out, errOut = &bytes.Buffer{}, &bytes.Buffer{}
+	})
+
+	It("should reject unknown commands", func() {
+		Expect(run("frobnicate")).To(Equal(errUsage))
+		Expect(errOut.String()).To(ContainSubstring(`unknown command "frobnicate"`))
+		Expect(run()).To(Equal(errUsage))
+		Expect(run("dead-letter")).To(Equal(errUsage))
+	})
+
+	It("should set up each command with the flags it adds", func() {
+		var dsn string
+		c := newCLI(nil, strings.NewReader(in), out, errOut)
+		c.setup = func(fs *flag.FlagSet) func() error {
+			fs.StringVar(&dsn, "dsn", "", "")
+			return func() error {
+				c.db = db
+				return nil
+			}
+		}
+		Expect(c.run([]string{"status", "-dsn", "postgres://localhost/crm"})).To(Succeed())
+		Expect(dsn).To(Equal("postgres://localhost/crm"))
+		Expect(out.String()).To(ContainSubstring("total"))
+
+		c.setup = func(*flag.FlagSet) func() error {
+			return func() error { return errors.New("no database") }
+		}
+		Expect(c.run([]string{"purge", "-yes"})).To(MatchError("no database"))
+	})
+
+	Context("-where", func() {
+		It("should build the filter", func() {
+			var w where
+			Expect(w.Set("state=failed")).To(Succeed())
+			Expect(w.Set("error=503")).To(Succeed())
+			Expect(w.Set("id=10-20")).To(Succeed())
+			Expect(w.Set("crm_id=c-1")).To(Succeed())
+			Expect(w.filter).To(Equal(database.CustomerFilter{State: database.StateFailed, Error: "503", MinID: 10, MaxID: 20, CRMID: "c-1"}))
+			Expect(w.String()).To(Equal("state=failed error=503 id=10-20 crm_id=c-1"))
+		})
+
+		It("should take a single id", func() {
+			var w where
+			Expect(w.Set("id=7")).To(Succeed())
+			Expect(w.filter).To(Equal(database.CustomerFilter{MinID: 7, MaxID: 7}))
+		})
+
+		It("should reject bad conditions", func() {
+			var w where
+			Expect(w.Set("state")).ToNot(Succeed())
+			Expect(w.Set("state=lost")).ToNot(Succeed())
+			Expect(w.Set("name=jon")).ToNot(Succeed())
+			Expect(w.Set("id=20-10")).ToNot(Succeed())
+			Expect(w.Set("id=x")).ToNot(Succeed())
+		})
+	})
+
+	Context("status", func() {
+		It("should count every state", func() {
+			Expect(run("status")).To(Succeed())
+			Expect(out.String()).To(MatchRegexp(`pending\s+2\s*\n`))
+			Expect(out.String()).To(MatchRegexp(`failed\s+0\s*\n`))
+			Expect(out.String()).To(MatchRegexp(`total\s+10\s*\n`))
+		})
+
+		It("should report errors", func() {
+			db.err = errors.New("no database")
+			Expect(run("status")).To(MatchError("no database"))
+		})
+	})
+
+	Context("requeue", func() {
+		It("should only count on a dry run", func() {
+			Expect(run("requeue", "-where", "error=503", "-dry-run")).To(Succeed())
+			Expect(out.String()).To(Equal("would requeue 3 customers where error=503\n"))
+			Expect(db.counted).To(Equal(database.CustomerFilter{State: database.StateNotUploaded, Error: "503"}))
+			Expect(db.changed).To(BeNil())
+		})
+
+		It("should requeue once confirmed", func() {
+			in = "y\n"
+			Expect(run("requeue", "-where", "state=failed")).To(Succeed())
+			Expect(out.String()).To(Equal("Requeue 3 customers where state=failed? [y/N] requeued 3 customers\n"))
+			Expect(*db.changed).To(Equal(database.CustomerFilter{State: database.StateFailed}))
+		})
+
+		It("should change nothing without confirmation", func() {
+			in = "\n"
+			Expect(run("requeue")).To(Succeed())
+			Expect(out.String()).To(HaveSuffix("nothing changed\n"))
+			Expect(db.changed).To(BeNil())
+		})
+
+		It("should stop waiting for confirmation once cancelled", func() {
+			answer, _ := io.Pipe()
+			c := newCLI(db, answer, out, errOut)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			c.ctx = ctx
+			Expect(c.run([]string{"requeue"})).To(MatchError(context.Canceled))
+			Expect(db.changed).To(BeNil())
+		})
+
+		It("should not ask with -yes", func() {
+			Expect(run("requeue", "-yes")).To(Succeed())
+			Expect(out.String()).To(Equal("requeued 3 customers\n"))
+		})
+
+		It("should refuse uploaded customers", func() {
+			Expect(run("requeue", "-where", "state=uploaded")).To(Equal(errUsage))
+			Expect(db.changed).To(BeNil())
+		})
+
+		It("should refuse arguments", func() {
+			Expect(run("requeue", "12")).To(Equal(errUsage))
+		})
+	})
+
+	Context("purge", func() {
+		It("should warn it's purging everything", func() {
+			Expect(run("purge")).To(Succeed())
+			Expect(out.String()).To(Equal("Purge 3 customers, every customer in the database? [y/N] nothing changed\n"))
+			Expect(db.changed).To(BeNil())
+		})
+
+		It("should purge the matching customers once confirmed", func() {
+			in = "yes\n"
+			Expect(run("purge", "-where", "id=1-2")).To(Succeed())
+			Expect(*db.changed).To(Equal(database.CustomerFilter{MinID: 1, MaxID: 2}))
+			Expect(out.String()).To(HaveSuffix("purged 3 customers\n"))
+		})
+
+		It("should not touch an empty match", func() {
+			db.customers = nil
+			Expect(run("purge", "-where", "state=skipped")).To(Succeed())
+			Expect(out.String()).To(Equal("no customers where state=skipped to purge\n"))
+			Expect(db.changed).To(BeNil())
+		})
+	})
+
+	Context("export", func() {
+		It("should write every customer as CSV a page at a time", func() {
+			Expect(run("export")).To(Succeed())
+			Expect(out.String()).To(Equal("id,first_name,last_name,email,phone,state,crm_id,attempts,last_error,last_attempt_ts\n" +
+				"1,jon,doe,jon.doe@mail.com,,dead_letter,,10,503,\n" +
+				"2,jane,doe,jane.doe@mail.com,,pending,,0,,\n" +
+				"3,jim,,jim@mail.com,,pending,,0,,\n"))
+		})
+
+		It("should stop at the limit", func() {
+			Expect(run("export", "-format", "json", "-limit", "2")).To(Succeed())
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[1]).To(HavePrefix(`{"id":2,`))
+			Expect(db.filters).To(Equal([]database.CustomerFilter{{Limit: 2}}))
+		})
+
+		It("should reject unknown formats", func() {
+			Expect(run("export", "-format", "xml")).To(Equal(errUsage))
+		})
+	})
+
+	Context("dead-letter", func() {
+		It("should list only dead letters", func() {
+			Expect(run("dead-letter", "list", "-where", "error=503")).To(Succeed())
+			Expect(db.filters[0]).To(Equal(database.CustomerFilter{State: database.StateDeadLetter, Error: "503", Limit: database.MaxListLimit}))
+			Expect(out.String()).To(HavePrefix("ID  EMAIL"))
+		})
+
+		It("should retry only dead letters", func() {
+			Expect(run("dead-letter", "retry", "-yes")).To(Succeed())
+			Expect(*db.changed).To(Equal(database.CustomerFilter{State: database.StateDeadLetter}))
+		})
+
+		It("should refuse other states", func() {
+			Expect(run("dead-letter", "retry", "-where", "state=pending")).To(Equal(errUsage))
+		})
+	})
+})
@@ -0,0 +1,100 @@
+// Command csvcrm imports customers from CSV files and uploads them to the CRM, together in one process or as separate
+// import and upload processes, and looks after the customers in the database: how their uploads are going, requeueing
+// or purging them and exporting them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dbyington/csv-crm-upload/config"
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+const usage = `Usage: csvcrm <command> [flags]
+
+Services:
+  import               Import a CSV file, or every file moved into a directory, and signal the uploader.
+  upload               Upload imported customers to the CRM as they are signalled.
+  serve                Import and upload in one process, signalling over a channel.
+  migrate              Bring the database schema up to date.
+  mock-crm             Serve the mock CRM, injecting faults.
+
+Customers:
+  status               Count the customers in each state.
+  requeue              Put customers that haven't been uploaded back in line to be uploaded.
+  purge                Delete customers, every customer without -where.
+  export               Write customers out as CSV or JSON.
+  dead-letter list     List the customers that gave up being uploaded.
+  dead-letter retry    Requeue dead-lettered customers.
+
+The services are configured by flags, environment variables or a -config file, see the README. The other commands
+take the database settings the same way.
+
+Commands that change customers ask for confirmation unless given -yes, and take -dry-run to only report how many
+customers would change. Customers are chosen with -where key=value, for the keys state, email, crm_id, error and
+id, e.g.
+  csvcrm requeue -where state=failed -where error=503
+  csvcrm purge -where id=100-200 -dry-run
+
+Run 'csvcrm <command> -h' for a command's flags.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	var err error
+	var closer io.Closer
+	switch name := flag.Arg(0); {
+	case name == "mock-crm":
+		err = mockCRM(args[1:])
+	case services[name].run != nil:
+		err = runService(name, services[name], args[1:])
+	default:
+		c := newCLI(nil, os.Stdin, os.Stdout, os.Stderr)
+		c.setup = func(fs *flag.FlagSet) func() error {
+			load := config.Define(fs, config.SectionDatabase)
+			return func() error {
+				cfg, err := load()
+				if err != nil {
+					return c.usageError(err.Error())
+				}
+				// Only problems are logged, the output is the commands'.
+				db, err := database.Open(cfg.Database, logging.New(os.Stderr, logging.Options{Level: logging.WarnLevel, RedactPII: true}))
+				if err != nil {
+					return err
+				}
+				c.db, closer = db, db
+				return nil
+			}
+		}
+		// An interrupt cancels the command's query, and any question it is waiting on an answer to.
+		ctx, cancel := untilStopped(stopOnSignal(logging.Nop()))
+		c.ctx = ctx
+		err = c.run(args)
+		cancel()
+	}
+	if closer != nil {
+		closer.Close()
+	}
+
+	switch err {
+	case nil:
+	case flag.ErrHelp:
+	case errUsage:
+		fmt.Fprintln(os.Stderr, "Run 'csvcrm -h' for usage.")
+		os.Exit(2)
+	case errLogged:
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "csvcrm: %s\n", err)
+		os.Exit(1)
+	}
+}
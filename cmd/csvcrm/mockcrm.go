@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/crm_server/mockcrm"
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+// By default the mock CRM guarantees 90% availability. Meaning 90% of your requests will get serviced. :-)
+const defaultFaults = "503=0.1"
+
+// mockCRM serves the mock CRM, see package mockcrm. Its flags are its own rather than config settings.
+func mockCRM(args []string) error {
+	var (
+		addr       string
+		scenario   string
+		seed       int64
+		faults     string
+		retryAfter time.Duration
+		latency    string
+		outage     string
+		timeout    time.Duration
+	)
+	fs := flag.NewFlagSet("csvcrm mock-crm", flag.ContinueOnError)
+	fs.StringVar(&addr, "addr", ":8089", "Address to listen on.")
+	fs.StringVar(&scenario, "scenario", "", "JSON scenario file, used in place of the other fault flags.")
+	fs.Int64Var(&seed, "seed", 0, "Seed for the random faults so a run can be repeated, 0 picks one.")
+	fs.StringVar(&faults, "faults", defaultFaults, "Faults to inject as kind=rate pairs, where kind is an HTTP status code, 'timeout' or 'reset', e.g. 503=0.1,429=0.05.")
+	fs.DurationVar(&retryAfter, "retryafter", 0, "Retry-After sent with injected 429 and 503 answers.")
+	fs.StringVar(&latency, "latency", "", "Latency before each answer: fixed:<mean>, uniform:<min>:<max>, normal:<mean>:<stddev> or exponential:<mean>.")
+	fs.StringVar(&outage, "outage", "", "An outage when every request fails with 503: <start>:<duration>, or <start>:<duration>:<every> to repeat it.")
+	fs.DurationVar(&timeout, "timeout", 0, "How long to hold timed out requests, 0 for as long as the client waits.")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+
+	s, err := scenarioFromFlags(scenario, seed, faults, retryAfter, latency, outage, timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid scenario: %s\n", err)
+		return errUsage
+	}
+
+	// Every injected fault is logged, as the mock is watched to see what the integrator is up against.
+	log := logging.New(os.Stderr, logging.Options{Level: logging.DebugLevel})
+	crm := mockcrm.New(s)
+	crm.SetLogger(log)
+	log.Info("listening", logging.F("addr", addr), logging.F("scenario", fmt.Sprintf("%+v", crm.Scenario())))
+	log.Error("listener stopped", logging.Err(http.ListenAndServe(addr, crm)))
+	return errLogged
+}
+
+func scenarioFromFlags(file string, seed int64, faults string, retryAfter time.Duration, latency, outage string, timeout time.Duration) (mockcrm.Scenario, error) {
+	if file != "" {
+		s, err := mockcrm.LoadScenario(file)
+		if seed != 0 {
+			s.Seed = seed
+		}
+		return s, err
+	}
+
+	s := mockcrm.Scenario{Seed: seed, Timeout: mockcrm.Duration(timeout)}
+	var err error
+	if s.Faults, err = mockcrm.ParseFaults(faults, retryAfter); err != nil {
+		return s, err
+	}
+	if s.Latency, err = mockcrm.ParseLatency(latency); err != nil {
+		return s, err
+	}
+	if outage != "" {
+		o, err := mockcrm.ParseOutage(outage)
+		if err != nil {
+			return s, err
+		}
+		s.Outages = append(s.Outages, o)
+	}
+	return s, s.Validate()
+}
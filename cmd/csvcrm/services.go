@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	ossignal "os/signal"
+	"syscall"
+
+	"github.com/dbyington/csv-crm-upload/cmd/csvreader"
+	"github.com/dbyington/csv-crm-upload/config"
+	"github.com/dbyington/csv-crm-upload/crm/admin"
+	"github.com/dbyington/csv-crm-upload/crm/upload"
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/health"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/metrics"
+	"github.com/dbyington/csv-crm-upload/signal"
+	"github.com/dbyington/csv-crm-upload/signal/listener"
+	"github.com/dbyington/csv-crm-upload/signal/sender"
+)
+
+// errLogged is returned by a service that failed, once the failure has been logged.
+var errLogged = errors.New("logged")
+
+// service is a command that runs the reader, the uploader or both, configured by the config sections it uses. Its
+// flags are the settings of those sections.
+type service struct {
+	sections []string
+	run      func(cfg *config.Config, log logging.Logger) error
+}
+
+var services = map[string]service{
+	"import": {
+		sections: []string{config.SectionDatabase, config.SectionSignal, config.SectionImport, config.SectionLog},
+		run:      runImport,
+	},
+	"upload": {
+		sections: []string{config.SectionDatabase, config.SectionSignal, config.SectionCRM, config.SectionUpload,
+			config.SectionIntegrator, config.SectionLog},
+		run: runUpload,
+	},
+	// Serve signals in process, so it has no use for the signal settings.
+	"serve": {
+		sections: []string{config.SectionDatabase, config.SectionImport, config.SectionCRM, config.SectionUpload,
+			config.SectionIntegrator, config.SectionLog},
+		run: runServe,
+	},
+	"migrate": {
+		sections: []string{config.SectionDatabase, config.SectionLog},
+		run:      runMigrate,
+	},
+}
+
+// runService loads the service's config from the command line, the environment and any config file, then runs it.
+func runService(name string, s service, args []string) error {
+	fs := flag.NewFlagSet("csvcrm "+name, flag.ContinueOnError)
+	load := config.Define(fs, s.sections...)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s takes no arguments\n", name)
+		return errUsage
+	}
+	cfg, err := load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errUsage
+	}
+
+	logOptions, _ := cfg.Log.Options()
+	log := logging.New(os.Stderr, logOptions)
+	if err := s.run(cfg, log); err != nil {
+		log.Error(name+" failed", logging.Err(err))
+		return errLogged
+	}
+	return nil
+}
+
+// runImport imports the CSV file, or every file moved into the watch directory, signalling the uploader as customers
+// are inserted.
+func runImport(cfg *config.Config, log logging.Logger) error {
+	db, err := database.Open(cfg.Database, log)
+	if err != nil {
+		return err
+	}
+	log.Info("database open")
+	defer db.Close()
+
+	var newSender func() sender.Signaler
+	switch cfg.Signal.Mode {
+	case config.SignalRPC:
+		// The listener doesn't need to be up, the sender keeps trying to connect in the background while we import.
+		dialer := &sender.Dialer{
+			Network: cfg.Signal.Network,
+			Address: cfg.Signal.Addr,
+			Secret:  cfg.Signal.Secret,
+			Timeout: cfg.Signal.Timeout,
+		}
+		if cfg.Signal.TLSCert != "" {
+			tlsConfig, err := signal.LoadTLS(cfg.Signal.TLSCert, cfg.Signal.TLSKey, cfg.Signal.TLSCA)
+			if err != nil {
+				return err
+			}
+			dialer.TLS = tlsConfig
+		}
+		newSender = func() sender.Signaler { return sender.NewLazySender(dialer, cfg.Signal.Wait) }
+	case config.SignalNotify:
+		// The database sends the notification as part of each insert so the listener doesn't need to be running.
+		db.NotifyOn(database.NotifyChannel)
+		newSender = func() sender.Signaler { return sender.NewNotifySender() }
+	}
+
+	checker := health.NewChecker()
+	checker.Ready("database", db.PingContext)
+	errs := make(chan error, 2)
+	if addr := cfg.Import.StatusAddr; addr != "" && cfg.Import.WatchDir != "" {
+		go func() { errs <- serveStatus(addr, checker, nil) }()
+	}
+	go func() { errs <- importCSV(cfg.Import, db, newSender, checker, log, stopOnSignal(log)) }()
+	return <-errs
+}
+
+// runUpload uploads customers to the CRM as the reader signals they are ready, and whenever it checks for work.
+func runUpload(cfg *config.Config, log logging.Logger) error {
+	db, err := database.Open(cfg.Database, log)
+	if err != nil {
+		return err
+	}
+	log.Info("database open")
+	defer db.Close()
+
+	stop := stopOnSignal(log)
+	ctx, cancel := untilStopped(stop)
+	defer cancel()
+	if err := db.Migrate(ctx); err != nil {
+		return err
+	}
+	db.SetMaxAttempts(cfg.Upload.MaxAttempts)
+
+	uploader, err := newIntegrator(cfg, db, log)
+	if err != nil {
+		return err
+	}
+	checker := health.NewChecker()
+	checker.Ready("database", db.PingContext)
+	adminAPI := newAdminAPI(cfg.Integrator, db, uploader, log)
+
+	// Metrics and health checks are served alongside the RPC listener unless they are given their own address. There is
+	// no listener when signalling by database notification, so they are served on the listener's address by default.
+	metricsAddr := cfg.Integrator.MetricsAddr
+	if cfg.Signal.Mode == config.SignalNotify {
+		uploader.UseNotifyListener(cfg.Database.ConnString(), database.NotifyChannel)
+		log.Info("listening for database notifications")
+		if metricsAddr == "" {
+			metricsAddr = cfg.Signal.Addr
+		}
+	} else {
+		l := uploader.UseRPCListener(cfg.Signal.Network, cfg.Signal.Addr)
+
+		if secret := cfg.Signal.Secret; secret != "" {
+			l.RequireSecret(secret)
+		}
+		if cert := cfg.Signal.TLSCert; cert != "" {
+			tlsConfig, err := signal.LoadTLS(cert, cfg.Signal.TLSKey, cfg.Signal.TLSCA)
+			if err != nil {
+				return err
+			}
+			l.UseTLS(tlsConfig)
+		}
+		if metricsAddr == "" {
+			handleStatus(l, checker, adminAPI)
+		}
+	}
+	uploader.Health(checker)
+
+	errs := make(chan error, 2)
+	if metricsAddr != "" {
+		go func() { errs <- serveStatus(metricsAddr, checker, adminAPI) }()
+	}
+	failed := make(chan error, 1)
+	go func() {
+		if err := uploader.Start(); err != nil {
+			failed <- fmt.Errorf("while listening for signals: %s", err)
+		}
+	}()
+
+	// Stopping cancels the posts in flight rather than wait out the CRM.
+	select {
+	case err := <-errs:
+		return err
+	case err := <-failed:
+		uploader.Stop()
+		return err
+	case <-stop:
+	}
+	uploader.Stop()
+	log.Info("stopped")
+	return nil
+}
+
+// runServe runs the reader and the uploader together, the reader signalling the uploader over a channel rather than
+// RPC. Having imported a file the uploader carries on until the process is stopped.
+func runServe(cfg *config.Config, log logging.Logger) error {
+	db, err := database.Open(cfg.Database, log)
+	if err != nil {
+		return err
+	}
+	log.Info("database open")
+	defer db.Close()
+
+	stop := stopOnSignal(log)
+	ctx, cancel := untilStopped(stop)
+	defer cancel()
+	if err := db.Migrate(ctx); err != nil {
+		return err
+	}
+	db.SetMaxAttempts(cfg.Upload.MaxAttempts)
+
+	uploader, err := newIntegrator(cfg, db, log)
+	if err != nil {
+		return err
+	}
+	local := uploader.UseLocalListener()
+	newSender := func() sender.Signaler { return local }
+
+	checker := health.NewChecker()
+	checker.Ready("database", db.PingContext)
+	uploader.Health(checker)
+
+	errs := make(chan error, 2)
+	if addr := cfg.Integrator.MetricsAddr; addr != "" {
+		adminAPI := newAdminAPI(cfg.Integrator, db, uploader, log)
+		go func() { errs <- serveStatus(addr, checker, adminAPI) }()
+	}
+	failed := make(chan error, 1)
+	go func() {
+		if err := uploader.Start(); err != nil {
+			failed <- fmt.Errorf("while uploading: %s", err)
+		}
+	}()
+
+	imported := make(chan error, 1)
+	go func() { imported <- importCSV(cfg.Import, db, newSender, checker, log, stop) }()
+	select {
+	case err := <-errs:
+		return err
+	case err := <-failed:
+		uploader.Stop()
+		return err
+	case err := <-imported:
+		if err != nil {
+			return err
+		}
+	}
+
+	// Once the import is done the uploader carries on until the process is stopped.
+	select {
+	case err := <-errs:
+		return err
+	case err := <-failed:
+		uploader.Stop()
+		return err
+	case <-stop:
+	}
+	uploader.Stop()
+	local.Stop()
+	log.Info("stopped")
+	return nil
+}
+
+// runMigrate brings the schema up to date, which the uploader also does each time it starts.
+func runMigrate(cfg *config.Config, log logging.Logger) error {
+	db, err := database.Open(cfg.Database, log)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := untilStopped(stopOnSignal(log))
+	defer cancel()
+	if err := db.Migrate(ctx); err != nil {
+		return err
+	}
+	log.Info("database migrated")
+	return nil
+}
+
+// importCSV imports the configured file or, with a watch directory, every file moved into it until stop is closed.
+// The watcher's health is added to the checker.
+func importCSV(imp config.Import, db database.Store, newSender func() sender.Signaler, checker *health.Checker,
+	log logging.Logger, stop <-chan struct{}) error {
+	if imp.WatchDir != "" {
+		watcher := csvreader.NewWatcher(db, imp.WatchDir, newSender, imp.NoHeader, imp.Buffer)
+		watcher.SetLogger(log)
+		watcher.SetPriority(imp.Priority)
+		watcher.SetCopy(imp.Copy)
+		watcher.SetInterval(imp.WatchInterval)
+		checker.Live("watcher", watcher.Healthy)
+
+		if err := watcher.Run(stop); err != nil {
+			return fmt.Errorf("while watching for CSV files: %s", err)
+		}
+		log.Info("done")
+		return nil
+	}
+
+	file, err := os.Open(imp.File)
+	if err != nil {
+		return fmt.Errorf("while opening CSV file: %s", err)
+	}
+	log.Info("csv file open", logging.F("filename", imp.File))
+	defer file.Close()
+
+	s := newSender()
+	reader := csvreader.NewReader(db, file, s, imp.NoHeader, imp.Buffer)
+	reader.SetLogger(log)
+	reader.SetPriority(imp.Priority)
+	reader.SetCopy(imp.Copy)
+	log = log.With(logging.F(logging.JobID, reader.JobID()))
+	log.Info("starting job")
+
+	// Unlike a watcher's, a single import has nothing to finish on the way out, so it stops at the next batch.
+	ctx, cancel := untilStopped(stop)
+	defer cancel()
+	err = reader.RunContext(ctx)
+	if err != nil && ctx.Err() != nil {
+		log.Warn("import stopped before the end of the file", logging.Err(err))
+		err = nil
+	}
+
+	// Whatever was imported before a failure has been signalled, so say how.
+	switch s := s.(type) {
+	case *sender.LazySender:
+		if s.Pending() {
+			log.Warn("could not signal the CRM integrator, the customers will be uploaded when it next checks for work")
+		} else if s.Delivered() {
+			log.Info("CRM integrator notified")
+		}
+	case *sender.NotifySender:
+		log.Info("CRM integrator notified by the database as the customers were committed")
+	default:
+		log.Info("uploader signalled in process")
+	}
+	if err != nil {
+		return fmt.Errorf("while reading CSV file: %s", err)
+	}
+	log.Info("done")
+	return nil
+}
+
+// untilStopped returns a context cancelled once stop is closed.
+func untilStopped(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopOnSignal returns a channel closed on an interrupt or SIGTERM, so a watcher finishes the file being imported on
+// the way out rather than leave it half done, and a single import stops cleanly between batches.
+func stopOnSignal(log logging.Logger) <-chan struct{} {
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	ossignal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Info("stopping")
+		close(stop)
+	}()
+	return stop
+}
+
+// integrator is the uploader, as the services drive it.
+type integrator interface {
+	admin.Uploads
+	UseRPCListener(network, addr string) *listener.Listener
+	UseNotifyListener(connStr, channel string)
+	UseLocalListener() *listener.LocalListener
+	Health(c *health.Checker)
+	Start() error
+	Stop()
+}
+
+// newIntegrator returns an uploader configured by the crm and upload sections.
+func newIntegrator(cfg *config.Config, db database.Store, log logging.Logger) (integrator, error) {
+	uploader := upload.NewUploader(cfg.Signal.Addr, cfg.CRM.URL, cfg.CRM.CustomersPath, db)
+	uploader.SetLogger(log)
+	uploader.SetTimeout(cfg.CRM.Timeout)
+	uploader.SetWorkers(cfg.Upload.Workers)
+	uploader.SetQueueSize(cfg.Upload.QueueSize)
+	uploader.SetPageSize(cfg.Upload.PageSize)
+	uploader.SetCheckLimit(cfg.Upload.CheckLimit)
+	uploader.SetMaxBackoff(cfg.Upload.MaxBackoff)
+	uploader.SetCircuit(cfg.Upload.CircuitThreshold, cfg.Upload.CircuitCooldown)
+	if cfg.Upload.WorkerID != "" {
+		uploader.SetWorkerID(cfg.Upload.WorkerID)
+	}
+	if err := uploader.SetCRMIDSources(cfg.CRM.IDSources); err != nil {
+		return nil, fmt.Errorf("while setting CRM id sources: %s", err)
+	}
+	return uploader, nil
+}
+
+// newAdminAPI returns the admin API, or nil as it is only served when there is a token to protect it.
+func newAdminAPI(i config.Integrator, db database.AdminDB, uploads admin.Uploads, log logging.Logger) *admin.API {
+	if i.AdminToken == "" {
+		return nil
+	}
+	a := admin.NewAPI(db, uploads, i.AdminToken)
+	a.SetLogger(log)
+	return a
+}
+
+// handleStatus mounts the metrics, the health checks and the admin API, if there is one.
+func handleStatus(mux health.Mux, checker *health.Checker, adminAPI *admin.API) {
+	mux.Handle("/metrics", metrics.Handler())
+	checker.Handle(mux)
+	if adminAPI != nil {
+		mux.Handle(admin.Prefix, adminAPI)
+	}
+}
+
+// serveStatus serves the metrics, health checks and, if there is one, the admin API on an address of their own.
+func serveStatus(addr string, checker *health.Checker, adminAPI *admin.API) error {
+	mux := http.NewServeMux()
+	handleStatus(mux, checker, adminAPI)
+	return fmt.Errorf("while serving status: %s", http.ListenAndServe(addr, mux))
+}
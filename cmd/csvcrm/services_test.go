@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/config"
+	databaseMock "github.com/dbyington/csv-crm-upload/database/mock"
+	"github.com/dbyington/csv-crm-upload/health"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal/sender"
+)
+
+var _ = Describe("services", func() {
+	It("should only run a service with a valid config", func() {
+		ran := false
+		s := service{
+			sections: []string{config.SectionCRM},
+			run: func(cfg *config.Config, log logging.Logger) error {
+				ran = true
+				Expect(cfg.CRM.URL).To(Equal("http://localhost:8089"))
+				return nil
+			},
+		}
+
+		Expect(runService("upload", s, []string{"-nonsense"})).To(Equal(errUsage))
+		Expect(runService("upload", s, []string{"-crm=http://localhost:8089", "extra"})).To(Equal(errUsage))
+		Expect(runService("upload", s, []string{"-crmtimeout=0s", "-crm=http://localhost:8089"})).To(Equal(errUsage))
+		Expect(runService("upload", s, []string{"-h"})).To(Equal(flag.ErrHelp))
+		Expect(ran).To(BeFalse())
+
+		Expect(runService("upload", s, []string{"-crm=http://localhost:8089"})).To(Succeed())
+		Expect(ran).To(BeTrue())
+	})
+
+	It("should report a service that fails once it has been logged", func() {
+		s := service{
+			sections: []string{config.SectionLog},
+			run:      func(*config.Config, logging.Logger) error { return errors.New("no database") },
+		}
+		Expect(runService("migrate", s, []string{"-loglevel=error"})).To(Equal(errLogged))
+	})
+
+	It("should configure each service from the sections it uses", func() {
+		Expect(services["import"].sections).To(ContainElement(config.SectionImport))
+		Expect(services["upload"].sections).ToNot(ContainElement(config.SectionImport))
+		Expect(services["serve"].sections).ToNot(ContainElement(config.SectionSignal))
+	})
+
+	Context("importCSV", func() {
+		var (
+			file      string
+			mockCtrl  *gomock.Controller
+			mockStore *databaseMock.MockStore
+		)
+
+		BeforeEach(func() {
+			mockCtrl = gomock.NewController(GinkgoT())
+			mockStore = databaseMock.NewMockStore(mockCtrl)
+		})
+
+		AfterEach(func() {
+			mockCtrl.Finish()
+			os.Remove(file)
+		})
+
+		importCSVFile := func(contents string) error {
+			f, err := ioutil.TempFile("", "customers*.csv")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = f.WriteString(contents)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			file = f.Name()
+
+			newSender := func() sender.Signaler { return sender.NewNotifySender() }
+			return importCSV(config.Import{File: file, Buffer: 10}, mockStore, newSender, health.NewChecker(),
+				logging.Nop(), make(chan struct{}))
+		}
+
+		It("should import the file", func() {
+			mockStore.EXPECT().InsertCustomers(gomock.Any(), gomock.Any()).Return(nil, nil)
+			Expect(importCSVFile("id,first_name,last_name,email,phone\n1,jon,doe,jon.doe@mail.com,+1 212 555 1234\n")).
+				To(Succeed())
+		})
+
+		It("should fail if the file can't be read", func() {
+			Expect(importCSVFile("\"id,first_name\n")).To(MatchError(ContainSubstring("while reading CSV file")))
+		})
+	})
+
+	Context("mock-crm", func() {
+		It("should build the scenario from the flags", func() {
+			s, err := scenarioFromFlags("", 42, "503=0.1,429=0.05", time.Second, "fixed:10ms", "1m:30s", 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Seed).To(Equal(int64(42)))
+			Expect(s.Faults).To(HaveLen(2))
+			Expect(s.Outages).To(HaveLen(1))
+		})
+
+		It("should reject bad flags", func() {
+			Expect(mockCRM([]string{"-faults=503=lots"})).To(Equal(errUsage))
+		})
+	})
+})
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dbyington/csv-crm-upload/database"
+)
+
+// where collects -where flags into a customer filter. Each is key=value, for the keys state, email, crm_id, error and
+// id. An id is either a single customer id or an inclusive range such as 100-200.
+type where struct {
+	filter     database.CustomerFilter
+	conditions []string
+}
+
+func (w *where) String() string {
+	return strings.Join(w.conditions, " ")
+}
+
+func (w *where) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("%q must be key=value", s)
+	}
+
+	key, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+	switch key {
+	case "state":
+		if value != database.StateNotUploaded && !database.KnownState(value) {
+			return fmt.Errorf("state must be one of %s", strings.Join(append(database.States, database.StateNotUploaded), ", "))
+		}
+		w.filter.State = value
+	case "email":
+		w.filter.Email = value
+	case "crm_id":
+		w.filter.CRMID = value
+	case "error":
+		w.filter.Error = value
+	case "id":
+		min, max, err := parseIDs(value)
+		if err != nil {
+			return err
+		}
+		w.filter.MinID, w.filter.MaxID = min, max
+	default:
+		return fmt.Errorf("unknown key %q, must be one of state, email, crm_id, error or id", key)
+	}
+	w.conditions = append(w.conditions, key+"="+value)
+	return nil
+}
+
+func parseIDs(s string) (int64, int64, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || min < 1 {
+		return 0, 0, fmt.Errorf("id must be a customer id or a range of them, not %q", s)
+	}
+	if len(parts) == 1 {
+		return min, min, nil
+	}
+	max, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || max < min {
+		return 0, 0, fmt.Errorf("id must be a customer id or a range of them, not %q", s)
+	}
+	return min, max, nil
+}
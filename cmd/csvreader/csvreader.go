@@ -1,57 +1,94 @@
 package csvreader
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
-	"net/rpc"
 	"strconv"
 
 	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
 	"github.com/dbyington/csv-crm-upload/signal/sender"
 )
 
 type reader struct {
 	*csv.Reader
-	db         database.CustomerDB
+	db         database.Store
 	headerRow  bool
 	bufferSize int
-	sender     *sender.Sender
+	sender     sender.Signaler
+	jobID      string
+	priority   int
+	copy       bool
+	log        logging.Logger
+	line       int
 }
 
-func NewReader(db database.CustomerDB, f io.Reader, c *rpc.Client, noHeaderRow bool, lineBuffer int) *reader {
-	rpcSender := sender.NewSender(c)
-
+func NewReader(db database.Store, f io.Reader, s sender.Signaler, noHeaderRow bool, lineBuffer int) *reader {
+	jobID := newJobID()
 	return &reader{
 		Reader:     csv.NewReader(f),
 		db:         db,
 		headerRow:  !noHeaderRow,
 		bufferSize: lineBuffer,
-		sender:     rpcSender,
+		sender:     s,
+		jobID:      jobID,
+		log:        logging.Default().With(logging.F(logging.JobID, jobID)),
 	}
 }
 
+// SetLogger replaces the default logger. Every line is tagged with the job id.
+func (r *reader) SetLogger(l logging.Logger) {
+	r.log = l.With(logging.F(logging.JobID, r.jobID))
+}
+
+// SetPriority sets the priority sent with each signal. Higher priority imports get uploaded more eagerly.
+func (r *reader) SetPriority(p int) {
+	r.priority = p
+}
+
+// SetCopy makes the reader bulk load each buffer with COPY rather than inserting it, for large files.
+func (r *reader) SetCopy(useCopy bool) {
+	r.copy = useCopy
+}
+
+// JobID identifies this import in the signals sent to the CRM worker.
+func (r *reader) JobID() string {
+	return r.jobID
+}
+
 func (r *reader) Run() error {
+	return r.RunContext(context.Background())
+}
+
+// RunContext is Run, stopping once ctx is done. The customers inserted by then stay inserted and are signalled, the
+// rest of the file is left unread.
+func (r *reader) RunContext(ctx context.Context) error {
 	defer r.sender.Close()
 
-	if r.headerRow {
-		if err := r.dropHeaderRow(); err != nil {
-			return err
-		}
-	}
-	if err := r.readCustomers(); err != io.EOF {
+	// readCustomers drops the header row.
+	if err := r.readCustomers(ctx); err != io.EOF {
 		return err
 	}
 	return nil
 }
 
 func (r *reader) dropHeaderRow() error {
-	_, err := r.Read()
+	_, err := r.read()
 	return err
 }
 
-func (r *reader) readCustomers() error {
+// read reads the next row, keeping count of the rows read so problems can be reported by line.
+func (r *reader) read() ([]string, error) {
+	r.line++
+	return r.Read()
+}
+
+func (r *reader) readCustomers(ctx context.Context) error {
 	if r.headerRow {
 		if err := r.dropHeaderRow(); err != nil {
 			return err
@@ -60,10 +97,13 @@ func (r *reader) readCustomers() error {
 	customers := database.NewCustomers()
 	for {
 		if customers.Count() == r.bufferSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			// insertCustomers will log any issues with inserting customers into the database. Once
 			// row(s) have been inserted it will handle signalling to the CRM worker there are
 			// customers ready to upload.
-			r.insertCustomers(customers)
+			r.insertCustomers(ctx, customers)
 
 			// Clear the customers to start fresh.
 			customers = database.NewCustomers()
@@ -71,43 +111,94 @@ func (r *reader) readCustomers() error {
 
 		// While we have rows to read parse them and append them to the customer set.
 		if id, first, last, email, phone, err := r.parseRow(); err == nil {
-			customers.Append(r.db.NewCustomer(id, first, last, email, phone))
+			customers.Append(database.NewCustomer(id, first, last, email, phone))
 		} else {
 			if err == io.EOF {
-				r.insertCustomers(customers)
+				r.insertCustomers(ctx, customers)
 				return err
 			} else {
 				// If parseRow returns an error other than EOF just log it and continue.
-				log.Printf("error reading row: %s", err)
+				r.log.Warn("skipping row", logging.F(logging.Line, r.line), logging.Err(err))
 			}
 		}
 	}
 }
 
-func (r *reader) insertCustomers(customers database.Customers) {
-	// Insert our customer set. If we get an error it will have failed on the entire set so range through the Customer
-	// and try to insert the individual customers, logging which one(s) still fail.
-	if err := customers.Insert(); err != nil {
-		log.Print("error while inserting customer set, trying individual customer inserts.")
+// insertCustomers inserts the customers, or copies them if SetCopy was used, logging any that conflict with a customer
+// already imported and signalling the rest to the CRM worker together.
+func (r *reader) insertCustomers(ctx context.Context, customers database.Customers) {
+	// The last buffer is empty when the number of rows is a multiple of the buffer size.
+	if customers.Count() == 0 {
+		return
+	}
 
-		for _, c := range customers.List() {
-			if err := c.Insert(); err != nil {
-				log.Printf("ERROR inserting customer (%s %s, %s): %s", c.FirstName, c.LastName, c.Email, err)
-			} else {
-				if err := r.sender.Signal(); err != nil {
-					log.Printf("ERROR signaling CRM after inserting new customers: %s", err)
-				}
-			}
+	load := r.db.InsertCustomers
+	if r.copy {
+		load = r.db.CopyCustomers
+	}
+
+	// Customers that conflict are left out without failing the set, so an error means something is wrong with the set
+	// as a whole, or one of its rows the database can't take at all. Range through the customers and try to insert them
+	// individually to find out which, logging which one(s) still fail.
+	conflicts, err := load(ctx, customers...)
+	if err != nil {
+		// Inserting the customers one at a time won't get any further once the import has been cancelled.
+		if ctx.Err() != nil {
+			r.log.Warn("inserting customer set cancelled", logging.F("customers", customers.Count()), logging.Err(err))
+			return
 		}
-	} else {
-		if err := r.sender.Signal(); err != nil {
-			log.Printf("ERROR signaling CRM after inserting new customers: %s", err)
+		r.log.Warn("inserting customer set failed, trying individual customer inserts",
+			logging.F("customers", customers.Count()), logging.Err(err))
+		r.insertEach(ctx, customers)
+		return
+	}
+
+	r.reportConflicts(conflicts)
+	if inserted := customers.Without(conflicts); inserted.Count() > 0 {
+		r.signal(ctx, inserted.IDs()...)
+	}
+}
+
+// insertEach inserts the customers one at a time, logging those that fail and signalling those inserted together.
+func (r *reader) insertEach(ctx context.Context, customers database.Customers) {
+	var inserted []int64
+	for _, c := range customers {
+		conflicts, err := r.db.InsertCustomers(ctx, c)
+		switch {
+		case err != nil:
+			r.log.Error("inserting customer failed", logging.F(logging.CustomerID, c.Id),
+				logging.F(logging.Email, c.Email), logging.Err(err))
+		case len(conflicts) > 0:
+			r.reportConflicts(conflicts)
+		default:
+			inserted = append(inserted, c.Id)
 		}
 	}
+	if len(inserted) > 0 {
+		r.signal(ctx, inserted...)
+	}
+}
+
+// reportConflicts logs each customer left out of an insert, and the constraint it broke.
+func (r *reader) reportConflicts(conflicts []database.Conflict) {
+	for _, c := range conflicts {
+		r.log.Error("customer conflicts with one already imported", logging.F(logging.CustomerID, c.Customer.Id),
+			logging.F(logging.Email, c.Customer.Email), logging.F("constraint", c.Constraint))
+	}
+}
+
+// signal tells the CRM worker which customers have been inserted.
+func (r *reader) signal(ctx context.Context, ids ...int64) {
+	p := signal.ForIDs(ids...)
+	p.JobID = r.jobID
+	p.Priority = r.priority
+	if err := r.sender.SignalContext(ctx, p); err != nil {
+		r.log.Error("signalling CRM after inserting new customers failed", logging.Err(err))
+	}
 }
 
 func (r *reader) parseRow() (int64, string, string, string, string, error) {
-	row, err := r.Read()
+	row, err := r.read()
 	if err != nil {
 		if parseErr, ok := err.(*csv.ParseError); ok {
 			return 0, "", "", "", "", fmt.Errorf("parse error while reading row: %s", parseErr)
@@ -127,3 +218,12 @@ func (r *reader) parseRow() (int64, string, string, string, string, error) {
 	}
 	return int64(id), row[1], row[2], row[3], row[4], nil
 }
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// The job id is only informational, so don't fail the import over it.
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
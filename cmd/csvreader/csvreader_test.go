@@ -2,7 +2,9 @@ package csvreader
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -17,6 +19,8 @@ import (
 
 	"github.com/dbyington/csv-crm-upload/database"
 	databaseMock "github.com/dbyington/csv-crm-upload/database/mock"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
 	"github.com/dbyington/csv-crm-upload/signal/sender"
 )
 
@@ -29,6 +33,32 @@ func (b *buffer) Close() error {
     return nil
 }
 
+// recordingSender keeps every signal it is sent.
+type recordingSender struct {
+	payloads []signal.Payload
+}
+
+func (s *recordingSender) Signal(p signal.Payload) error {
+	s.payloads = append(s.payloads, p)
+	return nil
+}
+
+func (s *recordingSender) SignalContext(ctx context.Context, p signal.Payload) error {
+	return s.Signal(p)
+}
+
+func (s *recordingSender) Close() error {
+	return nil
+}
+
+// jsonContaining matches a JSON query argument that contains the text.
+type jsonContaining string
+
+func (j jsonContaining) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && strings.Contains(s, string(j))
+}
+
 var (
 	errTest = errors.New("test error")
 
@@ -54,13 +84,13 @@ var _ = Describe("Csv", func() {
 		rpcClient *rpc.Client
 		rpcSender *sender.Sender
 
-		mockCustomers *databaseMock.MockCustomers
+		mockStore *databaseMock.MockStore
 	)
 
 	BeforeEach(func() {
 		dbMock, mockDB, err = sqlmock.New()
 		mockCtrl = gomock.NewController(GinkgoT())
-		mockCustomers = databaseMock.NewMockCustomers(mockCtrl)
+		mockStore = databaseMock.NewMockStore(mockCtrl)
 		rpcBuffer = &buffer{}
 		rpcClient = rpc.NewClient(rpcBuffer)
 		rpcSender = sender.NewSender(rpcClient)
@@ -72,20 +102,24 @@ var _ = Describe("Csv", func() {
 			csvString = csvHeaderRow + "\n" + goodCSV
 			hasHeader = true
 			r = &reader{
-				csv.NewReader(strings.NewReader(csvString)),
-				database.NewCustomerDB(dbMock),
-				!hasHeader,
-				5,
-				rpcSender,
+				Reader:     csv.NewReader(strings.NewReader(csvString)),
+				db:         database.NewCustomerDB(dbMock),
+				headerRow:  !hasHeader,
+				bufferSize: 5,
+				sender:     rpcSender,
+				log:        logging.Nop(),
 			}
 			testR = NewReader(database.NewCustomerDB(dbMock),
 				strings.NewReader(csvString),
-				rpcClient,
+				rpcSender,
 				hasHeader,
 				5)
 		})
 		It("should return a reader", func() {
 			Expect(testR).ToNot(BeNil())
+			Expect(testR.JobID()).To(HaveLen(16))
+			r.jobID = testR.JobID()
+			r.log = testR.log
 			Expect(testR).To(BeEquivalentTo(r))
 		})
 	})
@@ -119,11 +153,12 @@ var _ = Describe("Csv", func() {
 				csvString = ""
 				hasHeader = true
 				r = &reader{
-					csv.NewReader(strings.NewReader(csvString)),
-					database.NewCustomerDB(dbMock),
-					hasHeader,
-					5,
-					rpcSender,
+					Reader:     csv.NewReader(strings.NewReader(csvString)),
+					db:         database.NewCustomerDB(dbMock),
+					headerRow:  hasHeader,
+					bufferSize: 5,
+					sender:     rpcSender,
+					log:        logging.Nop(),
 				}
 			})
 
@@ -139,20 +174,21 @@ var _ = Describe("Csv", func() {
 				csvString = goodCSV
 				hasHeader = false
 				r = &reader{
-					csv.NewReader(strings.NewReader(csvString)),
-					database.NewCustomerDB(dbMock),
-					hasHeader,
-					5,
-					rpcSender,
+					Reader:     csv.NewReader(strings.NewReader(csvString)),
+					db:         database.NewCustomerDB(dbMock),
+					headerRow:  hasHeader,
+					bufferSize: 5,
+					sender:     rpcSender,
+					log:        logging.Nop(),
 				}
 			})
 
 			It("should append to the customers", func() {
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec("INSERT").WithArgs().WillReturnResult(sqlmock.NewResult(1, 1))
+				mockDB.ExpectQuery("INSERT INTO customers").WithArgs().WillReturnRows(sqlmock.NewRows([]string{"seq", "constraint"}))
 				mockDB.ExpectCommit()
 
-				err = r.readCustomers()
+				err = r.readCustomers(context.Background())
 				Expect(err).To(MatchError(io.EOF))
 			})
 		})
@@ -164,27 +200,59 @@ var _ = Describe("Csv", func() {
 					"\n" + goodCSV
 				hasHeader = true
 				r = &reader{
-					csv.NewReader(strings.NewReader(csvString)),
-					database.NewCustomerDB(dbMock),
-					hasHeader,
-					5,
-					rpcSender,
+					Reader:     csv.NewReader(strings.NewReader(csvString)),
+					db:         database.NewCustomerDB(dbMock),
+					headerRow:  hasHeader,
+					bufferSize: 5,
+					sender:     rpcSender,
+					log:        logging.Nop(),
 				}
 			})
 
 			It("should insert and continue", func() {
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec("INSERT").WithArgs().WillReturnResult(sqlmock.NewResult(1, 1))
+				mockDB.ExpectQuery("INSERT INTO customers").WithArgs().WillReturnRows(sqlmock.NewRows([]string{"seq", "constraint"}))
 				mockDB.ExpectCommit()
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec("INSERT").WithArgs().WillReturnResult(sqlmock.NewResult(1, 1))
+				mockDB.ExpectQuery("INSERT INTO customers").WithArgs().WillReturnRows(sqlmock.NewRows([]string{"seq", "constraint"}))
 				mockDB.ExpectCommit()
-				err = r.readCustomers()
+				err = r.readCustomers(context.Background())
 				Expect(err).To(MatchError(io.EOF))
 			})
 		})
 	})
 
+	Context("Run", func() {
+		BeforeEach(func() {
+			r = &reader{
+				Reader:     csv.NewReader(strings.NewReader(csvHeaderRow + "\n" + goodCSV)),
+				db:         database.NewCustomerDB(dbMock),
+				headerRow:  true,
+				bufferSize: 5,
+				sender:     rpcSender,
+				log:        logging.Nop(),
+			}
+		})
+
+		It("should insert the first customer after the header row", func() {
+			mockDB.ExpectBegin()
+			mockDB.ExpectQuery("INSERT INTO customers").WithArgs(jsonContaining(`"id":1,`)).WillReturnRows(sqlmock.NewRows([]string{"seq", "constraint"}))
+			mockDB.ExpectCommit()
+
+			Expect(r.Run()).To(Succeed())
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should stop reading once cancelled", func() {
+			r.Reader = csv.NewReader(strings.NewReader(csvHeaderRow + strings.Repeat("\n"+goodCSV, 7)))
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			Expect(r.RunContext(ctx)).To(MatchError(context.Canceled))
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
 	Context("parseRow", func() {
 		var id int64
 		var first, last, email, phone string
@@ -195,11 +263,12 @@ var _ = Describe("Csv", func() {
 				csvString = goodCSV
 				hasHeader = false
 				r = &reader{
-					csv.NewReader(strings.NewReader(csvString)),
-					database.NewCustomerDB(dbMock),
-					hasHeader,
-					5,
-					rpcSender,
+					Reader:     csv.NewReader(strings.NewReader(csvString)),
+					db:         database.NewCustomerDB(dbMock),
+					headerRow:  hasHeader,
+					bufferSize: 5,
+					sender:     rpcSender,
+					log:        logging.Nop(),
 				}
 				id, first, last, email, phone, err = r.parseRow()
 			})
@@ -219,11 +288,12 @@ var _ = Describe("Csv", func() {
 				csvString = badCSV
 				hasHeader = false
 				r = &reader{
-					csv.NewReader(strings.NewReader(csvString)),
-					database.NewCustomerDB(dbMock),
-					hasHeader,
-					5,
-					rpcSender,
+					Reader:     csv.NewReader(strings.NewReader(csvString)),
+					db:         database.NewCustomerDB(dbMock),
+					headerRow:  hasHeader,
+					bufferSize: 5,
+					sender:     rpcSender,
+					log:        logging.Nop(),
 				}
 				id, first, last, email, phone, err = r.parseRow()
 			})
@@ -238,11 +308,12 @@ var _ = Describe("Csv", func() {
 				csvString = ""
 				hasHeader = false
 				r = &reader{
-					csv.NewReader(strings.NewReader(csvString)),
-					database.NewCustomerDB(dbMock),
-					hasHeader,
-					5,
-					rpcSender,
+					Reader:     csv.NewReader(strings.NewReader(csvString)),
+					db:         database.NewCustomerDB(dbMock),
+					headerRow:  hasHeader,
+					bufferSize: 5,
+					sender:     rpcSender,
+					log:        logging.Nop(),
 				}
 				id, first, last, email, phone, err = r.parseRow()
 			})
@@ -254,28 +325,97 @@ var _ = Describe("Csv", func() {
 	})
 
 	Context("insertCustomers", func() {
+		var (
+			customers database.Customers
+			signals   *recordingSender
+		)
+
 		BeforeEach(func() {
+			signals = &recordingSender{}
+			r = &reader{
+				db:     mockStore,
+				sender: signals,
+				log:    logging.Nop(),
+			}
+			customers = database.NewCustomers(database.NewCustomer(1, "jon", "doe", "jon.doe@mail.com", ""),
+				database.NewCustomer(2, "jane", "doe", "jane.doe@mail.com", ""),
+				database.NewCustomer(3, "steve", "stevenson", "steves@mail.com", ""))
+		})
 
+		AfterEach(func() {
+			mockCtrl.Finish()
 		})
 
 		Context("when the customers insert succeeds", func() {
-			BeforeEach(func() {
-				mockCustomers.EXPECT().Insert().Times(1).Return(nil)
+			It("should insert them together and signal once", func() {
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[0], customers[1], customers[2]).Return(nil, nil)
+				r.insertCustomers(context.Background(), customers)
+				Expect(signals.payloads).To(Equal([]signal.Payload{signal.ForIDs(1, 2, 3)}))
 			})
+		})
 
-			// TODO: When signalling is available this should be completed.
-			It("should signal rows have been inserted", func() {
-				Expect(nil).To(BeNil())
+		Context("when some of the customers conflict", func() {
+			It("should signal the rest once", func() {
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[0], customers[1], customers[2]).
+					Return([]database.Conflict{{Customer: customers[1], Constraint: database.ConstraintEmail}}, nil)
+				r.insertCustomers(context.Background(), customers)
+				Expect(signals.payloads).To(Equal([]signal.Payload{signal.ForIDs(1, 3)}))
+			})
+		})
+
+		Context("when every customer conflicts", func() {
+			It("should not signal", func() {
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[0], customers[1], customers[2]).
+					Return([]database.Conflict{{Customer: customers[0], Constraint: database.ConstraintID},
+						{Customer: customers[1], Constraint: database.ConstraintID},
+						{Customer: customers[2], Constraint: database.ConstraintEmail}}, nil)
+				r.insertCustomers(context.Background(), customers)
+				Expect(signals.payloads).To(BeEmpty())
 			})
 		})
 
 		Context("when the customers insert fails", func() {
+			It("should insert them one at a time and signal those inserted once", func() {
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[0], customers[1], customers[2]).Return(nil, errTest)
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[0]).Return(nil, errTest)
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[1]).
+					Return([]database.Conflict{{Customer: customers[1], Constraint: database.ConstraintID}}, nil)
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[2]).Return(nil, nil)
+				r.insertCustomers(context.Background(), customers)
+				Expect(signals.payloads).To(Equal([]signal.Payload{signal.ForIDs(3)}))
+			})
+		})
+
+		Context("when the import has been cancelled", func() {
+			It("should not try them one at a time", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[0], customers[1], customers[2]).
+					Return(nil, context.Canceled)
+				r.insertCustomers(ctx, customers)
+				Expect(signals.payloads).To(BeEmpty())
+			})
+		})
+
+		Context("when copying", func() {
 			BeforeEach(func() {
-				mockCustomers.EXPECT().Insert().Times(1).Return(errTest)
+				r.SetCopy(true)
+			})
+
+			It("should signal the customers copied and leave out those that conflict", func() {
+				mockStore.EXPECT().CopyCustomers(gomock.Any(), customers[0], customers[1], customers[2]).
+					Return([]database.Conflict{{Customer: customers[0], Constraint: database.ConstraintEmail}}, nil)
+				r.insertCustomers(context.Background(), customers)
+				Expect(signals.payloads).To(Equal([]signal.Payload{signal.ForIDs(2, 3)}))
 			})
 
-			It("should get the customer list", func() {
-				mockCustomers.EXPECT().List().Times(1)
+			It("should insert them one at a time when the copy fails", func() {
+				mockStore.EXPECT().CopyCustomers(gomock.Any(), customers[0], customers[1], customers[2]).Return(nil, errTest)
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[0]).Return(nil, nil)
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[1]).Return(nil, errTest)
+				mockStore.EXPECT().InsertCustomers(gomock.Any(), customers[2]).Return(nil, nil)
+				r.insertCustomers(context.Background(), customers)
+				Expect(signals.payloads).To(Equal([]signal.Payload{signal.ForIDs(1, 3)}))
 			})
 		})
 	})
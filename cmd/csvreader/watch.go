@@ -0,0 +1,182 @@
+package csvreader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal/sender"
+)
+
+const defaultWatchInterval = 10 * time.Second
+
+// Imported files are moved into one of these subdirectories of the watched directory so they aren't imported twice.
+const (
+	doneDir   = "done"
+	failedDir = "failed"
+)
+
+// Watcher imports every CSV file that appears in a directory, for running the csvReader as a long-lived service.
+// Files should be moved into the directory once complete rather than written in place, or a file may be imported
+// while it is still being written.
+type Watcher struct {
+	db          database.Store
+	dir         string
+	newSender   func() sender.Signaler
+	noHeaderRow bool
+	bufferSize  int
+	priority    int
+	copy        bool
+	interval    time.Duration
+	log         logging.Logger
+	now         func() time.Time
+
+	mutex    sync.Mutex
+	lastScan time.Time
+	scanErr  error
+	current  string
+}
+
+// NewWatcher returns a Watcher for dir. Each file is imported with a sender from newSender, which is closed once the
+// file is done.
+func NewWatcher(db database.Store, dir string, newSender func() sender.Signaler, noHeaderRow bool, lineBuffer int) *Watcher {
+	return &Watcher{
+		db:          db,
+		dir:         dir,
+		newSender:   newSender,
+		noHeaderRow: noHeaderRow,
+		bufferSize:  lineBuffer,
+		interval:    defaultWatchInterval,
+		log:         logging.Default(),
+		now:         time.Now,
+	}
+}
+
+// SetInterval sets how often the directory is checked for new files.
+func (w *Watcher) SetInterval(d time.Duration) {
+	w.interval = d
+}
+
+// SetPriority sets the priority of every import.
+func (w *Watcher) SetPriority(p int) {
+	w.priority = p
+}
+
+// SetCopy makes every import bulk load with COPY, see the reader's SetCopy.
+func (w *Watcher) SetCopy(useCopy bool) {
+	w.copy = useCopy
+}
+
+// SetLogger replaces the default logger.
+func (w *Watcher) SetLogger(l logging.Logger) {
+	w.log = l
+}
+
+// Run imports files until stop is closed. A file being imported when stop is closed is finished first.
+func (w *Watcher) Run(stop <-chan struct{}) error {
+	for _, d := range []string{doneDir, failedDir} {
+		if err := os.MkdirAll(filepath.Join(w.dir, d), 0755); err != nil {
+			return fmt.Errorf("while creating %s directory: %s", d, err)
+		}
+	}
+
+	w.log.Info("watching for CSV files", logging.F("dir", w.dir), logging.F("interval", w.interval))
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.scan(stop)
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Healthy is a health check that fails if the directory can't be read or hasn't been checked recently. A long
+// import holds up the next check, so the watcher is healthy for as long as it's importing.
+func (w *Watcher) Healthy(ctx context.Context) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	switch {
+	case w.current != "":
+		return nil
+	case w.scanErr != nil:
+		return w.scanErr
+	case w.lastScan.IsZero():
+		return errors.New("not watching yet")
+	}
+	if since := w.now().Sub(w.lastScan); since > 3*w.interval {
+		return fmt.Errorf("last checked for files %s ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+func (w *Watcher) scan(stop <-chan struct{}) {
+	files, err := filepath.Glob(filepath.Join(w.dir, "*.csv"))
+	if err == nil {
+		// Glob only fails on a bad pattern, so make sure the directory is still there.
+		_, err = os.Stat(w.dir)
+	}
+	if err != nil {
+		w.log.Error("checking for CSV files failed", logging.F("dir", w.dir), logging.Err(err))
+	}
+
+	w.mutex.Lock()
+	w.lastScan = w.now()
+	w.scanErr = err
+	w.mutex.Unlock()
+
+	for _, path := range files {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		w.importFile(path)
+	}
+}
+
+func (w *Watcher) importFile(path string) {
+	w.setCurrent(path)
+	defer w.setCurrent("")
+
+	log := w.log.With(logging.F("filename", path))
+	dest := doneDir
+	if err := w.read(path, log); err != nil {
+		log.Error("importing file failed", logging.Err(err))
+		dest = failedDir
+	}
+
+	if err := os.Rename(path, filepath.Join(w.dir, dest, filepath.Base(path))); err != nil {
+		log.Error("moving imported file failed", logging.Err(err))
+	}
+}
+
+func (w *Watcher) read(path string, log logging.Logger) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("while opening CSV file: %s", err)
+	}
+	defer f.Close()
+
+	r := NewReader(w.db, f, w.newSender(), w.noHeaderRow, w.bufferSize)
+	r.SetLogger(log)
+	r.SetPriority(w.priority)
+	r.SetCopy(w.copy)
+	log.Info("importing file", logging.F(logging.JobID, r.JobID()))
+	return r.Run()
+}
+
+func (w *Watcher) setCurrent(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.current = path
+}
@@ -0,0 +1,117 @@
+package csvreader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal/sender"
+)
+
+var _ = Describe("Watcher", func() {
+	var (
+		err     error
+		dir     string
+		w       *Watcher
+		stop    chan struct{}
+		stopped chan error
+	)
+
+	write := func(name, contents string) {
+		Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		dbMock, mockDB, err = sqlmock.New()
+		Expect(err).ToNot(HaveOccurred())
+
+		dir, err = ioutil.TempDir("", "watch")
+		Expect(err).ToNot(HaveOccurred())
+
+		newSender := func() sender.Signaler { return sender.NewNotifySender() }
+		w = NewWatcher(database.NewCustomerDB(dbMock), dir, newSender, true, 5)
+		w.SetLogger(logging.Nop())
+		w.SetInterval(10 * time.Millisecond)
+		stop = make(chan struct{})
+		stopped = make(chan error, 1)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context(".Run", func() {
+		JustBeforeEach(func() {
+			go func() { stopped <- w.Run(stop) }()
+		})
+
+		AfterEach(func() {
+			close(stop)
+			Eventually(stopped).Should(Receive(BeNil()))
+		})
+
+		Context("when a file is dropped in", func() {
+			BeforeEach(func() {
+				mockDB.ExpectBegin()
+				mockDB.ExpectQuery("INSERT INTO customers").WillReturnRows(sqlmock.NewRows([]string{"seq", "constraint"}))
+				mockDB.ExpectCommit()
+				write("customers.csv", goodCSV+"\n")
+			})
+
+			It("should import it and move it to done", func() {
+				Eventually(filepath.Join(dir, doneDir, "customers.csv")).Should(BeAnExistingFile())
+				Expect(filepath.Join(dir, "customers.csv")).ToNot(BeAnExistingFile())
+				Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+			})
+		})
+
+		Context("when a file can't be imported", func() {
+			BeforeEach(func() {
+				w.noHeaderRow = false
+				write("broken.csv", `"unterminated`)
+			})
+
+			It("should move it to failed", func() {
+				Eventually(filepath.Join(dir, failedDir, "broken.csv")).Should(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context(".Healthy", func() {
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now()
+			w.now = func() time.Time { return now }
+		})
+
+		It("should not be healthy before the directory is checked", func() {
+			Expect(w.Healthy(context.Background())).To(MatchError("not watching yet"))
+		})
+
+		It("should be healthy once the directory is checked", func() {
+			w.scan(stop)
+			Expect(w.Healthy(context.Background())).To(Succeed())
+		})
+
+		It("should be unhealthy once checks stop", func() {
+			w.scan(stop)
+			now = now.Add(time.Minute)
+			Expect(w.Healthy(context.Background())).To(MatchError("last checked for files 1m0s ago"))
+		})
+
+		It("should be unhealthy when the directory goes missing", func() {
+			os.RemoveAll(dir)
+			w.scan(stop)
+			Expect(w.Healthy(context.Background())).To(HaveOccurred())
+		})
+	})
+})
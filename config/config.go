@@ -0,0 +1,252 @@
+// Package config holds the settings of the csvReader and the crmIntegrator. Every setting is taken from, in increasing
+// order of precedence: its default, the config file, its environment variable and its command line flag. So a flag
+// always wins, and a config file only needs the settings that differ from the defaults.
+//
+// The config file is named by the -config flag or CSVCRM_CONFIG. A file ending .json is JSON with an object for each
+// section; anything else is TOML-style, a [section] line before the key = value lines of that section, with # comments
+// on lines of their own. Durations are written as Go durations, such as 30s or 5m.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+// The sections of the config. A command loads the sections it uses; the others keep their defaults and aren't checked.
+const (
+	SectionDatabase   = "database"
+	SectionSignal     = "signal"
+	SectionImport     = "import"
+	SectionCRM        = "crm"
+	SectionUpload     = "upload"
+	SectionIntegrator = "integrator"
+	SectionLog        = "log"
+)
+
+// The ways the csvReader can signal the crmIntegrator.
+const (
+	SignalRPC    = "rpc"
+	SignalNotify = "notify"
+)
+
+// Config is every setting of both services.
+type Config struct {
+	Database   Database
+	Signal     Signal
+	Import     Import
+	CRM        CRM
+	Upload     Upload
+	Integrator Integrator
+	Log        Log
+}
+
+// Database is how to connect to Postgres, either by a full DSN or its parts.
+type Database = database.Config
+
+// Signal is how the csvReader tells the crmIntegrator customers are ready.
+type Signal struct {
+	// Mode is SignalRPC or SignalNotify.
+	Mode string
+	// Network and Addr are where the integrator listens for RPC signals, tcp or unix.
+	Network string
+	Addr    string
+	Secret  string
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+	// Timeout is how long connecting to the listener, and each signal, may take.
+	Timeout time.Duration
+	// Wait is how long the reader keeps trying to signal once its import has finished.
+	Wait time.Duration
+}
+
+// Import is what the csvReader imports and how.
+type Import struct {
+	File     string
+	NoHeader bool
+	// Buffer is how many rows are inserted at a time, bulk loaded with COPY if Copy is set.
+	Buffer   int
+	Priority int
+	Copy     bool
+	// WatchDir, if set, runs the reader as a service importing every file moved into it.
+	WatchDir      string
+	WatchInterval time.Duration
+	StatusAddr    string
+}
+
+// CRM is where customers are uploaded to.
+type CRM struct {
+	URL           string
+	CustomersPath string
+	Timeout       time.Duration
+	IDSources     string
+}
+
+// Upload tunes how the crmIntegrator uploads.
+type Upload struct {
+	// Workers post customers at the same time, from a queue of QueueSize customers.
+	Workers     int
+	QueueSize   int
+	MaxAttempts int
+	WorkerID    string
+	// PageSize customers are selected at a time, up to CheckLimit in a single check for work, 0 for no limit.
+	PageSize   int
+	CheckLimit int
+	// MaxBackoff caps the growing wait between checks for work, 0 for no cap.
+	MaxBackoff time.Duration
+	// CircuitThreshold failed posts in a row hold posts back for CircuitCooldown.
+	CircuitThreshold int
+	CircuitCooldown  time.Duration
+}
+
+// Integrator is what the crmIntegrator serves besides its signal listener.
+type Integrator struct {
+	MetricsAddr string
+	AdminToken  string
+}
+
+// Log is how both services log.
+type Log struct {
+	Format    string
+	Level     string
+	RedactPII bool
+}
+
+// Default returns the settings used when nothing else is given.
+func Default() *Config {
+	return &Config{
+		Database: Database{
+			Host:         "localhost",
+			SSLMode:      "disable",
+			MaxIdleConns: 2,
+			ReadyTimeout: 30 * time.Second,
+			Timeouts:     database.Timeouts{Insert: database.DefaultTimeout, Select: database.DefaultTimeout, Update: database.DefaultTimeout},
+		},
+		Signal: Signal{Mode: SignalRPC, Network: "tcp", Addr: "localhost:9876", Timeout: 5 * time.Second, Wait: 5 * time.Second},
+		Import: Import{Buffer: 5, WatchInterval: 10 * time.Second},
+		CRM: CRM{
+			CustomersPath: "/customers",
+			Timeout:       30 * time.Second,
+			IDSources:     "json:id,header:Location",
+		},
+		Upload: Upload{
+			Workers:          1,
+			QueueSize:        25,
+			PageSize:         500,
+			CheckLimit:       10000,
+			MaxAttempts:      10,
+			CircuitThreshold: 5,
+			CircuitCooldown:  30 * time.Second,
+		},
+		Log: Log{Format: "logfmt", Level: "info", RedactPII: true},
+	}
+}
+
+// Validate checks the settings of the sections given make sense together.
+func (c *Config) Validate(sections ...string) error {
+	checks := map[string]func() error{
+		SectionDatabase:   c.Database.Validate,
+		SectionSignal:     c.Signal.validate,
+		SectionImport:     c.Import.validate,
+		SectionCRM:        c.CRM.validate,
+		SectionUpload:     c.Upload.validate,
+		SectionIntegrator: func() error { return nil },
+		SectionLog: func() error {
+			_, err := c.Log.Options()
+			return err
+		},
+	}
+	for _, s := range sections {
+		check, ok := checks[s]
+		if !ok {
+			return fmt.Errorf("unknown config section %q", s)
+		}
+		if err := check(); err != nil {
+			return fmt.Errorf("%s: %s", s, err)
+		}
+	}
+	return nil
+}
+
+func (s Signal) validate() error {
+	switch {
+	case s.Mode != SignalRPC && s.Mode != SignalNotify:
+		return fmt.Errorf("mode must be %s or %s, not %q", SignalRPC, SignalNotify, s.Mode)
+	case s.Network != "tcp" && s.Network != "unix":
+		return fmt.Errorf("network must be tcp or unix, not %q", s.Network)
+	case s.Mode == SignalRPC && s.Addr == "":
+		return fmt.Errorf("addr is required")
+	case s.TLSCert != "" && s.TLSKey == "":
+		return fmt.Errorf("tls_key is required with tls_cert")
+	case s.Timeout < 0:
+		return fmt.Errorf("timeout can't be negative")
+	case s.Wait < 0:
+		return fmt.Errorf("wait can't be negative")
+	}
+	return nil
+}
+
+func (i Import) validate() error {
+	switch {
+	case i.File == "" && i.WatchDir == "":
+		return fmt.Errorf("file or watch_dir is required")
+	case i.Buffer < 1:
+		return fmt.Errorf("buffer must be at least 1")
+	case i.WatchInterval <= 0:
+		return fmt.Errorf("watch_interval must be positive")
+	}
+	return nil
+}
+
+func (c CRM) validate() error {
+	u, err := url.Parse(c.URL)
+	switch {
+	case c.URL == "":
+		return fmt.Errorf("url is required")
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return fmt.Errorf("url must be an http or https URL, not %q", c.URL)
+	case !strings.HasPrefix(c.CustomersPath, "/"):
+		return fmt.Errorf("customers_path must start with /")
+	case c.Timeout <= 0:
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
+
+func (u Upload) validate() error {
+	switch {
+	case u.Workers < 1:
+		return fmt.Errorf("workers must be at least 1")
+	case u.QueueSize < 1:
+		return fmt.Errorf("queue_size must be at least 1")
+	case u.PageSize < 1:
+		return fmt.Errorf("page_size must be at least 1")
+	case u.CheckLimit < 0:
+		return fmt.Errorf("check_limit can't be negative")
+	case u.MaxAttempts < 1:
+		return fmt.Errorf("max_attempts must be at least 1")
+	case u.CircuitThreshold < 1:
+		return fmt.Errorf("circuit_threshold must be at least 1")
+	case u.MaxBackoff < 0 || u.CircuitCooldown < 0:
+		return fmt.Errorf("durations can't be negative")
+	}
+	return nil
+}
+
+// Options are the logging options, or an error if the format or level isn't known.
+func (l Log) Options() (logging.Options, error) {
+	format, err := logging.ParseFormat(l.Format)
+	if err != nil {
+		return logging.Options{}, err
+	}
+	level, err := logging.ParseLevel(l.Level)
+	if err != nil {
+		return logging.Options{}, err
+	}
+	return logging.Options{Level: level, Format: format, RedactPII: l.RedactPII}, nil
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		dir string
+		fs  *flag.FlagSet
+		// restore puts back the environment variables the test changed.
+		restore []func()
+	)
+
+	// The integrator's sections, which need a CRM URL but nothing else.
+	sections := []string{SectionDatabase, SectionSignal, SectionCRM, SectionUpload, SectionLog}
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return path
+	}
+
+	setenv := func(key, value string) {
+		old, set := os.LookupEnv(key)
+		Expect(os.Setenv(key, value)).To(Succeed())
+		restore = append(restore, func() {
+			if set {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Expect(err).ToNot(HaveOccurred())
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		setenv("POSTGRES_DATABASE", "crm")
+		setenv("CRM_SERVER_ADDR", "")
+		setenv(FileEnv, "")
+	})
+
+	AfterEach(func() {
+		for i := len(restore) - 1; i >= 0; i-- {
+			restore[i]()
+		}
+		restore = nil
+		os.RemoveAll(dir)
+	})
+
+	It("should start from the defaults", func() {
+		c, err := Load(fs, []string{"-crm=http://localhost:8089"}, sections...)
+		Expect(err).ToNot(HaveOccurred())
+		want := Default()
+		want.Database.Name = "crm"
+		want.CRM.URL = "http://localhost:8089"
+		Expect(c).To(Equal(want))
+	})
+
+	It("should read a TOML-style file", func() {
+		path := write("csvcrm.toml", `
+# The CRM.
+[crm]
+url = "http://crm:8089"
+timeout = 10s
+
+[upload]
+workers = 4
+`)
+		c, err := Load(fs, []string{"-config=" + path}, sections...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.CRM.URL).To(Equal("http://crm:8089"))
+		Expect(c.CRM.Timeout).To(Equal(10 * time.Second))
+		Expect(c.Upload.Workers).To(Equal(4))
+	})
+
+	It("should read a JSON file named by the environment", func() {
+		setenv(FileEnv, write("csvcrm.json", `{"crm": {"url": "http://crm:8089"}, "log": {"redact_pii": false}, "upload": {"queue_size": 50}}`))
+		c, err := Load(fs, nil, sections...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.CRM.URL).To(Equal("http://crm:8089"))
+		Expect(c.Log.RedactPII).To(BeFalse())
+		Expect(c.Upload.QueueSize).To(Equal(50))
+	})
+
+	It("should prefer the environment to the file and flags to both", func() {
+		path := write("csvcrm.toml", "[crm]\nurl = http://file:8089\ntimeout = 10s\n[upload]\nworkers = 2\n")
+		setenv("CRM_SERVER_ADDR", "http://env:8089")
+		setenv("CRM_TIMEOUT", "20s")
+		c, err := Load(fs, []string{"-config", path, "-crmtimeout=40s"}, sections...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Upload.Workers).To(Equal(2))
+		Expect(c.CRM.URL).To(Equal("http://env:8089"))
+		Expect(c.CRM.Timeout).To(Equal(40 * time.Second))
+	})
+
+	It("should only define the flags of the sections loaded", func() {
+		_, err := Load(fs, []string{"-filename=customers.csv", "-crm=http://localhost:8089"}, sections...)
+		Expect(err).To(MatchError(ContainSubstring("flag provided but not defined: -filename")))
+	})
+
+	It("should take boolean flags without a value", func() {
+		c, err := Load(fs, []string{"-noheader", "-filename=customers.csv"}, SectionImport)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Import.NoHeader).To(BeTrue())
+	})
+
+	It("should reject unknown settings and bad values", func() {
+		_, err := Load(fs, []string{"-config=" + write("bad.toml", "[crm]\nurl_typo = x\n")}, sections...)
+		Expect(err).To(MatchError(ContainSubstring(`unknown setting "crm.url_typo"`)))
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		setenv("CRM_WORKERS", "many")
+		_, err = Load(fs, []string{"-crm=http://localhost:8089"}, sections...)
+		Expect(err).To(MatchError(ContainSubstring("CRM_WORKERS")))
+	})
+
+	It("should validate the sections loaded", func() {
+		_, err := Load(fs, nil, sections...)
+		Expect(err).To(MatchError("crm: url is required"))
+
+		c := Default()
+		c.Signal.Mode = "carrier-pigeon"
+		Expect(c.Validate(SectionSignal)).To(MatchError(ContainSubstring("mode must be rpc or notify")))
+		Expect(c.Validate(SectionLog)).To(Succeed())
+		c.Upload.Workers = 0
+		Expect(c.Validate(SectionUpload)).To(MatchError("upload: workers must be at least 1"))
+		c.Upload.Workers, c.Upload.PageSize = 1, 0
+		Expect(c.Validate(SectionUpload)).To(MatchError("upload: page_size must be at least 1"))
+		Expect(c.Validate("nonsense")).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,339 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileEnv names the config file when the -config flag isn't given.
+const FileEnv = "CSVCRM_CONFIG"
+
+// setting is one tunable: its key in the config file, its environment variable and its flag. Settings without a flag
+// can only be set from a file or the environment.
+type setting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+func (s setting) section() string {
+	return s.key[:strings.Index(s.key, ".")]
+}
+
+// settings lists every setting of c, bound to its field.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"database.dsn", "DATABASE_URL", "dsn", "Postgres connection string, used in place of the other database connection settings.", (*stringValue)(&c.Database.DSN)},
+		{"database.host", "POSTGRES_HOST", "dbhost", "Hostname, and optionally port, of the postgres database.", (*stringValue)(&c.Database.Host)},
+		{"database.port", "POSTGRES_PORT", "dbport", "Port of the postgres database, when it isn't given with the host.", (*intValue)(&c.Database.Port)},
+		{"database.user", "POSTGRES_CSV_USER", "username", "Username used to connect to the postgres database.", (*stringValue)(&c.Database.User)},
+		{"database.password", "POSTGRES_CSV_PASSWORD", "password", "Password used to connect to the postgres database.", (*stringValue)(&c.Database.Password)},
+		{"database.name", "POSTGRES_DATABASE", "database", "Name of the postgres database.", (*stringValue)(&c.Database.Name)},
+		{"database.sslmode", "POSTGRES_SSLMODE", "sslmode", "Postgres sslmode used to connect to the database.", (*stringValue)(&c.Database.SSLMode)},
+		{"database.sslcert", "POSTGRES_SSLCERT", "sslcert", "Client certificate presented to the postgres database.", (*stringValue)(&c.Database.SSLCert)},
+		{"database.sslkey", "POSTGRES_SSLKEY", "sslkey", "Key for the client certificate.", (*stringValue)(&c.Database.SSLKey)},
+		{"database.sslrootcert", "POSTGRES_SSLROOTCERT", "sslrootcert", "CA the postgres database's certificate is verified against.", (*stringValue)(&c.Database.SSLRootCert)},
+		{"database.max_open_conns", "POSTGRES_MAX_OPEN_CONNS", "dbmaxopen", "Most connections open to the database at once, 0 for no limit.", (*intValue)(&c.Database.MaxOpenConns)},
+		{"database.max_idle_conns", "POSTGRES_MAX_IDLE_CONNS", "dbmaxidle", "Most idle connections kept open to the database.", (*intValue)(&c.Database.MaxIdleConns)},
+		{"database.conn_max_lifetime", "POSTGRES_CONN_MAX_LIFETIME", "dbmaxlifetime", "How long a database connection is reused for, 0 for as long as it works.", (*durationValue)(&c.Database.ConnMaxLifetime)},
+		{"database.ready_timeout", "POSTGRES_READY_TIMEOUT", "dbwait", "How long to wait at startup for the database to accept connections, 0 to try once.", (*durationValue)(&c.Database.ReadyTimeout)},
+		{"database.insert_timeout", "POSTGRES_INSERT_TIMEOUT", "dbinserttimeout", "How long each insert may take before it is cancelled, 0 for no limit.", (*durationValue)(&c.Database.Timeouts.Insert)},
+		{"database.select_timeout", "POSTGRES_SELECT_TIMEOUT", "dbselecttimeout", "How long each select of customers, to upload or for the admin API and commands, may take before it is cancelled, 0 for no limit.", (*durationValue)(&c.Database.Timeouts.Select)},
+		{"database.update_timeout", "POSTGRES_UPDATE_TIMEOUT", "dbupdatetimeout", "How long recording each upload, or requeueing, skipping or purging customers, may take before it is cancelled, 0 for no limit.", (*durationValue)(&c.Database.Timeouts.Update)},
+
+		{"signal.mode", "SIGNAL_MODE", "signal", "How to signal the CRM worker, either 'rpc' or 'notify' (Postgres LISTEN/NOTIFY).", (*stringValue)(&c.Signal.Mode)},
+		{"signal.network", "CRM_LISTENER_NETWORK", "rpcnetwork", "Network of the signal listener, either 'tcp' or 'unix'.", (*stringValue)(&c.Signal.Network)},
+		{"signal.addr", "CRM_LISTENER_ADDR", "rpcaddr", "Address of the signal listener, or the path of its socket for the unix network.", (*stringValue)(&c.Signal.Addr)},
+		{"signal.secret", "SIGNAL_SECRET", "rpcsecret", "Shared secret the signal listener requires.", (*stringValue)(&c.Signal.Secret)},
+		{"signal.tls_cert", "SIGNAL_TLS_CERT", "rpccert", "Certificate presented when signalling over TLS.", (*stringValue)(&c.Signal.TLSCert)},
+		{"signal.tls_key", "SIGNAL_TLS_KEY", "rpckey", "Key for the signalling certificate.", (*stringValue)(&c.Signal.TLSKey)},
+		{"signal.tls_ca", "SIGNAL_TLS_CA", "rpcca", "CA used to verify the other side's signalling certificate.", (*stringValue)(&c.Signal.TLSCA)},
+		{"signal.timeout", "SIGNAL_TIMEOUT", "rpctimeout", "How long connecting to the signal listener, and each signal, may take.", (*durationValue)(&c.Signal.Timeout)},
+		{"signal.wait", "SIGNAL_WAIT", "rpcwait", "How long to keep trying to signal the listener once the import has finished.", (*durationValue)(&c.Signal.Wait)},
+
+		{"import.file", "CSV_FILE", "filename", "Path to the CSV file containing the customer records to upload.", (*stringValue)(&c.Import.File)},
+		{"import.no_header", "CSV_NO_HEADER", "noheader", "Used if the CSV file does not contain a header row.", (*boolValue)(&c.Import.NoHeader)},
+		{"import.buffer", "CSV_BUFFER", "buffer", "Number of lines to read in before writing to the database and signalling the CRM upload worker.", (*intValue)(&c.Import.Buffer)},
+		{"import.priority", "CSV_PRIORITY", "priority", "Priority sent to the CRM upload worker with each signal, higher priority imports are uploaded more eagerly.", (*intValue)(&c.Import.Priority)},
+		{"import.copy", "CSV_COPY", "copy", "Bulk load each buffer with COPY, for large files.", (*boolValue)(&c.Import.Copy)},
+		{"import.watch_dir", "CSV_WATCH_DIR", "watch", "Run as a service, importing every CSV file moved into this directory, instead of importing -filename.", (*stringValue)(&c.Import.WatchDir)},
+		{"import.watch_interval", "CSV_WATCH_INTERVAL", "watchinterval", "How often to check the -watch directory for new files.", (*durationValue)(&c.Import.WatchInterval)},
+		{"import.status_addr", "CSV_STATUS_ADDR", "statusaddr", "Address to serve /healthz and /readyz on when running with -watch.", (*stringValue)(&c.Import.StatusAddr)},
+
+		{"crm.url", "CRM_SERVER_ADDR", "crm", "URL of the CRM customers are uploaded to.", (*stringValue)(&c.CRM.URL)},
+		{"crm.customers_path", "CRM_CUSTOMERS_PATH", "crmpath", "Path customers are posted to on the CRM.", (*stringValue)(&c.CRM.CustomersPath)},
+		{"crm.timeout", "CRM_TIMEOUT", "crmtimeout", "The longest a post to the CRM may take.", (*durationValue)(&c.CRM.Timeout)},
+		{"crm.id_sources", "CRM_ID_SOURCES", "crmidsources", "Where the CRM's id for an uploaded customer is found in its answer, json:<dotted path> or header:<name>, tried in turn.", (*stringValue)(&c.CRM.IDSources)},
+
+		{"upload.workers", "CRM_WORKERS", "workers", "How many customers are posted to the CRM at once.", (*intValue)(&c.Upload.Workers)},
+		{"upload.queue_size", "CRM_QUEUE_SIZE", "queuesize", "How many customers can wait for an upload worker.", (*intValue)(&c.Upload.QueueSize)},
+		{"upload.page_size", "CRM_PAGE_SIZE", "pagesize", "How many customers are selected for upload at a time.", (*intValue)(&c.Upload.PageSize)},
+		{"upload.check_limit", "CRM_CHECK_LIMIT", "checklimit", "The most customers a single check for work selects, 0 for no limit.", (*intValue)(&c.Upload.CheckLimit)},
+		{"upload.max_attempts", "CRM_MAX_ATTEMPTS", "maxattempts", "Failed uploads allowed before a customer is dead-lettered.", (*intValue)(&c.Upload.MaxAttempts)},
+		{"upload.worker_id", "CRM_WORKER_ID", "workerid", "Identifies this integrator in the upload history, the host name and pid when empty.", (*stringValue)(&c.Upload.WorkerID)},
+		{"upload.max_backoff", "CRM_MAX_BACKOFF", "maxbackoff", "The longest wait between checks for work, 0 for no limit.", (*durationValue)(&c.Upload.MaxBackoff)},
+		{"upload.circuit_threshold", "CRM_CIRCUIT_THRESHOLD", "circuitthreshold", "Failed posts in a row that hold back posts to the CRM.", (*intValue)(&c.Upload.CircuitThreshold)},
+		{"upload.circuit_cooldown", "CRM_CIRCUIT_COOLDOWN", "circuitcooldown", "How long posts are held back before one is tried again.", (*durationValue)(&c.Upload.CircuitCooldown)},
+
+		{"integrator.metrics_addr", "CRM_METRICS_ADDR", "metricsaddr", "Address to serve metrics, health checks and the admin API on, rather than the signal listener's.", (*stringValue)(&c.Integrator.MetricsAddr)},
+		{"integrator.admin_token", "CRM_ADMIN_TOKEN", "", "Token protecting the admin API, which is only served when it is set.", (*stringValue)(&c.Integrator.AdminToken)},
+
+		{"log.format", "LOG_FORMAT", "logformat", "Log line format, either 'logfmt' or 'json'.", (*stringValue)(&c.Log.Format)},
+		{"log.level", "LOG_LEVEL", "loglevel", "Lowest level logged: debug, info, warn or error.", (*stringValue)(&c.Log.Level)},
+		{"log.redact_pii", "LOG_REDACT_PII", "redactpii", "Mask customers' email addresses and phone numbers in the logs.", (*boolValue)(&c.Log.RedactPII)},
+	}
+}
+
+// Load loads the config of a command that uses the sections given. The flags of those sections, and -config, are
+// defined on fs and parsed from args, then the config is validated.
+func Load(fs *flag.FlagSet, args []string, sections ...string) (*Config, error) {
+	load := Define(fs, sections...)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return load()
+}
+
+// Define defines -config and the flags of the sections given on fs, for a command that parses its flags itself. Once
+// fs has been parsed the function returned loads and validates the config as Load does.
+func Define(fs *flag.FlagSet, sections ...string) func() (*Config, error) {
+	c := Default()
+	settings := c.settings()
+
+	// The flags are parsed first, to find the config file, but only applied once the file and environment have been.
+	var file string
+	fs.StringVar(&file, "config", os.Getenv(FileEnv), "Config file, JSON or TOML-style, see the README.")
+	var flags []*flagValue
+	for _, s := range settings {
+		if s.flag != "" && contains(sections, s.section()) {
+			f := &flagValue{setting: s}
+			fs.Var(f, s.flag, s.usage)
+			flags = append(flags, f)
+		}
+	}
+
+	return func() (*Config, error) {
+		if file != "" {
+			values, err := readFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if err := apply(settings, values, file); err != nil {
+				return nil, err
+			}
+		}
+		for _, s := range settings {
+			if v := os.Getenv(s.env); v != "" {
+				if err := s.value.Set(v); err != nil {
+					return nil, fmt.Errorf("invalid value %q for %s: %s", v, s.env, err)
+				}
+			}
+		}
+		for _, f := range flags {
+			for _, v := range f.values {
+				if err := f.value.Set(v); err != nil {
+					return nil, fmt.Errorf("invalid value %q for flag -%s: %s", v, f.flag, err)
+				}
+			}
+		}
+
+		if err := c.Validate(sections...); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// apply sets the settings from the values read from file, keyed by section.key.
+func apply(settings []setting, values map[string]string, file string) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s, ok := find(settings, k)
+		if !ok {
+			return fmt.Errorf("unknown setting %q in %s", k, file)
+		}
+		if err := s.value.Set(values[k]); err != nil {
+			return fmt.Errorf("invalid value %q for %s in %s: %s", values[k], k, file, err)
+		}
+	}
+	return nil
+}
+
+func find(settings []setting, key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readFile reads a config file into its values, keyed by section.key.
+func readFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("while reading config: %s", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return parseJSON(b, path)
+	}
+	return parseTOML(b, path)
+}
+
+func parseJSON(b []byte, path string) (map[string]string, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("while parsing %s: %s", path, err)
+	}
+
+	values := make(map[string]string)
+	for section, v := range doc {
+		settings, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("while parsing %s: %s must be an object", path, section)
+		}
+		for key, v := range settings {
+			switch v := v.(type) {
+			case string:
+				values[section+"."+key] = v
+			case json.Number:
+				values[section+"."+key] = v.String()
+			case bool:
+				values[section+"."+key] = strconv.FormatBool(v)
+			default:
+				return nil, fmt.Errorf("while parsing %s: %s.%s must be a string, number or boolean", path, section, key)
+			}
+		}
+	}
+	return values, nil
+}
+
+func parseTOML(b []byte, path string) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+			continue
+		case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 || section == "" {
+			return nil, fmt.Errorf("while parsing %s: line %d must be key = value in a [section]", path, line)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("while parsing %s: line %d: %s", path, line, err)
+			}
+			value = unquoted
+		}
+		values[section+"."+key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("while parsing %s: %s", path, err)
+	}
+	return values, nil
+}
+
+// flagValue records a flag's values to apply after the file and environment.
+type flagValue struct {
+	setting
+	values []string
+}
+
+func (f *flagValue) String() string {
+	if f == nil || f.value == nil {
+		return ""
+	}
+	return f.value.String()
+}
+
+func (f *flagValue) Set(s string) error {
+	// Check the value now so a bad flag is reported as flag errors are.
+	if err := f.value.Set(s); err != nil {
+		return err
+	}
+	f.values = append(f.values, s)
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	_, ok := f.value.(*boolValue)
+	return ok
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("must be a whole number")
+	}
+	*v = intValue(n)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("must be a duration such as 30s")
+	}
+	*v = durationValue(d)
+	return nil
+}
+func (v *durationValue) String() string { return time.Duration(*v).String() }
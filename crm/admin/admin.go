@@ -0,0 +1,276 @@
+// Package admin is an HTTP API for inspecting and steering the integrator's uploads: listing customers by how their
+// upload is going, requeueing or skipping them, pausing uploads and checking for work on demand.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+// Prefix is the path the API is served under.
+const Prefix = "/admin/"
+
+// Uploads is the part of the uploader the API steers.
+type Uploads interface {
+	Pause()
+	Resume()
+	Paused() bool
+	Check()
+}
+
+// API serves the admin endpoints. Every request must present the token as a bearer token.
+type API struct {
+	db      database.AdminDB
+	uploads Uploads
+	token   string
+	log     logging.Logger
+	mux     *http.ServeMux
+}
+
+// Status is the state of the uploads as a whole.
+type Status struct {
+	Paused    bool             `json:"paused"`
+	Customers map[string]int64 `json:"customers,omitempty"`
+}
+
+// CustomerList is a page of customers, Next is the After to pass for the next page, 0 if this is the last.
+type CustomerList struct {
+	Customers []database.CustomerStatus `json:"customers"`
+	Next      int64                     `json:"next,omitempty"`
+}
+
+// Customer is a customer along with the history of its uploads, oldest attempt first.
+type Customer struct {
+	*database.CustomerStatus
+	History []database.UploadAttempt `json:"history"`
+}
+
+// IDs is the body of requeue and skip requests.
+type IDs struct {
+	IDs []int64 `json:"ids"`
+}
+
+// Updated is the reply to requeue and skip requests.
+type Updated struct {
+	Updated int64 `json:"updated"`
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+// NewAPI returns the API. With an empty token every request is refused.
+func NewAPI(db database.AdminDB, uploads Uploads, token string) *API {
+	a := &API{
+		db:      db,
+		uploads: uploads,
+		token:   token,
+		log:     logging.Default().With(logging.F(logging.Component, "admin")),
+		mux:     http.NewServeMux(),
+	}
+	a.mux.HandleFunc(Prefix+"status", a.method(http.MethodGet, a.status))
+	a.mux.HandleFunc(Prefix+"customers", a.method(http.MethodGet, a.listCustomers))
+	a.mux.HandleFunc(Prefix+"customers/", a.method(http.MethodGet, a.getCustomer))
+	a.mux.HandleFunc(Prefix+"customers/crm/", a.method(http.MethodGet, a.getCustomerByCRMID))
+	a.mux.HandleFunc(Prefix+"requeue", a.method(http.MethodPost, a.requeue))
+	a.mux.HandleFunc(Prefix+"skip", a.method(http.MethodPost, a.skip))
+	a.mux.HandleFunc(Prefix+"pause", a.method(http.MethodPost, a.pause))
+	a.mux.HandleFunc(Prefix+"resume", a.method(http.MethodPost, a.resume))
+	a.mux.HandleFunc(Prefix+"check", a.method(http.MethodPost, a.check))
+	return a
+}
+
+// SetLogger replaces the default logger.
+func (a *API) SetLogger(l logging.Logger) {
+	a.log = l.With(logging.F(logging.Component, "admin"))
+}
+
+// ServeHTTP serves the API, it should be mounted at Prefix.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	want := []byte(signal.AuthScheme + a.token)
+	got := []byte(r.Header.Get("Authorization"))
+	if a.token == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+		a.log.Warn("rejected unauthenticated request", logging.F("remote_addr", r.RemoteAddr),
+			logging.F("path", r.URL.Path))
+		a.error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *API) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			a.error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *API) status(w http.ResponseWriter, r *http.Request) {
+	counts, err := a.db.CountCustomers(r.Context())
+	if err != nil {
+		a.failed(w, err)
+		return
+	}
+	a.reply(w, http.StatusOK, Status{Paused: a.uploads.Paused(), Customers: counts})
+}
+
+// listCustomers takes the filter from the query string: state, email, crm_id, error, after and limit.
+func (a *API) listCustomers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := database.CustomerFilter{State: q.Get("state"), Email: q.Get("email"), CRMID: q.Get("crm_id"), Error: q.Get("error")}
+
+	var err error
+	if s := q.Get("after"); s != "" {
+		if f.After, err = strconv.ParseInt(s, 10, 64); err != nil {
+			a.error(w, http.StatusBadRequest, "after must be a customer id")
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 {
+			a.error(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+	}
+	if f.Limit == 0 {
+		f.Limit = database.DefaultListLimit
+	}
+	if f.Limit > database.MaxListLimit {
+		f.Limit = database.MaxListLimit
+	}
+	if f.State != "" && !database.KnownState(f.State) {
+		a.error(w, http.StatusBadRequest, "state must be one of "+strings.Join(database.States, ", "))
+		return
+	}
+
+	customers, err := a.db.ListCustomers(r.Context(), f)
+	if err != nil {
+		a.failed(w, err)
+		return
+	}
+
+	list := CustomerList{Customers: customers}
+	if list.Customers == nil {
+		list.Customers = []database.CustomerStatus{}
+	}
+	// A full page may not be the last, a short one is.
+	if len(customers) == f.Limit {
+		list.Next = customers[len(customers)-1].Id
+	}
+	a.reply(w, http.StatusOK, list)
+}
+
+func (a *API) getCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, Prefix+"customers/"), 10, 64)
+	if err != nil {
+		a.error(w, http.StatusNotFound, "no such customer")
+		return
+	}
+	c, err := a.db.GetCustomer(r.Context(), id)
+	a.customer(w, r, c, err)
+}
+
+// getCustomerByCRMID looks the customer up by the id the CRM gave it.
+func (a *API) getCustomerByCRMID(w http.ResponseWriter, r *http.Request) {
+	crmID := strings.TrimPrefix(r.URL.Path, Prefix+"customers/crm/")
+	if crmID == "" {
+		a.error(w, http.StatusNotFound, "no such customer")
+		return
+	}
+	c, err := a.db.GetCustomerByCRMID(r.Context(), crmID)
+	a.customer(w, r, c, err)
+}
+
+// customer replies with the customer looked up, along with its upload history.
+func (a *API) customer(w http.ResponseWriter, r *http.Request, c *database.CustomerStatus, err error) {
+	switch {
+	case err == database.ErrNotFound:
+		a.error(w, http.StatusNotFound, "no such customer")
+		return
+	case err != nil:
+		a.failed(w, err)
+		return
+	}
+
+	history, err := a.db.UploadAttempts(r.Context(), c.Id)
+	if err != nil {
+		a.failed(w, err)
+		return
+	}
+	if history == nil {
+		history = []database.UploadAttempt{}
+	}
+	a.reply(w, http.StatusOK, Customer{CustomerStatus: c, History: history})
+}
+
+// requeue puts the customers back in line to be uploaded, and checks for work so they don't wait out the backoff.
+func (a *API) requeue(w http.ResponseWriter, r *http.Request) {
+	if a.update(w, r, "requeued", a.db.Requeue) {
+		a.uploads.Check()
+	}
+}
+
+func (a *API) skip(w http.ResponseWriter, r *http.Request) {
+	a.update(w, r, "skipped", a.db.Skip)
+}
+
+// update applies the update to the customers in the request, reporting whether it succeeded.
+func (a *API) update(w http.ResponseWriter, r *http.Request, what string,
+	update func(context.Context, ...int64) (int64, error)) bool {
+	var ids IDs
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil || len(ids.IDs) == 0 {
+		a.error(w, http.StatusBadRequest, `body must be {"ids": [customer ids]}`)
+		return false
+	}
+
+	n, err := update(r.Context(), ids.IDs...)
+	if err != nil {
+		a.failed(w, err)
+		return false
+	}
+	a.log.Info("customers "+what, logging.F("ids", ids.IDs), logging.F("updated", n))
+	a.reply(w, http.StatusOK, Updated{Updated: n})
+	return true
+}
+
+func (a *API) pause(w http.ResponseWriter, r *http.Request) {
+	a.uploads.Pause()
+	a.reply(w, http.StatusOK, Status{Paused: true})
+}
+
+func (a *API) resume(w http.ResponseWriter, r *http.Request) {
+	a.uploads.Resume()
+	a.reply(w, http.StatusOK, Status{Paused: false})
+}
+
+func (a *API) check(w http.ResponseWriter, r *http.Request) {
+	a.uploads.Check()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *API) failed(w http.ResponseWriter, err error) {
+	a.log.Error("admin request failed", logging.Err(err))
+	a.error(w, http.StatusInternalServerError, err.Error())
+}
+
+func (a *API) error(w http.ResponseWriter, code int, msg string) {
+	a.reply(w, code, errorReply{Error: msg})
+}
+
+func (a *API) reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,261 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+type fakeDB struct {
+	ctx       context.Context
+	filter    database.CustomerFilter
+	customers []database.CustomerStatus
+	attempts  []database.UploadAttempt
+	requeued  []int64
+	err       error
+}
+
+func (f *fakeDB) CountCustomers(context.Context) (map[string]int64, error) {
+	return map[string]int64{database.StatePending: 2, database.StateDeadLetter: 1}, f.err
+}
+
+func (f *fakeDB) ListCustomers(ctx context.Context, filter database.CustomerFilter) ([]database.CustomerStatus, error) {
+	f.ctx, f.filter = ctx, filter
+	return f.customers, f.err
+}
+
+func (f *fakeDB) GetCustomer(_ context.Context, id int64) (*database.CustomerStatus, error) {
+	for _, c := range f.customers {
+		if c.Id == id {
+			return &c, f.err
+		}
+	}
+	return nil, database.ErrNotFound
+}
+
+func (f *fakeDB) GetCustomerByCRMID(_ context.Context, crmID string) (*database.CustomerStatus, error) {
+	for _, c := range f.customers {
+		if c.CRMID == crmID {
+			return &c, f.err
+		}
+	}
+	return nil, database.ErrNotFound
+}
+
+func (f *fakeDB) Requeue(_ context.Context, ids ...int64) (int64, error) {
+	f.requeued = ids
+	return int64(len(ids)), f.err
+}
+
+func (f *fakeDB) Skip(_ context.Context, ids ...int64) (int64, error) {
+	return int64(len(ids)), f.err
+}
+
+func (f *fakeDB) UploadAttempts(_ context.Context, id int64) ([]database.UploadAttempt, error) {
+	var attempts []database.UploadAttempt
+	for _, a := range f.attempts {
+		if a.CustomerID == id {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, f.err
+}
+
+func (f *fakeDB) CountMatching(context.Context, database.CustomerFilter) (int64, error) {
+	return int64(len(f.customers)), f.err
+}
+
+func (f *fakeDB) RequeueMatching(context.Context, database.CustomerFilter) (int64, error) {
+	return int64(len(f.customers)), f.err
+}
+
+func (f *fakeDB) Purge(context.Context, database.CustomerFilter) (int64, error) {
+	return int64(len(f.customers)), f.err
+}
+
+type fakeUploads struct {
+	paused  bool
+	checked int
+}
+
+func (f *fakeUploads) Pause()       { f.paused = true }
+func (f *fakeUploads) Resume()      { f.paused = false }
+func (f *fakeUploads) Paused() bool { return f.paused }
+func (f *fakeUploads) Check()       { f.checked++ }
+
+var _ = Describe("Admin", func() {
+	var (
+		db      *fakeDB
+		uploads *fakeUploads
+		a       *API
+		token   string
+	)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w
+	}
+
+	BeforeEach(func() {
+		db = &fakeDB{customers: []database.CustomerStatus{
+			{Id: 1, Email: "jon.doe@mail.com", State: database.StateDeadLetter, Attempts: 10, LastError: "post to CRM failed with (503) 503 Service Unavailable"},
+			{Id: 2, Email: "jane.doe@mail.com", State: database.StatePending},
+		}}
+		uploads = &fakeUploads{}
+		a = NewAPI(db, uploads, "s3cret")
+		a.SetLogger(logging.Nop())
+		token = "s3cret"
+	})
+
+	Context("without the token", func() {
+		BeforeEach(func() {
+			token = "guess"
+		})
+
+		It("should refuse the request", func() {
+			Expect(do(http.MethodGet, "/admin/status", "").Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with no token configured", func() {
+		BeforeEach(func() {
+			a = NewAPI(db, uploads, "")
+			a.SetLogger(logging.Nop())
+			token = ""
+		})
+
+		It("should refuse every request", func() {
+			Expect(do(http.MethodGet, "/admin/status", "").Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("GET /admin/status", func() {
+		It("should report the counts and whether uploads are paused", func() {
+			w := do(http.MethodGet, "/admin/status", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(MatchJSON(`{"paused":false,"customers":{"pending":2,"dead_letter":1}}`))
+		})
+	})
+
+	Context("GET /admin/customers", func() {
+		It("should pass the filter on", func() {
+			w := do(http.MethodGet, "/admin/customers?state=dead_letter&error=503&after=10&limit=2", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(db.filter).To(Equal(database.CustomerFilter{State: "dead_letter", Error: "503", After: 10, Limit: 2}))
+		})
+
+		It("should query with the request's context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			r := httptest.NewRequest(http.MethodGet, "/admin/customers", nil).WithContext(ctx)
+			r.Header.Set("Authorization", "Bearer "+token)
+			a.ServeHTTP(httptest.NewRecorder(), r)
+			Expect(db.ctx.Err()).To(Equal(context.Canceled))
+		})
+
+		It("should point to the next page when the page is full", func() {
+			w := do(http.MethodGet, "/admin/customers?limit=2", "")
+			Expect(w.Body.String()).To(ContainSubstring(`"next":2`))
+		})
+
+		It("should not when the page is short", func() {
+			w := do(http.MethodGet, "/admin/customers", "")
+			Expect(w.Body.String()).ToNot(ContainSubstring(`"next"`))
+			Expect(db.filter.Limit).To(Equal(database.DefaultListLimit))
+		})
+
+		It("should reject an unknown state", func() {
+			Expect(do(http.MethodGet, "/admin/customers?state=lost", "").Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should report database errors", func() {
+			db.err = errors.New("connection refused")
+			w := do(http.MethodGet, "/admin/customers", "")
+			Expect(w.Code).To(Equal(http.StatusInternalServerError))
+			Expect(w.Body.String()).To(MatchJSON(`{"error":"connection refused"}`))
+		})
+	})
+
+	Context("GET /admin/customers/{id}", func() {
+		It("should return the customer", func() {
+			w := do(http.MethodGet, "/admin/customers/1", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`"attempts":10`))
+			Expect(w.Body.String()).To(ContainSubstring(`"history":[]`))
+		})
+
+		It("should include the upload history", func() {
+			db.attempts = []database.UploadAttempt{
+				{ID: 7, CustomerID: 1, Status: 503, Error: "post to CRM failed with (503) 503 Service Unavailable", WorkerID: "crm-1"},
+				{ID: 8, CustomerID: 2, Status: 201, WorkerID: "crm-1"},
+			}
+			w := do(http.MethodGet, "/admin/customers/1", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`"history":[{"id":7,"customer_id":1,`))
+			Expect(w.Body.String()).ToNot(ContainSubstring(`"id":8`))
+		})
+
+		It("should look the customer up by the CRM's id", func() {
+			db.customers[1].CRMID = "crm-2"
+			db.attempts = []database.UploadAttempt{{ID: 8, CustomerID: 2, Status: 201, CRMID: "crm-2", WorkerID: "crm-1"}}
+			w := do(http.MethodGet, "/admin/customers/crm/crm-2", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`"id":2,"crm_id":"crm-2"`))
+			Expect(w.Body.String()).To(ContainSubstring(`"history":[{"id":8,`))
+			Expect(do(http.MethodGet, "/admin/customers/crm/crm-9", "").Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should 404 for an unknown customer", func() {
+			Expect(do(http.MethodGet, "/admin/customers/3", "").Code).To(Equal(http.StatusNotFound))
+			Expect(do(http.MethodGet, "/admin/customers/jon", "").Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Context("POST /admin/requeue", func() {
+		It("should requeue the customers and check for work", func() {
+			w := do(http.MethodPost, "/admin/requeue", `{"ids":[1,2]}`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(MatchJSON(`{"updated":2}`))
+			Expect(db.requeued).To(Equal([]int64{1, 2}))
+			Expect(uploads.checked).To(Equal(1))
+		})
+
+		It("should reject a request without ids", func() {
+			Expect(do(http.MethodPost, "/admin/requeue", `{}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(uploads.checked).To(BeZero())
+		})
+
+		It("should only accept POST", func() {
+			Expect(do(http.MethodGet, "/admin/requeue", "").Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+
+	Context("POST /admin/pause and /admin/resume", func() {
+		It("should pause and resume uploads", func() {
+			Expect(do(http.MethodPost, "/admin/pause", "").Code).To(Equal(http.StatusOK))
+			Expect(uploads.paused).To(BeTrue())
+			Expect(do(http.MethodPost, "/admin/resume", "").Code).To(Equal(http.StatusOK))
+			Expect(uploads.paused).To(BeFalse())
+		})
+	})
+
+	Context("POST /admin/check", func() {
+		It("should check for work", func() {
+			Expect(do(http.MethodPost, "/admin/check", "").Code).To(Equal(http.StatusAccepted))
+			Expect(uploads.checked).To(Equal(1))
+		})
+	})
+})
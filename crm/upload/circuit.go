@@ -0,0 +1,99 @@
+package upload
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// The number of posts in a row that must fail before the circuit opens.
+	circuitThreshold = 5
+	// How long the circuit stays open before a single post is let through to see if the CRM has recovered.
+	circuitCooldown = 30 * time.Second
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuit stops the upload workers hammering a CRM that is down. Customers that aren't posted while it is open are
+// still waiting to be uploaded, so they are picked up again by the next check for work.
+type circuit struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func newCircuit(threshold int, cooldown time.Duration) *circuit {
+	return &circuit{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a post may go ahead. Once the cooldown has passed one post at a time is allowed through as a
+// probe.
+func (c *circuit) allow() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch c.state() {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		if !c.probing {
+			c.probing = true
+			return true
+		}
+	}
+	return false
+}
+
+// result records the outcome of a post that was allowed.
+func (c *circuit) result(failed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !failed {
+		c.failures = 0
+		c.probing = false
+		circuitOpenGauge.Set(0)
+		return
+	}
+
+	c.failures++
+	if c.probing || c.failures >= c.threshold {
+		c.openedAt = c.now()
+		c.probing = false
+		circuitOpenGauge.Set(1)
+	}
+}
+
+// cancel records that a post that was allowed was abandoned before it had an outcome. If it was the probe another post
+// may be let through in its place.
+func (c *circuit) cancel() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.probing = false
+}
+
+// State returns closed, open or half-open.
+func (c *circuit) State() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state()
+}
+
+func (c *circuit) state() string {
+	if c.failures < c.threshold {
+		return circuitClosed
+	}
+	if c.now().Sub(c.openedAt) < c.cooldown {
+		return circuitOpen
+	}
+	return circuitHalfOpen
+}
@@ -0,0 +1,87 @@
+package upload
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("circuit", func() {
+	var (
+		c   *circuit
+		now time.Time
+	)
+
+	failTimes := func(n int) {
+		for i := 0; i < n; i++ {
+			Expect(c.allow()).To(BeTrue())
+			c.result(true)
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+		c = newCircuit(3, time.Minute)
+		c.now = func() time.Time { return now }
+	})
+
+	It("should stay closed until the threshold is reached", func() {
+		failTimes(2)
+		Expect(c.State()).To(Equal(circuitClosed))
+		failTimes(1)
+		Expect(c.State()).To(Equal(circuitOpen))
+		Expect(c.allow()).To(BeFalse())
+	})
+
+	It("should forget failures after a success", func() {
+		failTimes(2)
+		Expect(c.allow()).To(BeTrue())
+		c.result(false)
+		failTimes(2)
+		Expect(c.State()).To(Equal(circuitClosed))
+	})
+
+	Context("once the cooldown has passed", func() {
+		BeforeEach(func() {
+			failTimes(3)
+			now = now.Add(time.Minute)
+		})
+
+		It("should let one probe through", func() {
+			Expect(c.State()).To(Equal(circuitHalfOpen))
+			Expect(c.allow()).To(BeTrue())
+			Expect(c.allow()).To(BeFalse())
+		})
+
+		It("should close when the probe succeeds", func() {
+			Expect(c.allow()).To(BeTrue())
+			c.result(false)
+			Expect(c.State()).To(Equal(circuitClosed))
+		})
+
+		It("should open again when the probe fails", func() {
+			Expect(c.allow()).To(BeTrue())
+			c.result(true)
+			Expect(c.State()).To(Equal(circuitOpen))
+		})
+
+		It("should let another probe through when the probe is abandoned", func() {
+			Expect(c.allow()).To(BeTrue())
+			c.cancel()
+			Expect(c.State()).To(Equal(circuitHalfOpen))
+			Expect(c.allow()).To(BeTrue())
+		})
+	})
+
+	Context("unavailable", func() {
+		It("should only count the CRM's own failures", func() {
+			Expect(unavailable(errors.New("connection refused"))).To(BeTrue())
+			Expect(unavailable(&crmError{code: http.StatusServiceUnavailable})).To(BeTrue())
+			Expect(unavailable(&crmError{code: http.StatusTooManyRequests})).To(BeTrue())
+			Expect(unavailable(&crmError{code: http.StatusBadRequest})).To(BeFalse())
+		})
+	})
+})
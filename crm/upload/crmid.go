@@ -0,0 +1,116 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DefaultCRMIDSources are where the id the CRM gives a customer is looked for unless SetCRMIDSources is used: an id
+// field in the answer, or failing that the last part of the Location header.
+const DefaultCRMIDSources = "json:id,header:Location"
+
+// crmIDSource is one place the CRM's id for a customer may be found in its answer.
+type crmIDSource struct {
+	// jsonPath is the fields, or array indexes, leading to the id in the JSON body.
+	jsonPath []string
+	header   string
+}
+
+// parseCRMIDSources parses a comma separated list of sources, each either json:<path>, a dot separated path to the
+// id in the body such as json:data.customer.id, or header:<name>. A URL in a header, as in Location, gives the last
+// part of its path.
+func parseCRMIDSources(s string) ([]crmIDSource, error) {
+	var sources []crmIDSource
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("CRM id source %q must be json:<path> or header:<name>", spec)
+		}
+		switch strings.ToLower(parts[0]) {
+		case "json":
+			sources = append(sources, crmIDSource{jsonPath: strings.Split(parts[1], ".")})
+		case "header":
+			sources = append(sources, crmIDSource{header: http.CanonicalHeaderKey(parts[1])})
+		default:
+			return nil, fmt.Errorf("CRM id source %q must be json:<path> or header:<name>", spec)
+		}
+	}
+	return sources, nil
+}
+
+// crmID returns the id from the first source that has one, or an empty string if none do.
+func crmID(sources []crmIDSource, header http.Header, body []byte) string {
+	var doc interface{}
+	parsed := false
+	for _, s := range sources {
+		if s.header != "" {
+			if id := headerID(header.Get(s.header)); id != "" {
+				return id
+			}
+			continue
+		}
+
+		if !parsed {
+			parsed = true
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+			if err := dec.Decode(&doc); err != nil {
+				doc = nil
+			}
+		}
+		if id := jsonID(doc, s.jsonPath); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func headerID(value string) string {
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Path == "" {
+		return value
+	}
+	if id := path.Base(u.Path); id != "/" && id != "." {
+		return id
+	}
+	return ""
+}
+
+func jsonID(doc interface{}, jsonPath []string) string {
+	for _, key := range jsonPath {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			doc = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return ""
+			}
+			doc = v[i]
+		default:
+			return ""
+		}
+	}
+
+	switch v := doc.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+package upload
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CRM id", func() {
+	var sources []crmIDSource
+
+	BeforeEach(func() {
+		var err error
+		sources, err = parseCRMIDSources(DefaultCRMIDSources)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should find the id in the body", func() {
+		Expect(crmID(sources, http.Header{}, []byte(`{"id": "abc"}`))).To(Equal("abc"))
+	})
+
+	It("should keep numeric ids as they were sent", func() {
+		Expect(crmID(sources, http.Header{}, []byte(`{"id": 12345678901234567890}`))).To(Equal("12345678901234567890"))
+	})
+
+	It("should fall back to the Location header", func() {
+		header := http.Header{"Location": []string{"https://crm.example.com/customers/42"}}
+		Expect(crmID(sources, header, []byte(`created`))).To(Equal("42"))
+	})
+
+	It("should follow a path into the body", func() {
+		sources, err := parseCRMIDSources("json:data.customers.0.ref")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(crmID(sources, http.Header{}, []byte(`{"data": {"customers": [{"ref": "c-1"}]}}`))).To(Equal("c-1"))
+		Expect(crmID(sources, http.Header{}, []byte(`{"data": {"customers": []}}`))).To(BeEmpty())
+	})
+
+	It("should use any header as it is", func() {
+		sources, err := parseCRMIDSources("header:x-record-id")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(crmID(sources, http.Header{"X-Record-Id": []string{"r-9"}}, nil)).To(Equal("r-9"))
+	})
+
+	It("should be empty when no source has an id", func() {
+		Expect(crmID(sources, http.Header{}, []byte(`{"id": {"nested": true}}`))).To(BeEmpty())
+	})
+
+	It("should reject bad sources", func() {
+		_, err := parseCRMIDSources("id")
+		Expect(err).To(HaveOccurred())
+		_, err = parseCRMIDSources("xpath://id")
+		Expect(err).To(HaveOccurred())
+	})
+})
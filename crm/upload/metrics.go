@@ -0,0 +1,28 @@
+package upload
+
+import (
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/metrics"
+)
+
+var (
+	postsTotal = metrics.NewCounter("csvcrm_crm_posts_total",
+		"Posts to the CRM by HTTP status code, or \"error\" if no response was received.", "code")
+	postDuration = metrics.NewHistogram("csvcrm_crm_post_duration_seconds",
+		"Time taken to post a customer to the CRM.", nil)
+	uploadedTotal = metrics.NewCounter("csvcrm_customers_uploaded_total",
+		"Customers successfully uploaded to the CRM.")
+	queueDepth = metrics.NewGauge("csvcrm_upload_queue_depth",
+		"Customers waiting in the upload queue.")
+	pendingCustomers = metrics.NewGauge("csvcrm_pending_customers",
+		"Customers waiting to be uploaded as of the last full check for work.")
+	backoffSeconds = metrics.NewGauge("csvcrm_backoff_seconds",
+		"Current interval between checks for work.")
+	circuitOpenGauge = metrics.NewGauge("csvcrm_crm_circuit_open",
+		"1 while posts to the CRM are held back after repeated failures.")
+
+	uploadRate = metrics.NewRate(time.Minute)
+	_          = metrics.NewGaugeFunc("csvcrm_uploads_per_second",
+		"Customers uploaded per second, averaged over the last minute.", uploadRate.PerSecond)
+)
@@ -4,37 +4,85 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/health"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
 	"github.com/dbyington/csv-crm-upload/signal/listener"
 )
 
-// The maximum number of upload routines to spawn at one time.
+// How many customers wait for an upload worker, unless SetQueueSize is used.
 const maxConcurrentUploads = 25
 
-// The maximum time to wait for the CRM Server.
+// How many customers are selected at a time, and the most a single check for work takes, unless SetPageSize and
+// SetCheckLimit are used.
+const (
+	defaultPageSize   = 500
+	defaultCheckLimit = 10000
+)
+
+// The maximum time to wait for the CRM Server, unless SetTimeout is used.
 const clientTimeout = 30
 
+// How much of the CRM's answer is kept with each upload attempt, and how much is read looking for the customer's id.
+const (
+	maxResponseLength = 1024
+	maxResponseRead   = 64 * 1024
+)
+
+// signalListener is the receiving side of the signal sent when new customers have been inserted.
+type signalListener interface {
+	Start() error
+	Stop()
+	Ready(ctx context.Context) error
+}
+
 type upload struct {
 	listenAddress    string
+	listener         signalListener
 	crmServerAddress string
 	crmAPI           string
 	httpClient       *http.Client
-	db               database.CustomerDB
-	sigChan          chan struct{}
+	db               database.Store
+	sigChan          chan signal.Payload
+	checkChan        chan struct{}
 	successChan      chan struct{}
 	stopRun          context.CancelFunc
 	closeQueue       context.CancelFunc
 	wg               sync.WaitGroup
-	uploadChan       chan database.Customer
+	uploadChan       chan *database.Customer
+	circuit          *circuit
+	workerID         string
+	crmIDSources     []crmIDSource
+	workers          int
+	maxBackoff       time.Duration
+	pageSize         int
+	checkLimit       int
+	log              logging.Logger
+
+	// resumeAfter is the id a check for every customer waiting picks up after, when the check before it stopped at its
+	// limit. It is only used by the run goroutine.
+	resumeAfter int64
+
+	mutex  sync.Mutex
+	paused bool
+	queued map[int64]bool
 }
 
-func NewUploader(lis, crm, crmAPI string, db database.CustomerDB) *upload {
+func NewUploader(lis, crm, crmAPI string, db database.Store) *upload {
+	sources, _ := parseCRMIDSources(DefaultCRMIDSources)
 	return &upload{
 		listenAddress:    lis,
 		crmServerAddress: crm,
@@ -43,25 +91,204 @@ func NewUploader(lis, crm, crmAPI string, db database.CustomerDB) *upload {
 		httpClient: &http.Client{
 			Timeout: clientTimeout * time.Second,
 		},
-		sigChan:     make(chan struct{}, 1),
-		uploadChan:  make(chan database.Customer, maxConcurrentUploads),
-		successChan: make(chan struct{}, 1),
+		sigChan:      make(chan signal.Payload, 1),
+		checkChan:    make(chan struct{}, 1),
+		uploadChan:   make(chan *database.Customer, maxConcurrentUploads),
+		successChan:  make(chan struct{}, 1),
+		circuit:      newCircuit(circuitThreshold, circuitCooldown),
+		workerID:     defaultWorkerID(),
+		workers:      1,
+		pageSize:     defaultPageSize,
+		checkLimit:   defaultCheckLimit,
+		resumeAfter:  math.MinInt64,
+		crmIDSources: sources,
+		log:          logging.Default().With(logging.F(logging.Component, "uploader")),
+		queued:       make(map[int64]bool),
 	}
 }
 
-// Start starts the uploader service.
-func (u *upload) Start() {
-	l := listener.NewListener(u.listenAddress, u.sigChan)
+// defaultWorkerID identifies this process, by host and pid.
+func defaultWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+// SetCRMIDSources sets where the id the CRM gives each customer is found in its answer, see DefaultCRMIDSources. The
+// sources are a comma separated list tried in turn, each either json:<dotted path> into the body or header:<name>.
+func (u *upload) SetCRMIDSources(sources string) error {
+	s, err := parseCRMIDSources(sources)
+	if err != nil {
+		return err
+	}
+	u.crmIDSources = s
+	return nil
+}
+
+// SetWorkerID replaces the host and pid that upload attempts are recorded against.
+func (u *upload) SetWorkerID(id string) {
+	u.workerID = id
+}
+
+// SetWorkers sets how many customers are posted to the CRM at once, one by default.
+func (u *upload) SetWorkers(n int) {
+	u.workers = n
+}
+
+// SetQueueSize sets how many customers can wait for a worker before queueing more waits too. Call it before Start.
+func (u *upload) SetQueueSize(n int) {
+	u.uploadChan = make(chan *database.Customer, n)
+}
+
+// SetPageSize sets how many customers are selected from the database at a time.
+func (u *upload) SetPageSize(n int) {
+	u.pageSize = n
+}
+
+// SetCheckLimit sets the most customers a single check for work selects, 0 for no limit. A check that reaches the
+// limit is followed straight away by another, which carries on from where it stopped.
+func (u *upload) SetCheckLimit(n int) {
+	u.checkLimit = n
+}
+
+// SetTimeout sets the longest a post to the CRM may take.
+func (u *upload) SetTimeout(d time.Duration) {
+	u.httpClient.Timeout = d
+}
+
+// SetMaxBackoff caps the wait between checks for work, which otherwise keeps growing while there is none.
+func (u *upload) SetMaxBackoff(d time.Duration) {
+	u.maxBackoff = d
+}
+
+// SetCircuit sets how many failed posts in a row hold back posts to the CRM, and for how long.
+func (u *upload) SetCircuit(threshold int, cooldown time.Duration) {
+	u.circuit = newCircuit(threshold, cooldown)
+}
+
+// SetLogger replaces the default logger. Call it before choosing a listener so the listener logs with it too.
+func (u *upload) SetLogger(l logging.Logger) {
+	u.log = l.With(logging.F(logging.Component, "uploader"))
+}
+
+// UseNotifyListener makes the uploader wait for Postgres notifications on channel instead of listening for RPC
+// signals.
+func (u *upload) UseNotifyListener(connStr, channel string) {
+	l := listener.NewNotifyListener(connStr, channel, u.sigChan)
+	l.SetLogger(u.log)
+	u.listener = l
+}
+
+// UseRPCListener listens for RPC signals on the given network and address, rather than TCP on the address the
+// uploader was created with. The listener is returned so it can be secured before the uploader is started.
+func (u *upload) UseRPCListener(network, addr string) *listener.Listener {
+	l := listener.NewListener(network, addr, u.sigChan)
+	l.SetLogger(u.log)
+	u.listener = l
+	return l
+}
+
+// UseLocalListener takes signals from the same process instead of listening for RPC signals. The listener returned is
+// the sender the reader signals with.
+func (u *upload) UseLocalListener() *listener.LocalListener {
+	l := listener.NewLocalListener(u.sigChan)
+	u.listener = l
+	return l
+}
+
+// Start starts the uploader service. It returns when the listener stops.
+func (u *upload) Start() error {
+	if u.listener == nil {
+		u.UseRPCListener("tcp", u.listenAddress)
+	}
 	ctxRun, cancelRun := context.WithCancel(context.Background())
 	ctxQueue, cancelQueue := context.WithCancel(context.Background())
 	u.stopRun = cancelRun
 	u.closeQueue = cancelQueue
-	go u.run(ctxRun)
-	go u.uploadQueue(ctxQueue)
-	log.Fatal(l.Start())
+	u.wg.Add(1 + u.workers)
+	go func() {
+		defer u.wg.Done()
+		u.run(ctxRun)
+	}()
+	for i := 0; i < u.workers; i++ {
+		go func() {
+			defer u.wg.Done()
+			u.uploadQueue(ctxQueue)
+		}()
+	}
+	return u.listener.Start()
+}
+
+// Pause stops uploads until Resume is called. Customers already queued are left for the next check for work after
+// uploads resume.
+func (u *upload) Pause() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.paused = true
+	u.log.Info("uploads paused")
+}
+
+// Resume restarts uploads after Pause, checking for work straight away.
+func (u *upload) Resume() {
+	u.mutex.Lock()
+	u.paused = false
+	u.mutex.Unlock()
+	u.log.Info("uploads resumed")
+	u.Check()
+}
+
+// Paused reports whether uploads are paused.
+func (u *upload) Paused() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.paused
+}
+
+// Check checks for work straight away, rather than waiting for the next check, and starts the backoff over.
+func (u *upload) Check() {
+	select {
+	case u.checkChan <- struct{}{}:
+	default:
+		// A check is already waiting to happen.
+	}
+}
+
+// Health adds the uploader's checks: the signal listener, whether the CRM can be reached and whether posts to it are
+// being held back.
+func (u *upload) Health(c *health.Checker) {
+	c.Live("listener", func(ctx context.Context) error {
+		if u.listener == nil {
+			return errors.New("not started")
+		}
+		return u.listener.Ready(ctx)
+	})
+	c.Ready("crm", u.crmReachable)
+	c.Ready("circuit", func(ctx context.Context) error {
+		if state := u.circuit.State(); state != circuitClosed {
+			return fmt.Errorf("circuit is %s", state)
+		}
+		return nil
+	})
+}
+
+// crmReachable checks the CRM answers at all, whatever it answers with.
+func (u *upload) crmReachable(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodHead, u.crmServerAddress, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
 }
 
 // Stop will signal the running uploader go routines to finish and return then wait for any other processes to finish.
+// Selects and posts in flight are cancelled, so Stop returns once any outcome already known has been recorded.
 func (u *upload) Stop() {
 	u.stopRun()    // Signals the run() loops that we're Stop has been called.
 	u.closeQueue() // Signals the upload queue to finish and exit.
@@ -82,73 +309,265 @@ func (u *upload) run(ctx context.Context) {
 		}
 
 		select {
-		case <-u.sigChan:
-			u.processNewCustomers()
-			timer.Reset(time.Duration(fib()) * time.Second)
+		case p := <-u.sigChan:
+			// A prioritised import shouldn't have to wait out a long backoff for its follow up checks.
+			if p.Priority > 0 {
+				fib = fibFunc()
+			}
+			u.processNewCustomers(ctx, p)
+			u.resetTimer(timer, fib())
+		case <-u.checkChan:
+			fib = fibFunc()
+			u.processNewCustomers(ctx, signal.Payload{})
+			u.resetTimer(timer, fib())
 		case <-ctx.Done():
-			log.Print("we're done here")
+			u.log.Info("stopped checking for work")
 			return
 		case <-timer.C:
-			log.Print("checking for work")
-			u.processNewCustomers()
-			timer.Reset(time.Duration(fib()) * time.Second)
+			u.log.Debug("checking for work")
+			u.processNewCustomers(ctx, signal.Payload{})
+			u.resetTimer(timer, fib())
 		}
 	}
 }
 
-func (u *upload) processNewCustomers() {
-	customers, err := u.db.SelectCustomersForUpload()
-	if err != nil {
-		log.Print(fmt.Errorf("error getting new customers for upload: %s", err))
+// processNewCustomers queues the customers described by the payload for upload, or every customer waiting to be
+// uploaded if the payload doesn't describe any. The customers are selected a page at a time, in id order, and each
+// page is only selected once the queue has taken the last, so however many customers are waiting no more than a page
+// of them is held at once.
+func (u *upload) processNewCustomers(ctx context.Context, p signal.Payload) {
+	if u.Paused() {
+		return
 	}
 
-	if customers.Count() == 0 {
-		return
+	after, last := int64(math.MinInt64), int64(math.MaxInt64)
+	if p.Ranged() {
+		after, last = p.FirstID-1, p.LastID
+	} else {
+		after = u.resumeAfter
 	}
+	full := !p.Ranged() && after == math.MinInt64
 
-	log.Printf("Processing %d customers", customers.Count())
-	for _, customer := range customers.List() {
-		u.uploadChan <- customer
+	log := u.log
+	if p.JobID != "" {
+		log = log.With(logging.F(logging.JobID, p.JobID))
 	}
-    log.Print("done.")
+
+	selected, queued := 0, 0
+	for {
+		size := u.pageSize
+		if u.checkLimit > 0 && u.checkLimit-selected < size {
+			size = u.checkLimit - selected
+		}
+		if size == 0 {
+			// More customers are waiting than a check takes, so check again straight away, carrying on from here.
+			if !p.Ranged() {
+				u.resumeAfter = after
+			}
+			log.Info("check for work reached its limit", logging.F("customers", selected))
+			u.Check()
+			break
+		}
+
+		customers, err := u.db.SelectCustomersForUploadAfter(ctx, after, last, size)
+		if ctx.Err() != nil {
+			// Stopping, the customers are picked up again next time.
+			return
+		}
+		if err != nil {
+			log.Error("getting new customers for upload failed", logging.Err(err))
+			return
+		}
+		if customers.Count() > 0 {
+			if selected == 0 {
+				log.Info("processing customers")
+			}
+			selected += customers.Count()
+			after = customers[customers.Count()-1].Id
+			// The queue only takes the page as fast as the workers empty it.
+			queued += u.enqueue(ctx, customers)
+			if ctx.Err() != nil || u.Paused() {
+				return
+			}
+		}
+		if customers.Count() < size {
+			// That was the last page.
+			if !p.Ranged() {
+				u.resumeAfter = math.MinInt64
+			}
+			if full {
+				pendingCustomers.Set(float64(selected))
+			}
+			break
+		}
+	}
+
+	if selected > 0 {
+		log.Debug("customers queued for upload", logging.F("customers", selected), logging.F("queued", queued))
+	}
+}
+
+// enqueue queues the customers for upload, returning how many were queued. A customer that is still queued from an
+// earlier check is selected again, as it hasn't been uploaded yet, and is skipped so it is only posted once. Queueing
+// stops once ctx is done, as the queue may be full with no worker left to empty it.
+func (u *upload) enqueue(ctx context.Context, customers database.Customers) int {
+	n := 0
+	for _, customer := range customers {
+		u.mutex.Lock()
+		queued := u.queued[customer.Id]
+		u.queued[customer.Id] = true
+		u.mutex.Unlock()
+		if queued {
+			continue
+		}
+
+		select {
+		case u.uploadChan <- customer:
+		case <-ctx.Done():
+			u.dequeue(customer.Id)
+			return n
+		}
+		queueDepth.Set(float64(len(u.uploadChan)))
+		n++
+	}
+	return n
+}
+
+// dequeue allows the customer to be queued again.
+func (u *upload) dequeue(id int64) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.queued, id)
 }
 
-func (u *upload) post(c database.Customer) error {
+// post posts the customer to the CRM, returning the attempt to record whether or not it succeeded. The post is
+// abandoned once ctx is done.
+func (u *upload) post(ctx context.Context, c *database.Customer) (database.UploadAttempt, error) {
+	attempt := database.UploadAttempt{CustomerID: c.Id, Requested: time.Now(), WorkerID: u.workerID}
 	customerJSON, err := json.Marshal(c)
-	req := bytes.NewBuffer(customerJSON)
 	if err != nil {
-		return fmt.Errorf("error marshaling customerr: %s", err)
+		return attempt, fmt.Errorf("error marshaling customerr: %s", err)
 	}
+	req, err := http.NewRequest(http.MethodPost, u.crmServerAddress+u.crmAPI, bytes.NewReader(customerJSON))
+	if err != nil {
+		return attempt, fmt.Errorf("error creating CRM request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := u.httpClient.Post(u.crmServerAddress+u.crmAPI, "application/json", req)
+	resp, err := u.httpClient.Do(req.WithContext(ctx))
+	attempt.Duration = time.Since(attempt.Requested)
+	postDuration.Observe(attempt.Duration.Seconds())
 	if err != nil {
-		return fmt.Errorf("error while posting to CRM: %s", err)
+		postsTotal.Inc("error")
+		return attempt, fmt.Errorf("error while posting to CRM: %s", err)
 	}
+	attempt.Status = resp.StatusCode
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseRead))
+	resp.Body.Close()
+	attempt.Response = responseText(body)
+	postsTotal.Inc(strconv.Itoa(resp.StatusCode))
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("post to CRM failed with (%d) %s", resp.StatusCode, resp.Status)
+		return attempt, &crmError{code: resp.StatusCode, status: resp.Status}
 	}
-	return nil
+	attempt.CRMID = crmID(u.crmIDSources, resp.Header, body)
+	return attempt, nil
+}
+
+// responseText is the start of the CRM's answer as text that can be stored: invalid UTF-8 is replaced and NULs,
+// which Postgres won't store, are dropped.
+func responseText(body []byte) string {
+	if len(body) > maxResponseLength {
+		// This may cut a character in two, which is replaced like any other invalid UTF-8.
+		body = body[:maxResponseLength]
+	}
+	return strings.Replace(string([]rune(string(body))), "\x00", "", -1)
+}
+
+// crmError is a post the CRM answered with anything other than 201 Created.
+type crmError struct {
+	code   int
+	status string
+}
+
+func (e *crmError) Error() string {
+	return fmt.Sprintf("post to CRM failed with (%d) %s", e.code, e.status)
+}
+
+// unavailable reports whether a failed post means the CRM itself is in trouble, rather than it rejecting one customer.
+func unavailable(err error) bool {
+	if e, ok := err.(*crmError); ok {
+		return e.code >= 500 || e.code == http.StatusTooManyRequests
+	}
+	return true
 }
 
 func (u *upload) uploadQueue(ctx context.Context) {
-    var err error
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case customer := <-u.uploadChan:
-			if err = u.post(customer); err == nil {
-                if err = customer.Uploaded(); err == nil {
-                    u.success()
-                }
-			}
-			if err != nil {
-			    log.Print(err)
-            }
+			queueDepth.Set(float64(len(u.uploadChan)))
+			u.upload(ctx, customer)
+			u.dequeue(customer.Id)
 		}
 	}
 }
 
+// upload posts the customer to the CRM and records the outcome. A post cancelled by ctx has no outcome, the customer
+// is left for the next check for work. Once the CRM has answered, the outcome is recorded however long that takes up
+// to the database's own timeouts, so a customer the CRM accepted isn't posted again.
+func (u *upload) upload(ctx context.Context, customer *database.Customer) {
+	if u.Paused() || !u.circuit.allow() {
+		// Left for the next check for work.
+		return
+	}
+	attempt, err := u.post(ctx, customer)
+	if err != nil && ctx.Err() != nil {
+		u.log.Info("upload abandoned", logging.F(logging.CustomerID, customer.Id), logging.Err(err))
+		u.circuit.cancel()
+		return
+	}
+	u.circuit.result(err != nil && unavailable(err))
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	// Recording isn't cancelled by ctx, see above.
+	record := context.Background()
+	if recErr := u.db.RecordAttempt(record, attempt); recErr != nil {
+		u.log.Error("recording upload attempt failed", logging.Err(recErr))
+	}
+	if err != nil {
+		// A customer the CRM rejects outright is never going to be accepted, so it is dead-lettered.
+		if recErr := u.db.MarkUploadFailed(record, customer, err.Error(), !unavailable(err)); recErr != nil {
+			u.log.Error("recording failed upload failed", logging.Err(recErr))
+		}
+	} else {
+		if err = u.db.MarkUploaded(record, customer, attempt.CRMID); err == nil {
+			uploadedTotal.Inc()
+			uploadRate.Mark(1)
+			u.success()
+		}
+	}
+	if err != nil {
+		fields := []logging.Field{logging.F(logging.CustomerID, customer.Id), logging.Err(err)}
+		if e, ok := err.(*crmError); ok {
+			fields = append(fields, logging.F(logging.Status, e.code))
+		}
+		u.log.Error("uploading customer failed", fields...)
+	}
+}
+
+// resetTimer waits the given number of seconds, or the max backoff if that is less, before the next check for work.
+func (u *upload) resetTimer(timer *time.Timer, seconds int) {
+	d := time.Duration(seconds) * time.Second
+	if u.maxBackoff > 0 && d > u.maxBackoff {
+		d = u.maxBackoff
+	}
+	backoffSeconds.Set(d.Seconds())
+	timer.Reset(d)
+}
+
 func (u *upload) success() {
 	select {
 	case u.successChan <- struct{}{}:
@@ -0,0 +1,304 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/database"
+	databaseMock "github.com/dbyington/csv-crm-upload/database/mock"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+var _ = Describe("upload", func() {
+	var u *upload
+
+	BeforeEach(func() {
+		u = NewUploader("localhost:0", "http://localhost:1", "/customers", nil)
+		u.SetLogger(logging.Nop())
+	})
+
+	Context(".post", func() {
+		var (
+			server *httptest.Server
+			code   int
+			body   string
+			key    string
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(code)
+				w.Write([]byte(body))
+			}))
+			u = NewUploader("localhost:0", server.URL, "/customers", nil)
+			u.SetWorkerID("worker-1")
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should describe the attempt", func() {
+			code, body = http.StatusCreated, `{"id":"abc"}`
+			attempt, err := u.post(context.Background(), &database.Customer{Id: 7, Email: "jon.doe@mail.com"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attempt.Status).To(Equal(http.StatusCreated))
+			Expect(attempt.Response).To(Equal(`{"id":"abc"}`))
+			Expect(attempt.CRMID).To(Equal("abc"))
+			Expect(attempt.WorkerID).To(Equal("worker-1"))
+			Expect(attempt.Requested).ToNot(BeZero())
+			Expect(attempt.Duration).To(BeNumerically(">", 0))
+		})
+
+		It("should describe a rejected attempt", func() {
+			code, body = http.StatusBadRequest, "bad email"
+			attempt, err := u.post(context.Background(), &database.Customer{Id: 1})
+			Expect(err).To(BeAssignableToTypeOf(&crmError{}))
+			Expect(attempt.Status).To(Equal(http.StatusBadRequest))
+			Expect(attempt.Response).To(Equal("bad email"))
+			Expect(attempt.CRMID).To(BeEmpty())
+		})
+
+		It("should describe an attempt with no answer", func() {
+			server.Close()
+			attempt, err := u.post(context.Background(), &database.Customer{Id: 1})
+			Expect(err).To(HaveOccurred())
+			Expect(attempt.Status).To(BeZero())
+			Expect(attempt.WorkerID).To(Equal("worker-1"))
+		})
+
+		It("should abandon the post once cancelled", func() {
+			key = ""
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := u.post(ctx, &database.Customer{Id: 1})
+			Expect(err).To(MatchError(ContainSubstring(context.Canceled.Error())))
+			Expect(key).To(BeEmpty())
+		})
+	})
+
+	Context(".upload", func() {
+		var (
+			server   *httptest.Server
+			code     int
+			mockCtrl *gomock.Controller
+			store    *databaseMock.MockStore
+			customer *database.Customer
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(code)
+				w.Write([]byte(`{"id":"abc"}`))
+			}))
+			mockCtrl = gomock.NewController(GinkgoT())
+			store = databaseMock.NewMockStore(mockCtrl)
+			u = NewUploader("localhost:0", server.URL, "/customers", store)
+			u.SetLogger(logging.Nop())
+			customer = database.NewCustomer(7, "jon", "doe", "jon.doe@mail.com", "")
+		})
+
+		AfterEach(func() {
+			mockCtrl.Finish()
+			server.Close()
+		})
+
+		It("should record an upload the CRM accepted", func() {
+			code = http.StatusCreated
+			store.EXPECT().RecordAttempt(gomock.Any(), gomock.AssignableToTypeOf(database.UploadAttempt{})).
+				Do(func(_ context.Context, a database.UploadAttempt) {
+					Expect(a.CustomerID).To(Equal(int64(7)))
+					Expect(a.Status).To(Equal(http.StatusCreated))
+				})
+			store.EXPECT().MarkUploaded(gomock.Any(), customer, "abc")
+			u.upload(context.Background(), customer)
+		})
+
+		It("should dead-letter a customer the CRM rejected", func() {
+			code = http.StatusBadRequest
+			store.EXPECT().RecordAttempt(gomock.Any(), gomock.Any())
+			store.EXPECT().MarkUploadFailed(gomock.Any(), customer, gomock.Any(), true)
+			u.upload(context.Background(), customer)
+		})
+
+		It("should record nothing once cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			u.upload(ctx, customer)
+		})
+
+		It("should let another probe through when the probe is cancelled", func() {
+			for i := 0; i < circuitThreshold; i++ {
+				u.circuit.result(true)
+			}
+			u.circuit.openedAt = u.circuit.openedAt.Add(-circuitCooldown)
+			Expect(u.circuit.State()).To(Equal(circuitHalfOpen))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			u.upload(ctx, customer)
+			Expect(u.circuit.allow()).To(BeTrue())
+		})
+	})
+
+	Context("responseText", func() {
+		It("should keep only the start of the answer", func() {
+			Expect(responseText([]byte(strings.Repeat("a", 2*maxResponseLength)))).To(HaveLen(maxResponseLength))
+		})
+
+		It("should make the answer safe to store", func() {
+			Expect(responseText([]byte("ok\x00\xff"))).To(Equal("ok\uFFFD"))
+		})
+	})
+
+	Context(".Check", func() {
+		It("should not block when a check is already waiting", func() {
+			u.Check()
+			u.Check()
+			Expect(u.checkChan).To(Receive())
+			Expect(u.checkChan).ToNot(Receive())
+		})
+	})
+
+	Context(".UseLocalListener", func() {
+		It("should take signals sent in the same process", func() {
+			l := u.UseLocalListener()
+			Expect(u.listener).To(BeIdenticalTo(l))
+			Expect(l.Signal(signal.ForIDs(7))).To(Succeed())
+			Expect(u.sigChan).To(Receive(Equal(signal.ForIDs(7))))
+		})
+	})
+
+	Context(".enqueue", func() {
+		It("should queue a customer only once until it has been handled", func() {
+			customers := database.NewCustomers(database.NewCustomer(1, "jon", "doe", "jon.doe@mail.com", ""),
+				database.NewCustomer(2, "jane", "doe", "jane.doe@mail.com", ""))
+			Expect(u.enqueue(context.Background(), customers)).To(Equal(2))
+			Expect(u.enqueue(context.Background(), customers)).To(Equal(0))
+			Expect(u.uploadChan).To(HaveLen(2))
+
+			u.dequeue((<-u.uploadChan).Id)
+			Expect(u.enqueue(context.Background(), customers)).To(Equal(1))
+		})
+
+		It("should stop queueing once cancelled", func() {
+			u.SetQueueSize(1)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			customers := database.NewCustomers(database.NewCustomer(1, "jon", "doe", "jon.doe@mail.com", ""),
+				database.NewCustomer(2, "jane", "doe", "jane.doe@mail.com", ""))
+			Expect(u.enqueue(ctx, customers)).To(BeNumerically("<=", 1))
+			Expect(u.queued).To(HaveLen(len(u.uploadChan)))
+		})
+	})
+
+	Context(".processNewCustomers", func() {
+		var (
+			mockCtrl *gomock.Controller
+			store    *databaseMock.MockStore
+		)
+
+		page := func(ids ...int64) database.Customers {
+			customers := database.NewCustomers()
+			for _, id := range ids {
+				customers.Append(database.NewCustomer(id, "jon", "doe", "jon.doe@mail.com", ""))
+			}
+			return customers
+		}
+
+		BeforeEach(func() {
+			mockCtrl = gomock.NewController(GinkgoT())
+			store = databaseMock.NewMockStore(mockCtrl)
+			u = NewUploader("localhost:0", "http://localhost:1", "/customers", store)
+			u.SetLogger(logging.Nop())
+			u.SetPageSize(2)
+		})
+
+		AfterEach(func() {
+			mockCtrl.Finish()
+		})
+
+		It("should queue every customer waiting a page at a time", func() {
+			gomock.InOrder(
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(math.MinInt64), int64(math.MaxInt64), 2).Return(page(1, 2), nil),
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(2), int64(math.MaxInt64), 2).Return(page(3), nil),
+			)
+			u.processNewCustomers(context.Background(), signal.Payload{})
+			Expect(u.uploadChan).To(HaveLen(3))
+			Expect(u.checkChan).ToNot(Receive())
+		})
+
+		It("should only select the customers the signal describes", func() {
+			store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(4), int64(9), 2).Return(page(5), nil)
+			u.processNewCustomers(context.Background(), signal.ForIDs(5, 9))
+			Expect(u.uploadChan).To(HaveLen(1))
+		})
+
+		It("should carry on from where a check that reached its limit stopped", func() {
+			u.SetCheckLimit(3)
+			gomock.InOrder(
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(math.MinInt64), int64(math.MaxInt64), 2).Return(page(1, 2), nil),
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(2), int64(math.MaxInt64), 1).Return(page(3), nil),
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(3), int64(math.MaxInt64), 2).Return(page(), nil),
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(math.MinInt64), int64(math.MaxInt64), 2).Return(page(), nil),
+			)
+			u.processNewCustomers(context.Background(), signal.Payload{})
+			Expect(u.uploadChan).To(HaveLen(3))
+			Expect(u.checkChan).To(Receive())
+
+			u.processNewCustomers(context.Background(), signal.Payload{})
+			u.processNewCustomers(context.Background(), signal.Payload{})
+		})
+
+		It("should not select the next page until the queue has taken this one", func() {
+			u.SetQueueSize(1)
+			u.SetPageSize(1)
+			gomock.InOrder(
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(math.MinInt64), int64(math.MaxInt64), 1).Return(page(1), nil),
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(1), int64(math.MaxInt64), 1).Return(page(2), nil),
+				store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), int64(2), int64(math.MaxInt64), 1).Return(page(), nil),
+			)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				u.processNewCustomers(context.Background(), signal.Payload{})
+			}()
+
+			Consistently(done).ShouldNot(BeClosed())
+			Expect((<-u.uploadChan).Id).To(Equal(int64(1)))
+			Eventually(done).Should(BeClosed())
+			Expect((<-u.uploadChan).Id).To(Equal(int64(2)))
+		})
+
+		It("should stop at the first page that fails", func() {
+			store.EXPECT().SelectCustomersForUploadAfter(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("test error"))
+			u.processNewCustomers(context.Background(), signal.Payload{})
+			Expect(u.uploadChan).To(BeEmpty())
+		})
+	})
+
+	Context(".Pause", func() {
+		It("should pause until resumed", func() {
+			u.Pause()
+			Expect(u.Paused()).To(BeTrue())
+			u.Resume()
+			Expect(u.Paused()).To(BeFalse())
+		})
+
+		It("should check for work on resuming", func() {
+			u.Pause()
+			u.Resume()
+			Expect(u.checkChan).To(Receive())
+		})
+	})
+})
@@ -0,0 +1,359 @@
+package mockcrm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The faults that can be injected. The others are answered with their HTTP status code.
+const (
+	// FaultTimeout holds the request without answering until the client gives up, or the scenario's timeout passes.
+	FaultTimeout = "timeout"
+	// FaultReset drops the connection without answering.
+	FaultReset = "reset"
+)
+
+// Scenario describes how the mock CRM misbehaves.
+type Scenario struct {
+	// Seed makes the scenario repeatable, requests made in the same order get the same answers. 0 picks a seed.
+	Seed    int64   `json:"seed"`
+	Latency Latency `json:"latency"`
+	// Faults are tried for each request in turn, each with its own rate.
+	Faults []Fault `json:"faults"`
+	// Outages are windows when every request fails.
+	Outages []Outage `json:"outages"`
+	// Timeout is how long a timed out request is held, 0 for as long as the client waits.
+	Timeout Duration `json:"timeout"`
+}
+
+// Latency is how long to wait before answering each request.
+type Latency struct {
+	// Distribution is "fixed" (Mean), "uniform" (between Min and Max), "normal" (Mean and StdDev) or
+	// "exponential" (Mean). Empty means no latency.
+	Distribution string   `json:"distribution"`
+	Min          Duration `json:"min"`
+	Max          Duration `json:"max"`
+	Mean         Duration `json:"mean"`
+	StdDev       Duration `json:"stddev"`
+}
+
+// Fault is a failure injected into a share of the requests.
+type Fault struct {
+	// Kind is FaultTimeout, FaultReset or an HTTP status code such as "503".
+	Kind string  `json:"kind"`
+	Rate float64 `json:"rate"`
+	// RetryAfter is sent with a 429 or 503 when set.
+	RetryAfter Duration `json:"retry_after"`
+}
+
+// Outage is a window when every request is answered with Status, 503 if it isn't set. It starts Start after the
+// server does and lasts Duration, and then happens again Every so often if Every is set.
+type Outage struct {
+	Start    Duration `json:"start"`
+	Duration Duration `json:"duration"`
+	Every    Duration `json:"every"`
+	Status   int      `json:"status"`
+}
+
+// Duration is a time.Duration written as a string, "250ms" say, in scenario files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"250ms\": %s", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadScenario reads a scenario from a JSON file.
+func LoadScenario(path string) (Scenario, error) {
+	var s Scenario
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, fmt.Errorf("while reading scenario: %s", err)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("while parsing scenario: %s", err)
+	}
+	return s, s.Validate()
+}
+
+// Validate checks the scenario can be run.
+func (s Scenario) Validate() error {
+	switch s.Latency.Distribution {
+	case "", "fixed", "uniform", "normal", "exponential":
+	default:
+		return fmt.Errorf("unknown latency distribution %q", s.Latency.Distribution)
+	}
+	for _, f := range s.Faults {
+		if f.Rate < 0 || f.Rate > 1 {
+			return fmt.Errorf("rate of %s faults must be between 0 and 1", f.Kind)
+		}
+		if f.Kind == FaultTimeout || f.Kind == FaultReset {
+			continue
+		}
+		if code, err := strconv.Atoi(f.Kind); err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("unknown fault %q, must be timeout, reset or an HTTP status code", f.Kind)
+		}
+	}
+	for _, o := range s.Outages {
+		if o.Duration <= 0 {
+			return fmt.Errorf("outages must have a duration")
+		}
+	}
+	return nil
+}
+
+// ParseFaults parses faults written as kind=rate pairs, e.g. "503=0.1,429=0.05,reset=0.01".
+func ParseFaults(s string, retryAfter time.Duration) ([]Fault, error) {
+	var faults []Fault
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("fault %q must be kind=rate", pair)
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("fault %q must be kind=rate", pair)
+		}
+		faults = append(faults, Fault{Kind: parts[0], Rate: rate, RetryAfter: Duration(retryAfter)})
+	}
+	return faults, nil
+}
+
+// ParseLatency parses a latency written as distribution:values, one of fixed:<mean>, uniform:<min>:<max>,
+// normal:<mean>:<stddev> or exponential:<mean>.
+func ParseLatency(s string) (Latency, error) {
+	var l Latency
+	if s == "" {
+		return l, nil
+	}
+
+	parts := strings.Split(s, ":")
+	values := make([]Duration, len(parts)-1)
+	for i, p := range parts[1:] {
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			return l, fmt.Errorf("latency %q: %s", s, err)
+		}
+		values[i] = Duration(d)
+	}
+
+	l.Distribution = parts[0]
+	switch {
+	case (l.Distribution == "fixed" || l.Distribution == "exponential") && len(values) == 1:
+		l.Mean = values[0]
+	case l.Distribution == "uniform" && len(values) == 2:
+		l.Min, l.Max = values[0], values[1]
+	case l.Distribution == "normal" && len(values) == 2:
+		l.Mean, l.StdDev = values[0], values[1]
+	default:
+		return l, fmt.Errorf("latency %q must be fixed:<mean>, uniform:<min>:<max>, normal:<mean>:<stddev> or exponential:<mean>", s)
+	}
+	return l, nil
+}
+
+// ParseOutage parses an outage written as <start>:<duration>, or <start>:<duration>:<every> for one that repeats.
+func ParseOutage(s string) (Outage, error) {
+	var o Outage
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return o, fmt.Errorf("outage %q must be <start>:<duration> or <start>:<duration>:<every>", s)
+	}
+	values := make([]Duration, len(parts))
+	for i, p := range parts {
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			return o, fmt.Errorf("outage %q: %s", s, err)
+		}
+		values[i] = Duration(d)
+	}
+	o.Start, o.Duration = values[0], values[1]
+	if len(values) == 3 {
+		o.Every = values[2]
+	}
+	return o, nil
+}
+
+// injector decides how each request is answered.
+type injector struct {
+	scenario Scenario
+	started  time.Time
+	now      func() time.Time
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func newInjector(s Scenario, now func() time.Time) *injector {
+	if s.Seed == 0 {
+		s.Seed = now().UnixNano()
+	}
+	return &injector{scenario: s, started: now(), now: now, rand: rand.New(rand.NewSource(s.Seed))}
+}
+
+// outage returns the status to answer with if an outage is under way, or 0.
+func (in *injector) outage() int {
+	since := in.now().Sub(in.started)
+	for _, o := range in.scenario.Outages {
+		into := since - time.Duration(o.Start)
+		if into < 0 {
+			continue
+		}
+		if o.Every > 0 {
+			into %= time.Duration(o.Every)
+		}
+		if into < time.Duration(o.Duration) {
+			if o.Status == 0 {
+				return http.StatusServiceUnavailable
+			}
+			return o.Status
+		}
+	}
+	return 0
+}
+
+// latency picks how long to wait before answering.
+func (in *injector) latency() time.Duration {
+	l := in.scenario.Latency
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	var d float64
+	switch l.Distribution {
+	case "fixed":
+		d = float64(l.Mean)
+	case "uniform":
+		d = float64(l.Min) + in.rand.Float64()*float64(l.Max-l.Min)
+	case "normal":
+		d = in.rand.NormFloat64()*float64(l.StdDev) + float64(l.Mean)
+	case "exponential":
+		d = in.rand.ExpFloat64() * float64(l.Mean)
+	}
+	return time.Duration(math.Max(d, 0))
+}
+
+// fault picks the fault to inject, if any.
+func (in *injector) fault() (Fault, bool) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	// Every request takes one draw so a seed gives the same sequence of answers however the faults are set.
+	p := in.rand.Float64()
+	for _, f := range in.scenario.Faults {
+		if p < f.Rate {
+			return f, true
+		}
+		p -= f.Rate
+	}
+	return Fault{}, false
+}
+
+// inject answers the request with a fault, reporting whether it did.
+func (in *injector) inject(w http.ResponseWriter, r *http.Request) bool {
+	if status := in.outage(); status != 0 {
+		w.WriteHeader(status)
+		return true
+	}
+
+	if d := in.latency(); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+
+	f, ok := in.fault()
+	if !ok {
+		return false
+	}
+	switch f.Kind {
+	case FaultTimeout:
+		in.hold(r)
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case FaultReset:
+		reset(w)
+	default:
+		code, _ := strconv.Atoi(f.Kind)
+		if f.RetryAfter > 0 {
+			// Retry-After is whole seconds, round up so a client never retries early.
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Duration(f.RetryAfter).Seconds()))))
+		}
+		w.WriteHeader(code)
+	}
+	return true
+}
+
+// hold waits until the client gives up, or the scenario's timeout passes.
+func (in *injector) hold(r *http.Request) {
+	if in.scenario.Timeout <= 0 {
+		<-r.Context().Done()
+		return
+	}
+	select {
+	case <-time.After(time.Duration(in.scenario.Timeout)):
+	case <-r.Context().Done():
+	}
+}
+
+// reset drops the connection so the client sees it reset rather than closed.
+func reset(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// String describes the scenario for the log.
+func (s Scenario) String() string {
+	var parts []string
+	parts = append(parts, fmt.Sprintf("seed=%d", s.Seed))
+	if s.Latency.Distribution != "" {
+		parts = append(parts, "latency="+s.Latency.Distribution)
+	}
+	faults := make([]string, 0, len(s.Faults))
+	for _, f := range s.Faults {
+		faults = append(faults, fmt.Sprintf("%s=%g", f.Kind, f.Rate))
+	}
+	sort.Strings(faults)
+	if len(faults) > 0 {
+		parts = append(parts, "faults="+strings.Join(faults, ","))
+	}
+	if len(s.Outages) > 0 {
+		parts = append(parts, fmt.Sprintf("outages=%d", len(s.Outages)))
+	}
+	return strings.Join(parts, " ")
+}
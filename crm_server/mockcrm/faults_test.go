@@ -0,0 +1,144 @@
+package mockcrm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func clockAt() func() time.Time {
+	now := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	return func() time.Time { return now }
+}
+
+var _ = Describe("Faults", func() {
+	var (
+		now   time.Time
+		clock = func() time.Time { return now }
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	answers := func(in *injector, n int) []int {
+		codes := make([]int, n)
+		for i := range codes {
+			w := httptest.NewRecorder()
+			if !in.inject(w, httptest.NewRequest(http.MethodPost, "/customers", nil)) {
+				w.WriteHeader(http.StatusCreated)
+			}
+			codes[i] = w.Code
+		}
+		return codes
+	}
+
+	Context("with a seed", func() {
+		It("should give the same answers every time", func() {
+			s := Scenario{Seed: 42, Faults: []Fault{{Kind: "503", Rate: 0.3}, {Kind: "500", Rate: 0.2}}}
+			first := answers(newInjector(s, clock), 50)
+			Expect(answers(newInjector(s, clock), 50)).To(Equal(first))
+			Expect(first).To(ContainElement(http.StatusServiceUnavailable))
+			Expect(first).To(ContainElement(http.StatusInternalServerError))
+			Expect(first).To(ContainElement(http.StatusCreated))
+		})
+	})
+
+	It("should send Retry-After with a 429", func() {
+		in := newInjector(Scenario{Faults: []Fault{{Kind: "429", Rate: 1, RetryAfter: Duration(1500 * time.Millisecond)}}}, clock)
+		w := httptest.NewRecorder()
+		Expect(in.inject(w, httptest.NewRequest(http.MethodPost, "/customers", nil))).To(BeTrue())
+		Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(w.Header().Get("Retry-After")).To(Equal("2"))
+	})
+
+	It("should fail every request during an outage", func() {
+		in := newInjector(Scenario{Outages: []Outage{{Start: Duration(time.Minute), Duration: Duration(10 * time.Second), Every: Duration(time.Hour)}}}, clock)
+		Expect(in.outage()).To(BeZero())
+		now = now.Add(time.Minute + 5*time.Second)
+		Expect(in.outage()).To(Equal(http.StatusServiceUnavailable))
+		now = now.Add(10 * time.Second)
+		Expect(in.outage()).To(BeZero())
+		now = now.Add(time.Hour - 10*time.Second)
+		Expect(in.outage()).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should keep latency within a uniform range", func() {
+		in := newInjector(Scenario{Seed: 1, Latency: Latency{Distribution: "uniform", Min: Duration(time.Millisecond), Max: Duration(2 * time.Millisecond)}}, clock)
+		for i := 0; i < 20; i++ {
+			Expect(in.latency()).To(BeNumerically("~", 1500*time.Microsecond, 500*time.Microsecond))
+		}
+	})
+
+	It("should reset the connection", func() {
+		server := httptest.NewServer(newServer(Scenario{Faults: []Fault{{Kind: FaultReset, Rate: 1}}}, clock))
+		defer server.Close()
+		_, err := http.Post(server.URL+"/customers", "application/json", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should hold a timed out request until the client gives up", func() {
+		server := httptest.NewServer(newServer(Scenario{Faults: []Fault{{Kind: FaultTimeout, Rate: 1}}}, clock))
+		defer server.Close()
+		client := &http.Client{Timeout: 50 * time.Millisecond}
+		_, err := client.Post(server.URL+"/customers", "application/json", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("parsing", func() {
+		It("should parse faults", func() {
+			faults, err := ParseFaults("503=0.1, reset=0.01", time.Second)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(faults).To(Equal([]Fault{{Kind: "503", Rate: 0.1, RetryAfter: Duration(time.Second)}, {Kind: FaultReset, Rate: 0.01, RetryAfter: Duration(time.Second)}}))
+			_, err = ParseFaults("503", 0)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should parse latencies", func() {
+			l, err := ParseLatency("normal:100ms:20ms")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(l).To(Equal(Latency{Distribution: "normal", Mean: Duration(100 * time.Millisecond), StdDev: Duration(20 * time.Millisecond)}))
+			_, err = ParseLatency("uniform:100ms")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should parse outages", func() {
+			o, err := ParseOutage("30s:10s:2m")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(o).To(Equal(Outage{Start: Duration(30 * time.Second), Duration: Duration(10 * time.Second), Every: Duration(2 * time.Minute)}))
+		})
+
+		It("should reject unknown faults", func() {
+			faults, err := ParseFaults("418=0.1,teapot=0.1", 0)
+			Expect(err).ToNot(HaveOccurred())
+			err = Scenario{Faults: faults}.Validate()
+			Expect(err).To(MatchError(`unknown fault "teapot", must be timeout, reset or an HTTP status code`))
+		})
+
+		It("should load a scenario file", func() {
+			dir, err := ioutil.TempDir("", "scenario")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "incident.json")
+			Expect(ioutil.WriteFile(path, []byte(`{
+				"seed": 7,
+				"latency": {"distribution": "exponential", "mean": "80ms"},
+				"faults": [{"kind": "429", "rate": 0.2, "retry_after": "3s"}, {"kind": "reset", "rate": 0.05}],
+				"outages": [{"start": "1m", "duration": "20s", "every": "5m", "status": 502}]
+			}`), 0644)).To(Succeed())
+
+			s, err := LoadScenario(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Seed).To(Equal(int64(7)))
+			Expect(s.Faults).To(HaveLen(2))
+			Expect(s.Faults[0].RetryAfter).To(Equal(Duration(3 * time.Second)))
+			Expect(s.Outages[0].Status).To(Equal(http.StatusBadGateway))
+		})
+	})
+})
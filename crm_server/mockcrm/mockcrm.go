@@ -0,0 +1,125 @@
+// Package mockcrm is a mock of the CRM the integrator uploads customers to. It stores the customers it is sent so
+// tests can check what arrived, and can be made to fail the ways a real CRM does. Serve it with httptest.NewServer in
+// tests, or run it with csvcrm mock-crm.
+package mockcrm
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+// The paths of the CRM's API. Anything else is answered as though it worked, which is all a health check needs.
+const (
+	CustomersPath = "/customers"
+	StatsPath     = "/__stats"
+)
+
+// Server is the mock CRM.
+type Server struct {
+	store *store
+	log   logging.Logger
+	now   func() time.Time
+
+	mutex    sync.Mutex
+	injector *injector
+}
+
+// New returns a mock CRM that misbehaves as the scenario says. The zero Scenario never fails.
+func New(s Scenario) *Server {
+	return newServer(s, time.Now)
+}
+
+func newServer(s Scenario, now func() time.Time) *Server {
+	return &Server{
+		store:    newStore(),
+		log:      logging.Default().With(logging.F(logging.Component, "mockcrm")),
+		now:      now,
+		injector: newInjector(s, now),
+	}
+}
+
+// SetLogger replaces the default logger. Injected faults are logged at debug level.
+func (s *Server) SetLogger(l logging.Logger) {
+	s.log = l.With(logging.F(logging.Component, "mockcrm"))
+}
+
+// SetScenario replaces the scenario, starting its outages and random faults over.
+func (s *Server) SetScenario(sc Scenario) {
+	in := newInjector(sc, s.now)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.injector = in
+}
+
+// Scenario returns the scenario in use, with the seed it was given if it didn't have one.
+func (s *Server) Scenario() Scenario {
+	return s.currentInjector().scenario
+}
+
+// Customers returns every customer stored, in the order they were received.
+func (s *Server) Customers() []Customer {
+	return s.store.list()
+}
+
+// Customer returns the customer the mock gave the id.
+func (s *Server) Customer(id string) (Customer, bool) {
+	return s.store.get(id)
+}
+
+// Payloads returns the body of every customer posted that got as far as being read, accepted or not, in the order
+// they were received.
+func (s *Server) Payloads() [][]byte {
+	return s.store.payloads()
+}
+
+// Stats counts what the mock has been sent.
+func (s *Server) Stats() Stats {
+	return s.store.Stats()
+}
+
+// Reset forgets every customer and zeroes the stats.
+func (s *Server) Reset() {
+	s.store.reset()
+}
+
+func (s *Server) currentInjector() *injector {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.injector
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The stats are for the tests, so they are never faulty.
+	if r.URL.Path == StatsPath {
+		reply(w, http.StatusOK, s.store.Stats())
+		return
+	}
+
+	s.store.count(func(st *Stats) { st.Requests++ })
+	if s.currentInjector().inject(w, r) {
+		var failed int64
+		s.store.count(func(st *Stats) {
+			st.Failed++
+			failed = st.Failed
+		})
+		s.log.Debug("failing request", logging.F("path", r.URL.Path), logging.F("failures", failed))
+		return
+	}
+
+	switch {
+	case r.URL.Path == CustomersPath && r.Method == http.MethodPost:
+		s.create(w, r)
+	case r.URL.Path == CustomersPath && r.Method == http.MethodGet:
+		s.list(w, r)
+	case strings.HasPrefix(r.URL.Path, CustomersPath+"/") && r.Method == http.MethodGet:
+		s.get(w, r, strings.TrimPrefix(r.URL.Path, CustomersPath+"/"))
+	case r.URL.Path == CustomersPath || strings.HasPrefix(r.URL.Path, CustomersPath+"/"):
+		reply(w, http.StatusMethodNotAllowed, errorReply{Error: "method not allowed"})
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,13 @@
+package mockcrm
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestMockcrm(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Mock CRM Suite")
+}
@@ -0,0 +1,67 @@
+package mockcrm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		mock   *Server
+		server *httptest.Server
+	)
+
+	post := func(body string) int {
+		resp, err := http.Post(server.URL+CustomersPath, "application/json", strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	BeforeEach(func() {
+		mock = New(Scenario{})
+		mock.SetLogger(logging.Nop())
+		server = httptest.NewServer(mock)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should keep what it was sent", func() {
+		Expect(post(`{"id": 1, "email": "jon.doe@mail.com"}`)).To(Equal(http.StatusCreated))
+		Expect(post(`{"id": 2}`)).To(Equal(http.StatusBadRequest))
+
+		Expect(mock.Payloads()).To(Equal([][]byte{[]byte(`{"id": 1, "email": "jon.doe@mail.com"}`), []byte(`{"id": 2}`)}))
+		Expect(mock.Customers()).To(HaveLen(1))
+		c, ok := mock.Customer("1")
+		Expect(ok).To(BeTrue())
+		Expect(c.Email).To(Equal("jon.doe@mail.com"))
+	})
+
+	It("should take a new scenario while running", func() {
+		Expect(post(`{"id": 1, "email": "jon.doe@mail.com"}`)).To(Equal(http.StatusCreated))
+		mock.SetScenario(Scenario{Seed: 9, Faults: []Fault{{Kind: "502", Rate: 1}}})
+		Expect(post(`{"id": 2, "email": "jane.doe@mail.com"}`)).To(Equal(http.StatusBadGateway))
+		Expect(mock.Scenario().Seed).To(Equal(int64(9)))
+		Expect(mock.Stats()).To(Equal(Stats{Requests: 2, Created: 1, Failed: 1, Customers: 1}))
+	})
+
+	It("should forget everything on reset", func() {
+		Expect(post(`{"id": 1, "email": "jon.doe@mail.com"}`)).To(Equal(http.StatusCreated))
+		mock.Reset()
+		Expect(mock.Customers()).To(BeEmpty())
+		Expect(mock.Stats()).To(Equal(Stats{}))
+		Expect(post(`{"id": 1, "email": "jon.doe@mail.com"}`)).To(Equal(http.StatusCreated))
+	})
+
+	It("should pick a seed when not given one", func() {
+		Expect(mock.Scenario().Seed).ToNot(BeZero())
+	})
+})
@@ -0,0 +1,219 @@
+package mockcrm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Customer is a customer as the CRM stores it.
+type Customer struct {
+	// ID is the CRM's own id for the customer.
+	ID string `json:"id"`
+	// ExternalID is the id the customer was sent with.
+	ExternalID int64     `json:"external_id"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	Email      string    `json:"email"`
+	Phone      string    `json:"phone"`
+	Received   time.Time `json:"received_ts"`
+}
+
+// Stats counts what the CRM has been sent.
+type Stats struct {
+	Requests int64 `json:"requests"`
+	Created  int64 `json:"created"`
+	// Failed requests are those a fault was injected into.
+	Failed     int64 `json:"failed"`
+	Invalid    int64 `json:"invalid"`
+	Duplicates int64 `json:"duplicates"`
+	Customers  int   `json:"customers"`
+}
+
+// payload is a posted customer. Pointers tell fields that weren't sent from empty ones.
+type payload struct {
+	ID        *int64  `json:"id"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+	Phone     *string `json:"phone"`
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+// The largest customer the CRM reads.
+const maxPayload = 64 * 1024
+
+// store holds the customers the CRM has accepted, in the order they were received.
+type store struct {
+	mutex     sync.Mutex
+	customers []Customer
+	byID      map[string]int
+	byEmail   map[string]int
+	received  [][]byte
+	stats     Stats
+}
+
+func newStore() *store {
+	return &store{byID: make(map[string]int), byEmail: make(map[string]int)}
+}
+
+func (s *store) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.customers, s.received, s.stats = nil, nil, Stats{}
+	s.byID, s.byEmail = make(map[string]int), make(map[string]int)
+}
+
+func (s *store) receive(body []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.received = append(s.received, body)
+}
+
+func (s *store) payloads() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]byte{}, s.received...)
+}
+
+// validate checks the payload is a customer the CRM will accept.
+func (p payload) validate() error {
+	switch {
+	case p.ID == nil:
+		return fmt.Errorf("id is required")
+	case *p.ID < 1:
+		return fmt.Errorf("id must be a positive number")
+	case p.Email == nil || *p.Email == "":
+		return fmt.Errorf("email is required")
+	}
+	at := strings.Index(*p.Email, "@")
+	if at < 1 || at == len(*p.Email)-1 || strings.ContainsAny(*p.Email, " \t\n") {
+		return fmt.Errorf("email %q is not an email address", *p.Email)
+	}
+	return nil
+}
+
+// add stores the customer, returning false if there is already a customer with its email.
+func (s *store) add(p payload, now time.Time) (Customer, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	email := strings.ToLower(*p.Email)
+	if _, ok := s.byEmail[email]; ok {
+		s.stats.Duplicates++
+		return Customer{}, false
+	}
+
+	c := Customer{
+		ID:         strconv.Itoa(len(s.customers) + 1),
+		ExternalID: *p.ID,
+		FirstName:  str(p.FirstName),
+		LastName:   str(p.LastName),
+		Email:      *p.Email,
+		Phone:      str(p.Phone),
+		Received:   now,
+	}
+	s.byID[c.ID] = len(s.customers)
+	s.byEmail[email] = len(s.customers)
+	s.customers = append(s.customers, c)
+	s.stats.Created++
+	return c, true
+}
+
+func (s *store) get(id string) (Customer, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i, ok := s.byID[id]
+	if !ok {
+		return Customer{}, false
+	}
+	return s.customers[i], true
+}
+
+func (s *store) list() []Customer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Customer{}, s.customers...)
+}
+
+// count applies the change to the stats.
+func (s *store) count(change func(*Stats)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change(&s.stats)
+}
+
+func (s *store) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Customers = len(s.customers)
+	return stats
+}
+
+// create stores a posted customer, answering 201 with the stored customer, 400 if it isn't valid or 409 if its email
+// is already taken.
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayload))
+	if err != nil {
+		s.store.count(func(st *Stats) { st.Invalid++ })
+		reply(w, http.StatusRequestEntityTooLarge, errorReply{Error: fmt.Sprintf("while reading body: %s", err)})
+		return
+	}
+	s.store.receive(body)
+
+	var p payload
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&p); err != nil {
+		s.store.count(func(st *Stats) { st.Invalid++ })
+		reply(w, http.StatusBadRequest, errorReply{Error: fmt.Sprintf("body must be a customer: %s", err)})
+		return
+	}
+	if err := p.validate(); err != nil {
+		s.store.count(func(st *Stats) { st.Invalid++ })
+		reply(w, http.StatusBadRequest, errorReply{Error: err.Error()})
+		return
+	}
+
+	customer, ok := s.store.add(p, s.now())
+	if !ok {
+		reply(w, http.StatusConflict, errorReply{Error: fmt.Sprintf("a customer with email %q already exists", *p.Email)})
+		return
+	}
+	w.Header().Set("Location", CustomersPath+"/"+customer.ID)
+	reply(w, http.StatusCreated, customer)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	reply(w, http.StatusOK, s.store.list())
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, id string) {
+	customer, ok := s.store.get(id)
+	if !ok {
+		reply(w, http.StatusNotFound, errorReply{Error: "no such customer"})
+		return
+	}
+	reply(w, http.StatusOK, customer)
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,84 @@
+package mockcrm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+var _ = Describe("Store", func() {
+	var c *Server
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	stats := func() Stats {
+		var s Stats
+		Expect(json.Unmarshal(do(http.MethodGet, StatsPath, "").Body.Bytes(), &s)).To(Succeed())
+		return s
+	}
+
+	BeforeEach(func() {
+		c = newServer(Scenario{Seed: 1}, clockAt())
+		c.SetLogger(logging.Nop())
+	})
+
+	It("should store a valid customer and say where it is", func() {
+		w := do(http.MethodPost, CustomersPath, `{"id": 7, "first_name": "jon", "last_name": "doe", "email": "jon.doe@mail.com", "phone": "+1 212 555 1234", "uploaded": false}`)
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		Expect(w.Header().Get("Location")).To(Equal("/customers/1"))
+
+		var created Customer
+		Expect(json.Unmarshal(w.Body.Bytes(), &created)).To(Succeed())
+		Expect(created.ID).To(Equal("1"))
+		Expect(created.ExternalID).To(Equal(int64(7)))
+
+		w = do(http.MethodGet, "/customers/1", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(ContainSubstring(`"email":"jon.doe@mail.com"`))
+	})
+
+	It("should reject an invalid customer", func() {
+		Expect(do(http.MethodPost, CustomersPath, `{"email": "jon.doe@mail.com"}`).Code).To(Equal(http.StatusBadRequest))
+		Expect(do(http.MethodPost, CustomersPath, `{"id": 1, "email": "jon.doe"}`).Code).To(Equal(http.StatusBadRequest))
+		Expect(do(http.MethodPost, CustomersPath, `{"id": "1", "email": "jon.doe@mail.com"}`).Code).To(Equal(http.StatusBadRequest))
+		Expect(do(http.MethodPost, CustomersPath, `[]`).Code).To(Equal(http.StatusBadRequest))
+		Expect(stats().Invalid).To(Equal(int64(4)))
+	})
+
+	It("should reject a duplicate email", func() {
+		Expect(do(http.MethodPost, CustomersPath, `{"id": 1, "email": "jon.doe@mail.com"}`).Code).To(Equal(http.StatusCreated))
+		w := do(http.MethodPost, CustomersPath, `{"id": 2, "email": "Jon.Doe@mail.com"}`)
+		Expect(w.Code).To(Equal(http.StatusConflict))
+		Expect(w.Body.String()).To(ContainSubstring("already exists"))
+		Expect(stats()).To(Equal(Stats{Requests: 2, Created: 1, Duplicates: 1, Customers: 1}))
+	})
+
+	It("should list the customers in the order they were received", func() {
+		do(http.MethodPost, CustomersPath, `{"id": 2, "email": "jane.doe@mail.com"}`)
+		do(http.MethodPost, CustomersPath, `{"id": 1, "email": "jon.doe@mail.com"}`)
+		var list []Customer
+		Expect(json.Unmarshal(do(http.MethodGet, CustomersPath, "").Body.Bytes(), &list)).To(Succeed())
+		Expect(list).To(HaveLen(2))
+		Expect(list[0].ExternalID).To(Equal(int64(2)))
+	})
+
+	It("should 404 an unknown customer", func() {
+		Expect(do(http.MethodGet, "/customers/9", "").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should count injected failures but never fail the stats", func() {
+		c = newServer(Scenario{Faults: []Fault{{Kind: "503", Rate: 1}}}, clockAt())
+		Expect(do(http.MethodPost, CustomersPath, `{"id": 1, "email": "jon.doe@mail.com"}`).Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(stats()).To(Equal(Stats{Requests: 1, Failed: 1}))
+	})
+})
@@ -0,0 +1,366 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The states a customer can be listed by. Failed customers are still pending, they will be tried again until they
+// are dead-lettered.
+const (
+	StatePending    = "pending"
+	StateFailed     = "failed"
+	StateDeadLetter = "dead_letter"
+	StateSkipped    = "skipped"
+	StateUploaded   = "uploaded"
+)
+
+// StateNotUploaded matches every customer that hasn't been uploaded, whatever state it is in. It is a filter rather
+// than a state a customer is reported to be in.
+const StateNotUploaded = "not_uploaded"
+
+// States lists every state, in the order a customer moves through them.
+var States = []string{StatePending, StateFailed, StateDeadLetter, StateSkipped, StateUploaded}
+
+// KnownState reports whether s is one of States.
+func KnownState(s string) bool {
+	for _, state := range States {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+var stateConditions = map[string]string{
+	StateNotUploaded: `NOT uploaded`,
+	StatePending:     `NOT uploaded AND NOT dead_letter AND NOT skipped`,
+	StateFailed:      `NOT uploaded AND NOT dead_letter AND NOT skipped AND attempts > 0`,
+	StateDeadLetter:  `NOT uploaded AND dead_letter`,
+	StateSkipped:     `NOT uploaded AND skipped`,
+	StateUploaded:    `uploaded`,
+}
+
+const (
+	selectCustomerStatus = `SELECT id, crm_id, first_name, last_name, email, phone, uploaded, dead_letter, skipped, attempts, last_error, last_attempt_ts, created_ts, modified_ts FROM customers`
+	updateRequeue        = `UPDATE customers SET attempts = 0, last_error = NULL, dead_letter = false, skipped = false WHERE id = ANY($1) AND NOT uploaded;`
+	updateSkip           = `UPDATE customers SET skipped = true WHERE id = ANY($1) AND NOT uploaded;`
+	updateRequeueWhere   = `UPDATE customers SET attempts = 0, last_error = NULL, dead_letter = false, skipped = false`
+	deleteWhere          = `DELETE FROM customers`
+)
+
+// The most customers ListCustomers returns at once, and how many it returns if no limit is given.
+const (
+	MaxListLimit     = 1000
+	DefaultListLimit = 100
+)
+
+// ErrNotFound is returned when there is no customer with the id asked for.
+var ErrNotFound = errors.New("customer not found")
+
+// AdminDB is used to inspect and steer uploads.
+type AdminDB interface {
+	CountCustomers(context.Context) (map[string]int64, error)
+	ListCustomers(context.Context, CustomerFilter) ([]CustomerStatus, error)
+	GetCustomer(context.Context, int64) (*CustomerStatus, error)
+	GetCustomerByCRMID(context.Context, string) (*CustomerStatus, error)
+	Requeue(context.Context, ...int64) (int64, error)
+	Skip(context.Context, ...int64) (int64, error)
+	CountMatching(context.Context, CustomerFilter) (int64, error)
+	RequeueMatching(context.Context, CustomerFilter) (int64, error)
+	Purge(context.Context, CustomerFilter) (int64, error)
+	UploadAttempts(context.Context, int64) ([]UploadAttempt, error)
+}
+
+// CustomerFilter selects customers to list. Empty fields match every customer. Customers are listed in id order, a
+// page at a time, starting after the After id.
+type CustomerFilter struct {
+	State string
+	Email string
+	CRMID string
+	// Error matches customers whose last upload failed with an error containing it.
+	Error string
+	// MinID and MaxID limit the customers to a range of ids, inclusive, when they aren't 0.
+	MinID int64
+	MaxID int64
+	After int64
+	Limit int
+}
+
+// CustomerStatus is a customer along with how its upload is going.
+type CustomerStatus struct {
+	Id          int64      `json:"id"`
+	CRMID       string     `json:"crm_id,omitempty"`
+	FirstName   string     `json:"first_name"`
+	LastName    string     `json:"last_name"`
+	Email       string     `json:"email"`
+	Phone       string     `json:"phone"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt_ts,omitempty"`
+	Created     time.Time  `json:"created_ts"`
+	Modified    time.Time  `json:"modified_ts"`
+}
+
+// CountCustomers returns the number of customers in each state.
+func (db *DB) CountCustomers(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := bound(ctx, db.timeouts.Select)
+	defer cancel()
+	start := time.Now()
+
+	columns := make([]string, len(States))
+	for i, state := range States {
+		columns[i] = fmt.Sprintf("COUNT(*) FILTER (WHERE %s)", stateConditions[state])
+	}
+	counts := make([]int64, len(States))
+	dest := make([]interface{}, len(States))
+	for i := range counts {
+		dest[i] = &counts[i]
+	}
+
+	err := db.QueryRowContext(ctx, `SELECT `+strings.Join(columns, ", ")+` FROM customers;`).Scan(dest...)
+	if err != nil {
+		return nil, db.observe("select", start, fmt.Errorf("while counting customers: %s", err))
+	}
+
+	byState := make(map[string]int64, len(States))
+	for i, state := range States {
+		byState[state] = counts[i]
+	}
+	return byState, db.observe("select", start, nil)
+}
+
+// ListCustomers returns a page of the customers matching the filter.
+func (db *DB) ListCustomers(ctx context.Context, f CustomerFilter) ([]CustomerStatus, error) {
+	ctx, cancel := bound(ctx, db.timeouts.Select)
+	defer cancel()
+	start := time.Now()
+	query, args, err := f.query()
+	if err != nil {
+		return nil, err
+	}
+	list, err := db.queryStatus(ctx, query, args...)
+	return list, db.observe("select", start, err)
+}
+
+// GetCustomer returns a single customer, or ErrNotFound.
+func (db *DB) GetCustomer(ctx context.Context, id int64) (*CustomerStatus, error) {
+	return db.getCustomer(ctx, `id`, id)
+}
+
+// GetCustomerByCRMID returns the customer the CRM knows by crmID, or ErrNotFound.
+func (db *DB) GetCustomerByCRMID(ctx context.Context, crmID string) (*CustomerStatus, error) {
+	return db.getCustomer(ctx, `crm_id`, crmID)
+}
+
+func (db *DB) getCustomer(ctx context.Context, column string, id interface{}) (*CustomerStatus, error) {
+	ctx, cancel := bound(ctx, db.timeouts.Select)
+	defer cancel()
+	start := time.Now()
+	list, err := db.queryStatus(ctx, selectCustomerStatus+` WHERE `+column+` = $1;`, id)
+	if err = db.observe("select", start, err); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrNotFound
+	}
+	return &list[0], nil
+}
+
+// Requeue clears the failures of customers that haven't been uploaded, and takes them out of the dead letters and
+// skipped customers, so they are uploaded again. It returns how many customers were requeued.
+func (db *DB) Requeue(ctx context.Context, ids ...int64) (int64, error) {
+	return db.updateIDs(ctx, "requeue", updateRequeue, ids)
+}
+
+// Skip stops customers that haven't been uploaded from being uploaded, until they are requeued. It returns how many
+// customers were skipped.
+func (db *DB) Skip(ctx context.Context, ids ...int64) (int64, error) {
+	return db.updateIDs(ctx, "skip", updateSkip, ids)
+}
+
+// CountMatching counts the customers matching the filter, ignoring After and Limit, so the effect of
+// RequeueMatching or Purge can be seen before it is done.
+func (db *DB) CountMatching(ctx context.Context, f CustomerFilter) (int64, error) {
+	ctx, cancel := bound(ctx, db.timeouts.Select)
+	defer cancel()
+	start := time.Now()
+	f.After = 0
+	where, args, err := f.where()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM customers`+where+`;`, args...).Scan(&n); err != nil {
+		return 0, db.observe("select", start, fmt.Errorf("while counting customers: %s", err))
+	}
+	return n, db.observe("select", start, nil)
+}
+
+// RequeueMatching is Requeue for the customers matching the filter. Customers that have been uploaded are never
+// requeued, so a filter that could match them should be narrowed with StateNotUploaded to count them first.
+func (db *DB) RequeueMatching(ctx context.Context, f CustomerFilter) (int64, error) {
+	f.After = 0
+	where, args, err := f.where()
+	if err != nil {
+		return 0, err
+	}
+	if where == "" {
+		where = " WHERE NOT uploaded"
+	} else {
+		where += " AND NOT uploaded"
+	}
+	return db.exec(ctx, "requeue", updateRequeueWhere+where+";", args...)
+}
+
+// Purge deletes the customers matching the filter, every customer if it is empty.
+func (db *DB) Purge(ctx context.Context, f CustomerFilter) (int64, error) {
+	f.After = 0
+	where, args, err := f.where()
+	if err != nil {
+		return 0, err
+	}
+	return db.exec(ctx, "purge", deleteWhere+where+";", args...)
+}
+
+func (db *DB) updateIDs(ctx context.Context, what, query string, ids []int64) (int64, error) {
+	return db.exec(ctx, what, query, pq.Array(ids))
+}
+
+func (db *DB) exec(ctx context.Context, what, query string, args ...interface{}) (int64, error) {
+	ctx, cancel := bound(ctx, db.timeouts.Update)
+	defer cancel()
+	start := time.Now()
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, db.observe("update", start, fmt.Errorf("while updating customers to %s: %s", what, err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, db.observe("update", start, fmt.Errorf("while counting customers to %s: %s", what, err))
+	}
+	return n, db.observe("update", start, nil)
+}
+
+func (db *DB) queryStatus(ctx context.Context, query string, args ...interface{}) ([]CustomerStatus, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("while selecting rows: %s", err)
+	}
+	defer rows.Close()
+
+	var list []CustomerStatus
+	for rows.Next() {
+		var (
+			c                              CustomerStatus
+			uploaded, deadLetter, skipped  bool
+			firstName, lastName, phone     sql.NullString
+			crmID, lastError               sql.NullString
+			lastAttempt, created, modified pq.NullTime
+		)
+		err := rows.Scan(&c.Id, &crmID, &firstName, &lastName, &c.Email, &phone, &uploaded, &deadLetter, &skipped,
+			&c.Attempts, &lastError, &lastAttempt, &created, &modified)
+		if err != nil {
+			return nil, fmt.Errorf("while scanning rows: %s", err)
+		}
+
+		c.FirstName, c.LastName, c.Phone, c.LastError = firstName.String, lastName.String, phone.String, lastError.String
+		c.CRMID = crmID.String
+		c.Created, c.Modified = created.Time, modified.Time
+		if lastAttempt.Valid {
+			c.LastAttempt = &lastAttempt.Time
+		}
+		c.State = state(uploaded, deadLetter, skipped, c.Attempts)
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("while selecting rows: %s", err)
+	}
+	return list, nil
+}
+
+// state matches stateConditions.
+func state(uploaded, deadLetter, skipped bool, attempts int) string {
+	switch {
+	case uploaded:
+		return StateUploaded
+	case deadLetter:
+		return StateDeadLetter
+	case skipped:
+		return StateSkipped
+	case attempts > 0:
+		return StateFailed
+	}
+	return StatePending
+}
+
+// where builds the conditions for the filter, numbering its arguments from 1. It is empty when the filter matches
+// every customer.
+func (f CustomerFilter) where() (string, []interface{}, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.State != "" {
+		condition, ok := stateConditions[f.State]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown state %q", f.State)
+		}
+		conditions = append(conditions, condition)
+	}
+	if f.Email != "" {
+		conditions = append(conditions, "email = "+arg(f.Email))
+	}
+	if f.CRMID != "" {
+		conditions = append(conditions, "crm_id = "+arg(f.CRMID))
+	}
+	if f.Error != "" {
+		conditions = append(conditions, "last_error ILIKE '%' || "+arg(f.Error)+" || '%'")
+	}
+	if f.MinID > 0 {
+		conditions = append(conditions, "id >= "+arg(f.MinID))
+	}
+	if f.MaxID > 0 {
+		conditions = append(conditions, "id <= "+arg(f.MaxID))
+	}
+	if f.After > 0 {
+		conditions = append(conditions, "id > "+arg(f.After))
+	}
+
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// query builds the select for a page of the filter.
+func (f CustomerFilter) query() (string, []interface{}, error) {
+	where, args, err := f.where()
+	if err != nil {
+		return "", nil, err
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	args = append(args, limit)
+	return selectCustomerStatus + where + " ORDER BY id LIMIT $" + strconv.Itoa(len(args)) + ";", args, nil
+}
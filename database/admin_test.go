@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+var _ = Describe("Admin", func() {
+	var (
+		db      *DB
+		columns = []string{"id", "crm_id", "first_name", "last_name", "email", "phone", "uploaded", "dead_letter", "skipped",
+			"attempts", "last_error", "last_attempt_ts", "created_ts", "modified_ts"}
+		created = time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	BeforeEach(func() {
+		dbMock, mockDB, err = sqlmock.New()
+		db = &DB{DB: dbMock, log: logging.Nop()}
+	})
+
+	Context("KnownState", func() {
+		It("should know every state a customer can be in", func() {
+			for _, state := range States {
+				Expect(KnownState(state)).To(BeTrue())
+			}
+			Expect(KnownState(StateNotUploaded)).To(BeFalse())
+			Expect(KnownState("lost")).To(BeFalse())
+		})
+	})
+
+	Context("CustomerFilter", func() {
+		It("should select everything by default", func() {
+			query, args, err := CustomerFilter{}.query()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(query).To(Equal(selectCustomerStatus + " ORDER BY id LIMIT $1;"))
+			Expect(args).To(Equal([]interface{}{DefaultListLimit}))
+		})
+
+		It("should filter by the CRM's id", func() {
+			query, args, err := CustomerFilter{CRMID: "crm-1"}.query()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(query).To(Equal(selectCustomerStatus + " WHERE crm_id = $1 ORDER BY id LIMIT $2;"))
+			Expect(args).To(Equal([]interface{}{"crm-1", DefaultListLimit}))
+		})
+
+		It("should combine the filters", func() {
+			query, args, err := CustomerFilter{State: StateFailed, Error: "503", After: 10, Limit: 5000}.query()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(query).To(Equal(selectCustomerStatus + " WHERE " + stateConditions[StateFailed] +
+				" AND last_error ILIKE '%' || $1 || '%' AND id > $2 ORDER BY id LIMIT $3;"))
+			Expect(args).To(Equal([]interface{}{"503", int64(10), MaxListLimit}))
+		})
+
+		It("should reject an unknown state", func() {
+			_, _, err := CustomerFilter{State: "lost"}.query()
+			Expect(err).To(MatchError(`unknown state "lost"`))
+		})
+	})
+
+	Context(".ListCustomers", func() {
+		BeforeEach(func() {
+			rows := sqlmock.NewRows(columns).
+				AddRow(1, nil, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234", false, true, false, 10, "503", created, created, created).
+				AddRow(2, "crm-2", "jane", nil, "jane.doe@mail.com", nil, false, false, false, 0, nil, nil, created, created)
+			mockDB.ExpectQuery("SELECT id, crm_id, first_name").WithArgs("jon.doe@mail.com", DefaultListLimit).WillReturnRows(rows)
+		})
+
+		It("should return the customers with their state", func() {
+			list, err := db.ListCustomers(context.Background(), CustomerFilter{Email: "jon.doe@mail.com"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(Equal([]CustomerStatus{
+				{Id: 1, FirstName: "jon", LastName: "doe", Email: "jon.doe@mail.com", Phone: "+1 212 555 1234",
+					State: StateDeadLetter, Attempts: 10, LastError: "503", LastAttempt: &created, Created: created, Modified: created},
+				{Id: 2, CRMID: "crm-2", FirstName: "jane", Email: "jane.doe@mail.com", State: StatePending, Created: created, Modified: created},
+			}))
+		})
+	})
+
+	Context(".GetCustomer", func() {
+		It("should return ErrNotFound for an unknown customer", func() {
+			mockDB.ExpectQuery("SELECT id, crm_id, first_name").WithArgs(3).WillReturnRows(sqlmock.NewRows(columns))
+			_, err := db.GetCustomer(context.Background(), 3)
+			Expect(err).To(Equal(ErrNotFound))
+		})
+	})
+
+	Context(".GetCustomerByCRMID", func() {
+		It("should look the customer up by the CRM's id", func() {
+			rows := sqlmock.NewRows(columns).
+				AddRow(4, "crm-4", "jim", nil, "jim@mail.com", nil, true, false, false, 1, nil, created, created, created)
+			mockDB.ExpectQuery("SELECT id, crm_id, .* WHERE crm_id = \\$1;").WithArgs("crm-4").WillReturnRows(rows)
+			c, err := db.GetCustomerByCRMID(context.Background(), "crm-4")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Id).To(Equal(int64(4)))
+			Expect(c.State).To(Equal(StateUploaded))
+		})
+	})
+
+	Context(".CountCustomers", func() {
+		It("should count each state", func() {
+			mockDB.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows(States).AddRow(5, 2, 1, 0, 9))
+			counts, err := db.CountCustomers(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(counts).To(Equal(map[string]int64{StatePending: 5, StateFailed: 2, StateDeadLetter: 1, StateSkipped: 0, StateUploaded: 9}))
+		})
+
+		It("should not count once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := db.CountCustomers(ctx)
+			Expect(err).To(MatchError(fmt.Sprintf("while counting customers: %s", context.Canceled)))
+		})
+	})
+
+	Context(".Requeue", func() {
+		It("should requeue customers that haven't been uploaded", func() {
+			mockDB.ExpectExec("UPDATE customers SET attempts = 0").WithArgs(pq.Array([]int64{1, 2})).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			n, err := db.Requeue(context.Background(), 1, 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(int64(1)))
+		})
+
+		It("should report errors", func() {
+			mockDB.ExpectExec("UPDATE customers").WillReturnError(errTest)
+			_, err := db.Requeue(context.Background(), 1)
+			Expect(err).To(MatchError(fmt.Sprintf("while updating customers to requeue: %s", errTest)))
+		})
+	})
+
+	Context(".CountMatching", func() {
+		It("should count the customers in the range, ignoring the page", func() {
+			mockDB.ExpectQuery(`SELECT COUNT\(\*\) FROM customers WHERE NOT uploaded AND id >= \$1 AND id <= \$2;`).
+				WithArgs(int64(10), int64(20)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+			f := CustomerFilter{State: StateNotUploaded, MinID: 10, MaxID: 20, After: 15}
+			n, err := db.CountMatching(context.Background(), f)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(int64(7)))
+		})
+	})
+
+	Context(".RequeueMatching", func() {
+		It("should only requeue customers that haven't been uploaded", func() {
+			mockDB.ExpectExec(`UPDATE customers SET attempts = 0, .* WHERE last_error ILIKE .* AND NOT uploaded;`).
+				WithArgs("503").WillReturnResult(sqlmock.NewResult(0, 3))
+			n, err := db.RequeueMatching(context.Background(), CustomerFilter{Error: "503"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(int64(3)))
+		})
+
+		It("should requeue every customer that hasn't been uploaded without a filter", func() {
+			mockDB.ExpectExec(`UPDATE customers SET .* WHERE NOT uploaded;`).WillReturnResult(sqlmock.NewResult(0, 4))
+			n, err := db.RequeueMatching(context.Background(), CustomerFilter{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(int64(4)))
+		})
+	})
+
+	Context(".Purge", func() {
+		It("should delete the customers matching the filter", func() {
+			mockDB.ExpectExec(`DELETE FROM customers WHERE ` + stateConditions[StateDeadLetter] + `;`).
+				WillReturnResult(sqlmock.NewResult(0, 2))
+			n, err := db.Purge(context.Background(), CustomerFilter{State: StateDeadLetter})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(int64(2)))
+		})
+
+		It("should reject an unknown state before deleting anything", func() {
+			_, err := db.Purge(context.Background(), CustomerFilter{State: "lost"})
+			Expect(err).To(MatchError(`unknown state "lost"`))
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context(".Migrate", func() {
+		It("should run every migration in one transaction", func() {
+			mockDB.ExpectBegin()
+			for range migrations {
+				mockDB.ExpectExec("(ALTER TABLE customers ADD COLUMN|CREATE TABLE|CREATE INDEX) IF NOT EXISTS").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			mockDB.ExpectCommit()
+			Expect(db.Migrate(context.Background())).To(Succeed())
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should roll back a failed migration", func() {
+			mockDB.ExpectBegin()
+			mockDB.ExpectExec("ALTER TABLE").WillReturnError(errTest)
+			mockDB.ExpectRollback()
+			Expect(db.Migrate(context.Background())).To(MatchError(HavePrefix("while migrating")))
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+const (
+	insertUploadAttempt  = `INSERT INTO upload_attempts (customer_id, requested_ts, duration_ns, status, error, response, crm_id, worker_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	selectUploadAttempts = `SELECT id, customer_id, requested_ts, duration_ns, status, error, response, crm_id, worker_id FROM upload_attempts WHERE customer_id = $1 ORDER BY requested_ts, id;`
+)
+
+// UploadAttempt is the record of one post of a customer to the CRM.
+type UploadAttempt struct {
+	ID         int64         `json:"id"`
+	CustomerID int64         `json:"customer_id"`
+	Requested  time.Time     `json:"requested_ts"`
+	Duration   time.Duration `json:"duration_ns"`
+	// Status is the HTTP status the CRM answered with, 0 if it didn't answer.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Response is the start of the body the CRM answered with.
+	Response string `json:"response,omitempty"`
+	// CRMID is the id the CRM gave the customer, if it accepted it.
+	CRMID    string `json:"crm_id,omitempty"`
+	WorkerID string `json:"worker_id"`
+}
+
+// RecordAttempt adds an attempt to upload a customer to the history of the customer with the attempt's CustomerID.
+func (db *DB) RecordAttempt(ctx context.Context, a UploadAttempt) error {
+	ctx, cancel := bound(ctx, db.timeouts.Insert)
+	defer cancel()
+	start := time.Now()
+	_, err := db.ExecContext(ctx, insertUploadAttempt, a.CustomerID, a.Requested, int64(a.Duration), nullInt(a.Status),
+		nullString(a.Error), nullString(a.Response), nullString(a.CRMID), a.WorkerID)
+	if err != nil {
+		err = fmt.Errorf("while recording upload attempt: %s", err)
+	}
+	return db.observe("insert", start, err, logging.F(logging.CustomerID, a.CustomerID))
+}
+
+// UploadAttempts returns every attempt to upload the customer, oldest first.
+func (db *DB) UploadAttempts(ctx context.Context, customerID int64) ([]UploadAttempt, error) {
+	ctx, cancel := bound(ctx, db.timeouts.Select)
+	defer cancel()
+	start := time.Now()
+	attempts, err := db.queryAttempts(ctx, customerID)
+	return attempts, db.observe("select", start, err, logging.F(logging.CustomerID, customerID))
+}
+
+func (db *DB) queryAttempts(ctx context.Context, customerID int64) ([]UploadAttempt, error) {
+	rows, err := db.QueryContext(ctx, selectUploadAttempts, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("while selecting upload attempts: %s", err)
+	}
+	defer rows.Close()
+
+	var attempts []UploadAttempt
+	for rows.Next() {
+		var (
+			a                          UploadAttempt
+			duration                   int64
+			status                     sql.NullInt64
+			errorText, response, crmID sql.NullString
+		)
+		err := rows.Scan(&a.ID, &a.CustomerID, &a.Requested, &duration, &status, &errorText, &response, &crmID, &a.WorkerID)
+		if err != nil {
+			return nil, fmt.Errorf("while scanning upload attempts: %s", err)
+		}
+		a.Duration, a.Status = time.Duration(duration), int(status.Int64)
+		a.Error, a.Response, a.CRMID = errorText.String, response.String, crmID.String
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("while selecting upload attempts: %s", err)
+	}
+	return attempts, nil
+}
+
+// nullString stores an empty string as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullInt stores 0 as NULL.
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+var _ = Describe("Upload attempts", func() {
+	var (
+		db        *DB
+		requested = time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+		columns   = []string{"id", "customer_id", "requested_ts", "duration_ns", "status", "error", "response", "crm_id", "worker_id"}
+	)
+
+	BeforeEach(func() {
+		dbMock, mockDB, err = sqlmock.New()
+		db = &DB{DB: dbMock, log: logging.Nop()}
+	})
+
+	Context(".RecordAttempt", func() {
+		It("should record the attempt against the customer", func() {
+			mockDB.ExpectExec("INSERT INTO upload_attempts").
+				WithArgs(int64(1), requested, int64(250*time.Millisecond), sql.NullInt64{},
+					sql.NullString{String: "no answer", Valid: true}, sql.NullString{}, sql.NullString{}, "crm-1").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			err := db.RecordAttempt(context.Background(), UploadAttempt{CustomerID: 1, Requested: requested, Duration: 250 * time.Millisecond,
+				Error: "no answer", WorkerID: "crm-1"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should report errors", func() {
+			mockDB.ExpectExec("INSERT INTO upload_attempts").WillReturnError(errTest)
+			Expect(db.RecordAttempt(context.Background(), UploadAttempt{CustomerID: 1})).To(MatchError(fmt.Sprintf("while recording upload attempt: %s", errTest)))
+		})
+	})
+
+	Context(".UploadAttempts", func() {
+		It("should return the customer's attempts", func() {
+			rows := sqlmock.NewRows(columns).
+				AddRow(1, 1, requested, int64(time.Second), 503, "post to CRM failed", nil, nil, "crm-1").
+				AddRow(2, 1, requested.Add(time.Minute), int64(time.Millisecond), 201, nil, `{"id":"abc"}`, "abc", "crm-1")
+			mockDB.ExpectQuery("SELECT id, customer_id").WithArgs(1).WillReturnRows(rows)
+
+			attempts, err := db.UploadAttempts(context.Background(), 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attempts).To(Equal([]UploadAttempt{
+				{ID: 1, CustomerID: 1, Requested: requested, Duration: time.Second, Status: 503, Error: "post to CRM failed", WorkerID: "crm-1"},
+				{ID: 2, CustomerID: 1, Requested: requested.Add(time.Minute), Duration: time.Millisecond, Status: 201,
+					Response: `{"id":"abc"}`, CRMID: "abc", WorkerID: "crm-1"},
+			}))
+		})
+
+		It("should report errors", func() {
+			mockDB.ExpectQuery("SELECT id, customer_id").WillReturnError(errTest)
+			_, err := db.UploadAttempts(context.Background(), 1)
+			Expect(err).To(MatchError(fmt.Sprintf("while selecting upload attempts: %s", errTest)))
+		})
+	})
+})
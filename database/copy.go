@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Copied customers go into a staging table, dropped with the transaction, and are merged into customers from there.
+// Only a customer the staging table can't hold, an id out of range say, fails the whole set.
+const (
+	createStaging = `CREATE TEMPORARY TABLE customers_staging (seq INTEGER NOT NULL, id INTEGER, first_name TEXT, last_name TEXT, email TEXT, phone TEXT) ON COMMIT DROP;`
+	mergeStaging  = `WITH staged AS (SELECT seq, id, first_name, last_name, email, phone FROM customers_staging), ` + mergeStaged
+)
+
+// CopyCustomers bulk loads the customers with COPY, for imports too large to insert a set at a time, in a single
+// transaction. Customers that conflict are left out and returned rather than failing the rest, which are inserted
+// and notified as InsertCustomers does. Copying no customers does nothing.
+func (db *DB) CopyCustomers(ctx context.Context, customers ...*Customer) ([]Conflict, error) {
+	if len(customers) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := bound(ctx, db.timeouts.Insert)
+	defer cancel()
+	start := time.Now()
+	conflicts, err := db.copyTx(ctx, customers)
+	return conflicts, db.observe("copy", start, err)
+}
+
+func (db *DB) copyTx(ctx context.Context, customers Customers) (conflicts []Conflict, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("while creating transaction: %s", err)
+	}
+
+	// If returning an error Rollback the transaction, otherwise Commit it.
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+		if err != nil {
+			conflicts = nil
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, createStaging); err != nil {
+		return nil, fmt.Errorf("while creating staging table: %s", err)
+	}
+	if err = copyIn(ctx, tx, customers); err != nil {
+		return nil, err
+	}
+	return db.merge(ctx, tx, customers, mergeStaging)
+}
+
+// copyIn copies the customers into the staging table, numbered in the order they are given.
+func copyIn(ctx context.Context, tx *sql.Tx, customers Customers) error {
+	copyCustomers := pq.CopyIn("customers_staging", "seq", "id", "first_name", "last_name", "email", "phone")
+	stmt, err := tx.PrepareContext(ctx, copyCustomers)
+	if err != nil {
+		return fmt.Errorf("while starting copy: %s", err)
+	}
+	defer stmt.Close()
+
+	for i, c := range customers {
+		if _, err := stmt.ExecContext(ctx, i, c.Id, c.FirstName, c.LastName, c.Email, c.Phone); err != nil {
+			return fmt.Errorf("while copying customer %d: %s", c.Id, err)
+		}
+	}
+	// An Exec with no arguments sends whatever is still buffered and ends the copy.
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("while copying customers: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+var _ = Describe("Copy", func() {
+	var (
+		db        *DB
+		customers Customers
+	)
+
+	BeforeEach(func() {
+		dbMock, mockDB, err = sqlmock.New()
+		db = &DB{DB: dbMock, log: logging.Nop()}
+		customers = NewCustomers(NewCustomer(1, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234"),
+			NewCustomer(2, "jane", "doe", "jane.doe@mail.com", "+1 212 555 4321"),
+			NewCustomer(3, "jon", "doe", "jon.doe@mail.com", ""))
+	})
+
+	expectCopy := func() {
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec("CREATE TEMPORARY TABLE customers_staging").WillReturnResult(sqlmock.NewResult(0, 0))
+		copyIn := mockDB.ExpectPrepare("COPY \"customers_staging\"")
+		for i, c := range customers {
+			copyIn.ExpectExec().WithArgs(i, c.Id, c.FirstName, c.LastName, c.Email, c.Phone).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		copyIn.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	Context(".CopyCustomers", func() {
+		It("should insert the customers and return those that conflict", func() {
+			expectCopy()
+			mockDB.ExpectQuery("WITH staged AS \\(SELECT seq, .* FROM customers_staging\\)").
+				WillReturnRows(sqlmock.NewRows([]string{"seq", "constraint"}).AddRow(2, ConstraintEmail))
+			mockDB.ExpectCommit()
+
+			conflicts, err := db.CopyCustomers(context.Background(), customers...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflicts).To(Equal([]Conflict{{Customer: customers[2], Constraint: ConstraintEmail}}))
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should notify of the customers inserted", func() {
+			db.NotifyOn(NotifyChannel)
+			expectCopy()
+			mockDB.ExpectQuery("WITH staged AS").
+				WillReturnRows(sqlmock.NewRows([]string{"seq", "constraint"}).AddRow(2, ConstraintEmail))
+			mockDB.ExpectExec("SELECT pg_notify").WithArgs(NotifyChannel, `{"first_id":1,"last_id":2,"count":2}`).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mockDB.ExpectCommit()
+
+			_, err := db.CopyCustomers(context.Background(), customers...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should roll back a failed copy", func() {
+			mockDB.ExpectBegin()
+			mockDB.ExpectExec("CREATE TEMPORARY TABLE customers_staging").WillReturnResult(sqlmock.NewResult(0, 0))
+			mockDB.ExpectPrepare("COPY").ExpectExec().WillReturnError(errTest)
+			mockDB.ExpectRollback()
+
+			conflicts, err := db.CopyCustomers(context.Background(), customers...)
+			Expect(err).To(MatchError(fmt.Sprintf("while copying customer 1: %s", errTest)))
+			Expect(conflicts).To(BeNil())
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should roll back a failed merge", func() {
+			expectCopy()
+			mockDB.ExpectQuery("WITH staged AS").WillReturnError(errTest)
+			mockDB.ExpectRollback()
+
+			_, err := db.CopyCustomers(context.Background(), customers...)
+			Expect(err).To(MatchError(fmt.Sprintf("while inserting customers: %s", errTest)))
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should do nothing without customers", func() {
+			conflicts, err := db.CopyCustomers(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflicts).To(BeEmpty())
+			Expect(mockDB.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+})
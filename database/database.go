@@ -3,6 +3,7 @@ package database
 //go:generate mockgen -source=database.go -destination=mock/database_mock.go -package=mock_database
 
 import (
+    "context"
     "database/sql"
     "encoding/json"
     "fmt"
@@ -10,26 +11,93 @@ import (
 
     // This external lib is required for postgres.
     _ "github.com/lib/pq"
+
+    "github.com/dbyington/csv-crm-upload/logging"
+    "github.com/dbyington/csv-crm-upload/signal"
+)
+
+// The inserts name their columns so those the CSV doesn't supply get their defaults rather than nulls.
+const (
+	insertCustomerSet        = `WITH staged AS (SELECT ordinality - 1 AS seq, id, first_name, last_name, email, phone FROM JSON_POPULATE_RECORDSET(null::customers, $1::json) WITH ORDINALITY), ` + mergeStaged
+	selectUploadedFalseAfter = `SELECT id, first_name, last_name, email, phone FROM customers WHERE uploaded = false AND NOT dead_letter AND NOT skipped AND id > $1::bigint AND id <= $2::bigint ORDER BY id LIMIT $3;`
+	updateUploaded           = `UPDATE customers SET uploaded = true, crm_id = COALESCE($2, crm_id), attempts = attempts + 1, last_error = NULL, last_attempt_ts = NOW() WHERE email = $1;`
+	updateFailed             = `UPDATE customers SET attempts = attempts + 1, last_error = $2, last_attempt_ts = NOW(), dead_letter = $3 OR attempts + 1 >= $4 WHERE email = $1;`
+	notifyInserted           = `SELECT pg_notify($1, $2);`
 )
 
+// mergeStaged follows a staged CTE of customers numbered by seq. It inserts them, leaving out any that conflict with a
+// customer already stored or one before it, and selects those left out, in order, with the constraint they clashed on.
+// The select sees customers as they were before the insert, so a customer left out that clashes with none of them
+// clashed with one inserted from the set.
+const mergeStaged = `inserted AS (
+	INSERT INTO customers (id, first_name, last_name, email, phone)
+	SELECT id, first_name, last_name, email, phone FROM staged ORDER BY seq
+	ON CONFLICT DO NOTHING
+	RETURNING id, email)
+SELECT s.seq, CASE
+	WHEN EXISTS (SELECT 1 FROM customers c WHERE c.id = s.id) THEN '` + ConstraintID + `'
+	WHEN EXISTS (SELECT 1 FROM customers c WHERE c.email = s.email) THEN '` + ConstraintEmail + `'
+	WHEN EXISTS (SELECT 1 FROM inserted i WHERE i.id = s.id) THEN '` + ConstraintID + `'
+	ELSE '` + ConstraintEmail + `' END
+FROM staged s
+WHERE NOT EXISTS (SELECT 1 FROM inserted i WHERE i.id = s.id AND i.email = s.email)
+	OR EXISTS (SELECT 1 FROM staged e WHERE e.seq < s.seq AND e.id = s.id AND e.email = s.email)
+ORDER BY s.seq;`
+
+// The names Postgres gives the UNIQUE constraints on the customers table, which a customer conflicts on.
 const (
-	insertCustomer      = `INSERT INTO customers SELECT * FROM JSON_POPULATE_RECORD(null::customers, $1::json);`
-	insertCustomerSet   = `INSERT INTO customers SELECT * FROM JSON_POPULATE_RECORDSET(null::customers, $1::json);`
-	selectUploadedFalse = `SELECT id, first_name, last_name, email, phone FROM customers WHERE uploaded = false;`
-	updateUploaded      = `UPDATE customers SET uploaded = true WHERE email = $1;`
+	ConstraintID    = "customers_id_key"
+	ConstraintEmail = "customers_email_key"
 )
 
-type cdb struct {
+// DefaultMaxAttempts is how many times a customer is tried before it is dead-lettered, unless SetMaxAttempts is used.
+const DefaultMaxAttempts = 10
+
+// NotifyChannel is the Postgres channel inserts are announced on when notification is enabled with NotifyOn.
+const NotifyChannel = "customers_inserted"
+
+// DefaultTimeout bounds each kind of operation unless SetTimeouts is used.
+const DefaultTimeout = 30 * time.Second
+
+// Timeouts bound how long each kind of operation may take, on top of any deadline of the context it is given. A
+// timeout of 0 leaves the operation bounded by its context alone.
+type Timeouts struct {
+	Insert time.Duration
+	Select time.Duration
+	Update time.Duration
+}
+
+// DB is the customer database. It implements Store, for the reader and the uploader, and AdminDB.
+type DB struct {
 	*sql.DB
+	notify      string
+	maxAttempts int
+	timeouts    Timeouts
+	log         logging.Logger
 }
 
-type CustomerDB interface {
-	NewCustomer(int64, string, string, string, string) *customer
-	SelectCustomersForUpload() (*customers, error)
+// Store is what importing and uploading customers needs of the database. *DB implements it, and the mock package
+// generated from it stands in for it in tests.
+type Store interface {
+	// InsertCustomers inserts the customers in a single transaction, leaving out and returning those that conflict
+	// with a customer already stored or earlier in the set.
+	InsertCustomers(ctx context.Context, customers ...*Customer) ([]Conflict, error)
+	// SelectCustomersForUploadAfter returns a page of up to limit customers waiting to be uploaded, in id order, with
+	// ids after after and up to last, inclusive.
+	SelectCustomersForUploadAfter(ctx context.Context, after, last int64, limit int) (Customers, error)
+	// CopyCustomers bulk loads the customers in a single transaction, leaving out and returning those that conflict
+	// with a customer already stored or earlier in the set.
+	CopyCustomers(ctx context.Context, customers ...*Customer) ([]Conflict, error)
+	// MarkUploaded records the customer as uploaded, along with the id the CRM gave it, if it is known.
+	MarkUploaded(ctx context.Context, c *Customer, crmID string) error
+	// MarkUploadFailed records a failed upload of the customer.
+	MarkUploadFailed(ctx context.Context, c *Customer, reason string, permanent bool) error
+	// RecordAttempt adds an attempt to upload a customer to its history.
+	RecordAttempt(ctx context.Context, a UploadAttempt) error
 }
 
 // Customer describes a CRM customer
-type customer struct {
+type Customer struct {
 	Id        int64     `json:"id"`
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
@@ -38,100 +106,135 @@ type customer struct {
 	Up        bool      `json:"uploaded"`
 	Created   time.Time `json:"created_ts"`
 	Updated   time.Time `json:"updated_ts"`
-	db        *cdb      `json:"-"`
-}
-
-type Customer interface {
-	Insert() error
-	Uploaded() error
 }
 
-// customers is a slice of *Customer
-type customers []*customer
+// Customers is a set of customers, inserted or selected together.
+type Customers []*Customer
 
-type Customers interface {
-	Append(*customer)
-	Count() int
-	Insert() error
-	List() []*customer
+// Conflict is a customer that wasn't inserted because it has the id or email of a customer already stored, or of one
+// before it in the same set.
+type Conflict struct {
+	Customer *Customer
+	// Constraint is the constraint the customer clashed on, ConstraintID or ConstraintEmail.
+	Constraint string
 }
 
 // NewCustomerDB takes a sql.DB instance already opened to the correct db.
-func NewCustomerDB(d *sql.DB) *cdb {
-	return &cdb{d}
+func NewCustomerDB(d *sql.DB) *DB {
+	return &DB{
+		DB:          d,
+		maxAttempts: DefaultMaxAttempts,
+		timeouts:    Timeouts{Insert: DefaultTimeout, Select: DefaultTimeout, Update: DefaultTimeout},
+		log:         logging.Default(),
+	}
 }
 
-// NewCustomer returns a *Customer based on the supplied Customer type values.
-func (db *cdb) NewCustomer(id int64, firstName, lastName, email, phone string) *customer {
-	return &customer{
-		id,
-		firstName,
-		lastName,
-		email,
-		phone,
-		false,
-		time.Now(),
-		time.Now(),
-		db,
-	}
+// SetTimeouts sets how long inserts, selects and updates may each take before they are cancelled.
+func (db *DB) SetTimeouts(t Timeouts) {
+	db.timeouts = t
 }
 
-// NewCustomers creates a *customers object consisting of the optionally supplied *Customer objects.
-func NewCustomers(customerList ...*customer) *customers {
-	customers := &customers{}
-	for _, customer := range customerList {
-		*customers = append(*customers, customer)
+// bound returns ctx limited to the timeout d, if there is one.
+func bound(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, d)
+}
 
-	return customers
+// SetMaxAttempts sets how many failed uploads a customer is allowed before it is dead-lettered and no longer picked
+// up for upload.
+func (db *DB) SetMaxAttempts(n int) {
+	db.maxAttempts = n
 }
 
-// Insert performs the database insert of a single customer object.
-func (c *customer) Insert() error {
-	jsonBytes, err := json.Marshal(c)
-	if err != nil {
-		return fmt.Errorf("while marshaling customer: %s", err)
+// SetLogger replaces the default logger. Operations are logged at debug level, errors are returned to the caller to
+// report.
+func (db *DB) SetLogger(l logging.Logger) {
+	db.log = l.With(logging.F(logging.Component, "database"))
+}
+
+// NotifyOn makes every insert also NOTIFY the given channel from within the insert transaction, so a listener is only
+// told about customers once they have been committed.
+func (db *DB) NotifyOn(channel string) {
+	db.notify = channel
+}
+
+// NewCustomer returns a *Customer based on the supplied Customer type values.
+func NewCustomer(id int64, firstName, lastName, email, phone string) *Customer {
+	return &Customer{
+		Id:        id,
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     email,
+		Phone:     phone,
+		Created:   time.Now(),
+		Updated:   time.Now(),
 	}
+}
 
-	return c.db.insert(insertCustomer, string(jsonBytes))
+// NewCustomers creates a Customers set consisting of the optionally supplied *Customer objects.
+func NewCustomers(customerList ...*Customer) Customers {
+	return append(Customers{}, customerList...)
 }
 
-// Append adds the supplied *Customer to the *customers set.
-func (c *customers) Append(customer *customer) {
+// Append adds the supplied *Customer to the set.
+func (c *Customers) Append(customer *Customer) {
 	*c = append(*c, customer)
 }
 
-// Count returns the number of *Customer in the *customers set.
-func (c *customers) Count() int {
-	return len(*c)
+// Count returns the number of *Customer in the set.
+func (c Customers) Count() int {
+	return len(c)
 }
 
-func (c *customers) List() []*customer {
-	return *c
+// IDs returns the ids of the customers in the set.
+func (c Customers) IDs() []int64 {
+	ids := make([]int64, 0, len(c))
+	for _, customer := range c {
+		ids = append(ids, customer.Id)
+	}
+	return ids
 }
 
-// Insert performs the database insert with a set of customer objects
-func (c *customers) Insert() error {
-	// Extract the db from the first customer
-	var db *cdb
-	if customer := c.List()[0]; customer != nil {
-		db = customer.db
-	} else {
-		return fmt.Errorf("empty customer list")
+// Without returns the customers in the set other than those that conflicted.
+func (c Customers) Without(conflicts []Conflict) Customers {
+	left := make(map[*Customer]bool, len(conflicts))
+	for _, conflict := range conflicts {
+		left[conflict.Customer] = true
+	}
+	customers := NewCustomers()
+	for _, customer := range c {
+		if !left[customer] {
+			customers.Append(customer)
+		}
 	}
+	return customers
+}
 
-	jsonBytes, err := json.Marshal(c)
+// InsertCustomers inserts the customers in a single statement and transaction. Customers that conflict with one
+// already stored, or one earlier in the set, are left out and returned rather than failing the rest. Inserting no
+// customers does nothing.
+func (db *DB) InsertCustomers(ctx context.Context, customers ...*Customer) ([]Conflict, error) {
+	if len(customers) == 0 {
+		return nil, nil
+	}
+	jsonBytes, err := json.Marshal(customers)
 	if err != nil {
-		return fmt.Errorf("while marshaling customer: %s", err)
+		return nil, fmt.Errorf("while marshaling customers: %s", err)
 	}
 
-	return db.insert(insertCustomerSet, string(jsonBytes))
+	ctx, cancel := bound(ctx, db.timeouts.Insert)
+	defer cancel()
+	start := time.Now()
+	conflicts, err := db.insertTx(ctx, customers, string(jsonBytes))
+	return conflicts, db.observe("insert", start, err)
 }
 
-func (db *cdb) insert(query, arg string) error {
-	tx, err := db.Begin()
+func (db *DB) insertTx(ctx context.Context, customers Customers, arg string) (conflicts []Conflict, err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("while creating transaction: %s", err)
+		return nil, fmt.Errorf("while creating transaction: %s", err)
 	}
 
 	// If returning an error Rollback the transaction, otherwise Commit it.
@@ -140,41 +243,119 @@ func (db *cdb) insert(query, arg string) error {
 		case nil:
 			err = tx.Commit()
 		default:
-			err = tx.Rollback()
+			tx.Rollback()
+		}
+		if err != nil {
+			conflicts = nil
 		}
 	}()
 
-	_, err = tx.Exec(query, arg)
+	return db.merge(ctx, tx, customers, insertCustomerSet, arg)
+}
+
+// merge runs a query ending in mergeStaged, returning the customers it left out, and notifies the channel set with
+// NotifyOn of the rest.
+func (db *DB) merge(ctx context.Context, tx *sql.Tx, customers Customers, query string,
+	args ...interface{}) ([]Conflict, error) {
+	conflicts, err := queryConflicts(ctx, tx, customers, query, args...)
 	if err != nil {
-		return fmt.Errorf("executing query (%s): %s", query, err)
+		return nil, err
+	}
+	if db.notify != "" {
+		if inserted := customers.Without(conflicts); inserted.Count() > 0 {
+			if err := db.notifyTx(ctx, tx, signal.ForIDs(inserted.IDs()...)); err != nil {
+				return nil, err
+			}
+		}
 	}
+	return conflicts, nil
+}
 
+// queryConflicts runs the merge query, matching the customers it left out to the set by their position in it.
+func queryConflicts(ctx context.Context, tx *sql.Tx, customers Customers, query string,
+	args ...interface{}) ([]Conflict, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("while inserting customers: %s", err)
+	}
+	defer rows.Close()
+
+	var conflicts []Conflict
+	for rows.Next() {
+		var seq int
+		var constraint string
+		if err := rows.Scan(&seq, &constraint); err != nil {
+			return nil, fmt.Errorf("while scanning conflicts: %s", err)
+		}
+		if seq < 0 || seq >= len(customers) {
+			return nil, fmt.Errorf("while scanning conflicts: no customer %d in the set", seq)
+		}
+		conflicts = append(conflicts, Conflict{Customer: customers[seq], Constraint: constraint})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("while inserting customers: %s", err)
+	}
+	return conflicts, nil
+}
+
+// notifyTx notifies the channel set with NotifyOn of the inserted customers, once tx commits.
+func (db *DB) notifyTx(ctx context.Context, tx *sql.Tx, inserted signal.Payload) error {
+	payload, err := json.Marshal(inserted)
+	if err != nil {
+		return fmt.Errorf("while marshaling notification: %s", err)
+	}
+	if _, err := tx.ExecContext(ctx, notifyInserted, db.notify, string(payload)); err != nil {
+		return fmt.Errorf("while notifying %s: %s", db.notify, err)
+	}
 	return nil
 }
 
-// SelectCustomersForUpload returns a *customers struct suitable to be unmarshaled and uploaded to CRM.
-func (db *cdb) SelectCustomersForUpload() (*customers, error) {
-	customers := new(customers)
-	rows, err := db.Query(selectUploadedFalse)
+// SelectCustomersForUploadAfter returns a page of up to limit customers waiting to be uploaded to CRM, in id order,
+// with ids after after and up to last, inclusive. The customers waiting are paged through by passing the id of the
+// last customer of each page as after for the next, which reads each page straight from the index however many
+// customers there are. The bounds are compared as bigints, so they can be anything an int64 holds although ids are
+// integers.
+func (db *DB) SelectCustomersForUploadAfter(ctx context.Context, after, last int64, limit int) (Customers, error) {
+	ctx, cancel := bound(ctx, db.timeouts.Select)
+	defer cancel()
+	start := time.Now()
+	customers, err := db.queryCustomers(ctx, selectUploadedFalseAfter, after, last, limit)
+	return customers, db.observe("select", start, err)
+}
+
+func (db *DB) queryCustomers(ctx context.Context, query string, args ...interface{}) (Customers, error) {
+	customers := NewCustomers()
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("while selecting rows: %s", err)
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		c := new(customer)
+		c := new(Customer)
 		err := rows.Scan(&c.Id, &c.FirstName, &c.LastName, &c.Email, &c.Phone)
 		if err != nil {
 			return nil, fmt.Errorf("while scanning rows: %s", err)
 		}
-		*customers = append(*customers, db.NewCustomer(c.Id, c.FirstName, c.LastName, c.Email, c.Phone))
+		customers.Append(NewCustomer(c.Id, c.FirstName, c.LastName, c.Email, c.Phone))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("while selecting rows: %s", err)
 	}
 
 	return customers, nil
 }
 
-// Uploaded is used to set the status of a customer record in the database to "uploaded".
-func (c *customer) Uploaded() error {
-	tx, err := c.db.Begin()
+// MarkUploaded is used to set the status of a customer record in the database to "uploaded", along with the id the
+// CRM gave it, if it is known.
+func (db *DB) MarkUploaded(ctx context.Context, c *Customer, crmID string) error {
+	ctx, cancel := bound(ctx, db.timeouts.Update)
+	defer cancel()
+	return db.observe("update", time.Now(), db.markUploaded(ctx, c, crmID), logging.F(logging.CustomerID, c.Id))
+}
+
+func (db *DB) markUploaded(ctx context.Context, c *Customer, crmID string) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("while starting update: %s", err)
 	}
@@ -185,14 +366,27 @@ func (c *customer) Uploaded() error {
 		case nil:
 			err = tx.Commit()
 		default:
-			err = tx.Rollback()
+			tx.Rollback()
 		}
 	}()
 
-	_, err = tx.Exec(updateUploaded, string(c.Email))
+	_, err = tx.ExecContext(ctx, updateUploaded, c.Email, nullString(crmID))
 	if err != nil {
 		return fmt.Errorf("while updating: %s", err)
 	}
 
 	return nil
 }
+
+// MarkUploadFailed records a failed upload of the customer. A permanent failure, the CRM rejecting the customer say,
+// dead-letters it straight away, otherwise it is dead-lettered once it has used up its attempts.
+func (db *DB) MarkUploadFailed(ctx context.Context, c *Customer, reason string, permanent bool) error {
+	ctx, cancel := bound(ctx, db.timeouts.Update)
+	defer cancel()
+	start := time.Now()
+	_, err := db.ExecContext(ctx, updateFailed, c.Email, reason, permanent, db.maxAttempts)
+	if err != nil {
+		err = fmt.Errorf("while recording failed upload: %s", err)
+	}
+	return db.observe("update", start, err, logging.F(logging.CustomerID, c.Id))
+}
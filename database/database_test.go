@@ -1,35 +1,36 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
+
 	"github.com/DATA-DOG/go-sqlmock"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
 )
 
 const (
-	database            = `crm`
-	host                = `localhost`
-	goodCustomerJSON    = `{ "id": 1, "first_name": "jon", "last_name": "doe", "email": "jdoe@mail.com", "phone": "+1 212 555 1234"}`
-	goodCustomerSetJSON = `[ { "id": 1, "first_name": "jon", "last_name": "doe", "email": "jon.doe@mail.com", "phone": "+1 212 555 1234"},
-{ "id": 2, "first_name": "jane", "last_name": "doe", "email": "jane.doe@mail.com", "phone": "+1 212 555 4321"},
-{ "id": 3, "first_name": "steve", "last_name": "stevenson", "email": "steves@mail.com", "phone": "+1 503 555 5522"} ]`
+	database = `crm`
+	host     = `localhost`
 )
 
 var (
 	err     error
 	errTest = errors.New("test error")
 
-	customerDB *cdb
+	customerDB *DB
 	dbMock     *sql.DB
 	mockDB     sqlmock.Sqlmock
 )
 
 var _ = Describe("Database", func() {
 	var (
-		expectedCustomer1 = &customer{
+		expectedCustomer1 = &Customer{
 			Id:        1,
 			FirstName: "jon",
 			LastName:  "doe",
@@ -37,7 +38,7 @@ var _ = Describe("Database", func() {
 			Phone:     "+1 212 555 1234",
 			Up:        false,
 		}
-		expectedCustomer2 = &customer{
+		expectedCustomer2 = &Customer{
 			Id:        2,
 			FirstName: "jane",
 			LastName:  "doe",
@@ -49,17 +50,15 @@ var _ = Describe("Database", func() {
 
 	BeforeEach(func() {
 		dbMock, mockDB, err = sqlmock.New()
-		customerDB = &cdb{dbMock}
-		expectedCustomer1.db = customerDB
-		expectedCustomer2.db = customerDB
+		customerDB = &DB{DB: dbMock, log: logging.Nop()}
 	})
 
 	Context("NewCustomer", func() {
-		var testCustomer *customer
+		var testCustomer *Customer
 
 		Context("when called", func() {
 			BeforeEach(func() {
-				testCustomer = customerDB.NewCustomer(1, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234")
+				testCustomer = NewCustomer(1, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234")
 			})
 
 			It("should return a customer", func() {
@@ -72,8 +71,7 @@ var _ = Describe("Database", func() {
 	})
 
 	Context("NewCustomers", func() {
-		var testCustomers *customers
-		expectedCustomers := new(customers)
+		var testCustomers, expectedCustomers Customers
 
 		AfterEach(func() {
 			expectedCustomers = nil
@@ -81,7 +79,7 @@ var _ = Describe("Database", func() {
 
 		Context("when called with customers", func() {
 			BeforeEach(func() {
-				*expectedCustomers = append(*expectedCustomers, expectedCustomer1, expectedCustomer2)
+				expectedCustomers = Customers{expectedCustomer1, expectedCustomer2}
 				testCustomers = NewCustomers(expectedCustomer1, expectedCustomer2)
 			})
 
@@ -96,151 +94,171 @@ var _ = Describe("Database", func() {
 			})
 
 			It("should return an empty set of customers", func() {
-				Expect(testCustomers).To(BeEquivalentTo(&customers{}))
+				Expect(testCustomers).To(BeEquivalentTo(Customers{}))
 			})
 		})
 	})
 
-	Context("insert", func() {
+	Context("InsertCustomers", func() {
 		var (
-			expectedInsert = `INSERT INTO customers`
+			testCustomers Customers
+			conflicts     []Conflict
+			conflictRows  *sqlmock.Rows
 		)
 
+		const expectedInsert = `WITH staged AS \(SELECT ordinality - 1 AS seq, .* JSON_POPULATE_RECORDSET\(`
+
+		BeforeEach(func() {
+			testCustomers = NewCustomers(NewCustomer(1, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234"),
+				NewCustomer(2, "jane", "doe", "jane.doe@mail.com", "+1 212 555 4321"))
+			conflictRows = sqlmock.NewRows([]string{"seq", "constraint"})
+		})
+
 		Context("with a single good customer", func() {
 			BeforeEach(func() {
-
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec(expectedInsert).WillReturnResult(sqlmock.NewResult(1, 1))
+				mockDB.ExpectQuery(expectedInsert).WithArgs(sqlmock.AnyArg()).WillReturnRows(conflictRows)
 				mockDB.ExpectCommit()
-				err = customerDB.insert(insertCustomer, goodCustomerJSON)
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers[0])
 			})
 
 			It("should insert the customer", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(BeEmpty())
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
 			})
 		})
 
 		Context("with a good customer set", func() {
 			BeforeEach(func() {
-
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec(expectedInsert).WillReturnResult(sqlmock.NewResult(3, 3))
+				mockDB.ExpectQuery(expectedInsert).WithArgs(sqlmock.AnyArg()).WillReturnRows(conflictRows)
 				mockDB.ExpectCommit()
-				err = customerDB.insert(insertCustomerSet, goodCustomerSetJSON)
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers...)
 			})
 
-			It("should insert the customer", func() {
+			It("should insert the customers together", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(BeEmpty())
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
 			})
 		})
 
-		Context("with transaction begin failure", func() {
+		Context("with a customer that conflicts", func() {
 			BeforeEach(func() {
-
-				mockDB.ExpectBegin().WillReturnError(errTest)
-				err = customerDB.insert(insertCustomer, goodCustomerJSON)
+				mockDB.ExpectBegin()
+				mockDB.ExpectQuery(expectedInsert).WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(conflictRows.AddRow(1, ConstraintEmail))
+				mockDB.ExpectCommit()
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers...)
 			})
 
-			It("should fail to insert the customer", func() {
+			It("should insert the rest and return the one that conflicts", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(Equal([]Conflict{{Customer: testCustomers[1], Constraint: ConstraintEmail}}))
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
-				Expect(err).To(MatchError(fmt.Errorf("while creating transaction: %s", errTest)))
 			})
 		})
 
-		Context("with a bad customer json string", func() {
+		Context("with notification enabled", func() {
 			BeforeEach(func() {
+				customerDB.NotifyOn(NotifyChannel)
 
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec(expectedInsert).WillReturnError(errTest)
-				mockDB.ExpectRollback()
-				err = customerDB.insert(insertCustomer, "bad customer")
+				mockDB.ExpectQuery(expectedInsert).WillReturnRows(conflictRows.AddRow(1, ConstraintID))
+				mockDB.ExpectExec("SELECT pg_notify").
+					WithArgs(NotifyChannel, `{"first_id":1,"last_id":1,"count":1}`).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mockDB.ExpectCommit()
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers...)
 			})
 
-			It("should return an error", func() {
+			It("should notify of the customers inserted within the insert transaction", func() {
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
-				Expect(err).To(MatchError(fmt.Errorf("executing query (%s): %s", insertCustomer, errTest)))
+				Expect(err).ToNot(HaveOccurred())
 			})
 		})
-	})
 
-	Context("Customer.Insert", func() {
-		var (
-			expectedInsert = `INSERT INTO customers`
-			testCustomer   *customer
-			db             *cdb
-		)
+		Context("with a notification failure", func() {
+			BeforeEach(func() {
+				customerDB.NotifyOn(NotifyChannel)
 
-		BeforeEach(func() {
-			db = &cdb{dbMock}
-			testCustomer = &customer{
-				Id:        1,
-				FirstName: "jon",
-				LastName:  "doe",
-				Email:     "jon.doe@mail.com",
-				Phone:     "+1 212 555 1234",
-				db:        db,
-			}
-		})
+				mockDB.ExpectBegin()
+				mockDB.ExpectQuery(expectedInsert).WillReturnRows(conflictRows)
+				mockDB.ExpectExec("SELECT pg_notify").WillReturnError(errTest)
+				mockDB.ExpectRollback()
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers...)
+			})
 
-		AfterEach(func() {
-			db = nil
+			It("should roll back the insert", func() {
+				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
+				Expect(err).To(MatchError(fmt.Errorf("while notifying %s: %s", NotifyChannel, errTest)))
+			})
 		})
 
-		Context("with a single good customer", func() {
+		Context("with transaction begin failure", func() {
 			BeforeEach(func() {
-				mockDB.ExpectBegin()
-				mockDB.ExpectExec(expectedInsert).WillReturnResult(sqlmock.NewResult(1, 1))
-				mockDB.ExpectCommit()
-				err = testCustomer.Insert()
+				mockDB.ExpectBegin().WillReturnError(errTest)
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers...)
 			})
 
-			It("should insert the customer", func() {
+			It("should fail to insert the customers", func() {
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
+				Expect(err).To(MatchError(fmt.Errorf("while creating transaction: %s", errTest)))
 			})
 		})
-	})
 
-	Context("customers.Insert", func() {
-		var (
-			expectedInsert = `INSERT INTO customers`
-			testCustomers  = &customers{}
-			db             *cdb
-		)
-
-		BeforeEach(func() {
-			db = &cdb{dbMock}
-
-			*testCustomers = append(*testCustomers, &customer{
-				Id:        1,
-				FirstName: "jon",
-				LastName:  "doe",
-				Email:     "jon.doe@mail.com",
-				Phone:     "+1 212 555 1234",
-				db:        db,
+		Context("with an insert failure", func() {
+			BeforeEach(func() {
+				mockDB.ExpectBegin()
+				mockDB.ExpectQuery(expectedInsert).WillReturnError(errTest)
+				mockDB.ExpectRollback()
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers...)
 			})
-		})
 
-		AfterEach(func() {
-			db = nil
+			It("should return an error", func() {
+				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
+				Expect(err).To(MatchError(fmt.Errorf("while inserting customers: %s", errTest)))
+				Expect(conflicts).To(BeNil())
+			})
 		})
 
-		Context("with a good customer set", func() {
+		Context("with a conflict that isn't in the set", func() {
 			BeforeEach(func() {
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec(expectedInsert).WillReturnResult(sqlmock.NewResult(1, 1))
-				mockDB.ExpectCommit()
-				err = testCustomers.Insert()
+				mockDB.ExpectQuery(expectedInsert).WillReturnRows(conflictRows.AddRow(2, ConstraintID))
+				mockDB.ExpectRollback()
+				conflicts, err = customerDB.InsertCustomers(context.Background(), testCustomers...)
 			})
 
-			It("should insert the customer", func() {
+			It("should roll back the insert", func() {
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
+				Expect(err).To(MatchError("while scanning conflicts: no customer 2 in the set"))
 			})
 		})
+
+		Context("with no customers", func() {
+			It("should do nothing", func() {
+				conflicts, err = customerDB.InsertCustomers(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(BeEmpty())
+				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
+			})
+		})
+	})
+
+	Context(".Without", func() {
+		It("should leave out the customers that conflicted", func() {
+			customers := NewCustomers(expectedCustomer1, expectedCustomer2)
+			Expect(customers.Without([]Conflict{{Customer: expectedCustomer1, Constraint: ConstraintID}})).
+				To(Equal(NewCustomers(expectedCustomer2)))
+			Expect(customers.Without(nil)).To(Equal(customers))
+		})
 	})
 
 	Context(".Append", func() {
-		var testCustomers = &customers{}
-		var expectedCustomers = &customers{}
+		var testCustomers = &Customers{}
+		var expectedCustomers = &Customers{}
 
 		BeforeEach(func() {
 			*expectedCustomers = append(*expectedCustomers, expectedCustomer1, expectedCustomer2)
@@ -255,7 +273,7 @@ var _ = Describe("Database", func() {
 	})
 
 	Context(".Count", func() {
-		var testCustomers = &customers{}
+		var testCustomers = &Customers{}
 
 		Context("with no customers", func() {
 			It("should return 0", func() {
@@ -275,7 +293,7 @@ var _ = Describe("Database", func() {
 	})
 
 	Context(".Count", func() {
-		var testCustomers = &customers{}
+		var testCustomers = &Customers{}
 
 		Context("with no customers", func() {
 			It("should return 0", func() {
@@ -294,15 +312,15 @@ var _ = Describe("Database", func() {
 		})
 	})
 
-	Context("SelectCustomersForUpload", func() {
+	Context("SelectCustomersForUploadAfter", func() {
 		var (
 			expectedRows *sqlmock.Rows
-			rowsReturned *customers
-			db           *cdb
+			rowsReturned Customers
+			db           *DB
 		)
 
 		BeforeEach(func() {
-			db = &cdb{dbMock}
+			db = &DB{DB: dbMock, log: logging.Nop()}
 		})
 
 		AfterEach(func() {
@@ -312,25 +330,25 @@ var _ = Describe("Database", func() {
 		Context("with a successful select", func() {
 			BeforeEach(func() {
 				expectedRows = sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "phone"}).
-					AddRow(1, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234").
 					AddRow(2, "jane", "doe", "jane.doe@mail.com", "+1 212 555 4321").
 					AddRow(3, "steve", "stevenson", "steves@mail.com", "+1 503 555 5522")
-				mockDB.ExpectQuery("SELECT id, first_name, last_name, email, phone FROM customers WHERE uploaded = false").WillReturnRows(expectedRows)
-				rowsReturned, err = db.SelectCustomersForUpload()
+				mockDB.ExpectQuery("SELECT id, first_name, last_name, email, phone FROM customers WHERE uploaded = false AND NOT dead_letter AND NOT skipped AND id > \\$1::bigint AND id <= \\$2::bigint ORDER BY id LIMIT \\$3").
+					WithArgs(1, 10, 2).
+					WillReturnRows(expectedRows)
+				rowsReturned, err = db.SelectCustomersForUploadAfter(context.Background(), 1, 10, 2)
 			})
 
-			It("should return customers needing to be uploaded", func() {
+			It("should return the page of customers needing to be uploaded", func() {
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
 				Expect(err).ToNot(HaveOccurred())
-				Expect(rowsReturned).ToNot(BeNil())
-				Expect(len(*rowsReturned)).To(Equal(3))
+				Expect(rowsReturned.IDs()).To(Equal([]int64{2, 3}))
 			})
 		})
 
 		Context("when an error occurs selecting rows", func() {
 			BeforeEach(func() {
 				mockDB.ExpectQuery("SELECT id, first_name, last_name, email, phone FROM customers WHERE uploaded = false").WillReturnError(errTest)
-				rowsReturned, err = db.SelectCustomersForUpload()
+				rowsReturned, err = db.SelectCustomersForUploadAfter(context.Background(), 0, 10, 2)
 			})
 
 			It("should return a select error", func() {
@@ -346,31 +364,58 @@ var _ = Describe("Database", func() {
 					AddRow(nil, "jon", "doe", "jdoe@mail.com", "+1 212 555 1234").
 					RowError(1, errTest)
 				mockDB.ExpectQuery("SELECT").WillReturnRows(expectedRows)
-				rowsReturned, err = db.SelectCustomersForUpload()
+				rowsReturned, err = db.SelectCustomersForUploadAfter(context.Background(), 0, 10, 2)
 			})
 
 			It("should return a scan error", func() {
 				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
-				Expect(err).To(MatchError(fmt.Errorf("while scanning rows: sql: Scan error on column index 0, name \"id\": converting driver.Value type <nil> (\"<nil>\") to a int64: invalid syntax")))
+				// The wording of the conversion error differs between Go releases, so only match up to the column.
+				Expect(err).To(MatchError(HavePrefix("while scanning rows: sql: Scan error on column index 0, name \"id\"")))
+				Expect(rowsReturned).To(BeNil())
+			})
+		})
+		Context("when the select takes longer than allowed", func() {
+			BeforeEach(func() {
+				db.SetTimeouts(Timeouts{Select: 10 * time.Millisecond})
+				expectedRows = sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "phone"}).
+					AddRow(1, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234")
+				mockDB.ExpectQuery("SELECT").WillDelayFor(time.Second).WillReturnRows(expectedRows)
+				rowsReturned, err = db.SelectCustomersForUploadAfter(context.Background(), 0, 10, 2)
+			})
+
+			It("should cancel the select", func() {
+				Expect(err).To(MatchError(HavePrefix("while selecting rows: canceling query")))
+				Expect(rowsReturned).To(BeNil())
+			})
+		})
+
+		Context("when the context is already done", func() {
+			BeforeEach(func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				rowsReturned, err = db.SelectCustomersForUploadAfter(ctx, 0, 10, 2)
+			})
+
+			It("should not select anything", func() {
+				Expect(err).To(MatchError(fmt.Errorf("while selecting rows: %s", context.Canceled)))
 				Expect(rowsReturned).To(BeNil())
 			})
 		})
 	})
 
-	Context(".Uploaded", func() {
+	Context(".MarkUploaded", func() {
 		var (
-			db           *cdb
-			testCustomer *customer
+			db           *DB
+			testCustomer *Customer
 		)
 		BeforeEach(func() {
-			db = &cdb{dbMock}
-			testCustomer = &customer{
+			db = &DB{DB: dbMock, log: logging.Nop()}
+			testCustomer = &Customer{
 				Id:        1,
 				FirstName: "jon",
 				LastName:  "doe",
 				Email:     "jon.doe@mail.com",
 				Phone:     "+1 212 555 1234",
-				db:        db,
 			}
 		})
 
@@ -381,9 +426,11 @@ var _ = Describe("Database", func() {
 		Context("with a successful update", func() {
 			BeforeEach(func() {
 				mockDB.ExpectBegin()
-				mockDB.ExpectExec("UPDATE customers").WillReturnResult(sqlmock.NewResult(1, 1))
+				mockDB.ExpectExec("UPDATE customers").
+					WithArgs("jon.doe@mail.com", sql.NullString{String: "crm-1", Valid: true}).
+					WillReturnResult(sqlmock.NewResult(1, 1))
 				mockDB.ExpectCommit()
-				err = testCustomer.Uploaded()
+				err = db.MarkUploaded(context.Background(), testCustomer, "crm-1")
 			})
 
 			It("should not return an error", func() {
@@ -397,7 +444,7 @@ var _ = Describe("Database", func() {
 				mockDB.ExpectBegin()
 				mockDB.ExpectExec("UPDATE customers").WillReturnError(errTest)
 				mockDB.ExpectRollback()
-				err = testCustomer.Uploaded()
+				err = db.MarkUploaded(context.Background(), testCustomer, "")
 			})
 
 			It("should return an error", func() {
@@ -405,5 +452,56 @@ var _ = Describe("Database", func() {
 				Expect(err).To(MatchError(fmt.Errorf("while updating: %s", errTest)))
 			})
 		})
+
+		Context("with a failed commit", func() {
+			BeforeEach(func() {
+				mockDB.ExpectBegin()
+				mockDB.ExpectExec("UPDATE customers").WillReturnResult(sqlmock.NewResult(1, 1))
+				mockDB.ExpectCommit().WillReturnError(errTest)
+				err = db.MarkUploaded(context.Background(), testCustomer, "crm-1")
+			})
+
+			It("should return an error", func() {
+				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
+				Expect(err).To(MatchError(errTest))
+			})
+		})
+	})
+
+	Context(".MarkUploadFailed", func() {
+		var (
+			db           *DB
+			testCustomer *Customer
+		)
+
+		BeforeEach(func() {
+			db = &DB{DB: dbMock, maxAttempts: 3, log: logging.Nop()}
+			testCustomer = &Customer{Id: 1, Email: "jon.doe@mail.com"}
+		})
+
+		Context("with a successful update", func() {
+			BeforeEach(func() {
+				mockDB.ExpectExec("UPDATE customers SET attempts = attempts \\+ 1").
+					WithArgs("jon.doe@mail.com", "post to CRM failed", true, 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				err = db.MarkUploadFailed(context.Background(), testCustomer, "post to CRM failed", true)
+			})
+
+			It("should record the attempt", func() {
+				Expect(mockDB.ExpectationsWereMet()).ToNot(HaveOccurred())
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("with a failed update", func() {
+			BeforeEach(func() {
+				mockDB.ExpectExec("UPDATE customers").WillReturnError(errTest)
+				err = db.MarkUploadFailed(context.Background(), testCustomer, "post to CRM failed", false)
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError(fmt.Errorf("while recording failed upload: %s", errTest)))
+			})
+		})
 	})
 })
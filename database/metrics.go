@@ -0,0 +1,31 @@
+package database
+
+import (
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/metrics"
+)
+
+var (
+	queryDuration = metrics.NewHistogram("csvcrm_database_query_duration_seconds",
+		"Time taken by database operations.", nil, "operation")
+	queryErrors = metrics.NewCounter("csvcrm_database_errors_total",
+		"Database operations that returned an error.", "operation")
+)
+
+// observe records how long an operation took and whether it failed, passing its error back.
+func (db *DB) observe(operation string, start time.Time, err error, fields ...logging.Field) error {
+	elapsed := time.Since(start)
+	queryDuration.Observe(elapsed.Seconds(), operation)
+	if err != nil {
+		queryErrors.Inc(operation)
+	}
+
+	fields = append(fields, logging.F("operation", operation), logging.F("duration", elapsed))
+	if err != nil {
+		fields = append(fields, logging.Err(err))
+	}
+	db.log.Debug("database operation", fields...)
+	return err
+}
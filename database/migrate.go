@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// migrations bring a database created by postgres/entrypoint-init.d up to date. Each one is safe to run again, so
+// they are all run every time.
+var migrations = []string{
+	`ALTER TABLE customers ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE customers ADD COLUMN IF NOT EXISTS last_error TEXT;`,
+	`ALTER TABLE customers ADD COLUMN IF NOT EXISTS last_attempt_ts TIMESTAMPTZ;`,
+	`ALTER TABLE customers ADD COLUMN IF NOT EXISTS dead_letter BOOLEAN NOT NULL DEFAULT false;`,
+	`ALTER TABLE customers ADD COLUMN IF NOT EXISTS skipped BOOLEAN NOT NULL DEFAULT false;`,
+	`CREATE TABLE IF NOT EXISTS upload_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL REFERENCES customers (id) ON DELETE CASCADE,
+		requested_ts TIMESTAMPTZ NOT NULL,
+		duration_ns BIGINT NOT NULL,
+		status INTEGER,
+		error TEXT,
+		response TEXT,
+		crm_id TEXT,
+		worker_id TEXT NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS upload_attempts_customer_idx ON upload_attempts (customer_id, requested_ts);`,
+	`ALTER TABLE customers ADD COLUMN IF NOT EXISTS crm_id TEXT;`,
+	`CREATE INDEX IF NOT EXISTS customers_crm_id_idx ON customers (crm_id);`,
+	`CREATE INDEX IF NOT EXISTS customers_pending_idx ON customers (id) WHERE NOT uploaded AND NOT dead_letter AND NOT skipped;`,
+}
+
+// Migrate updates the schema for this version, in a single transaction, rolled back if ctx is done first. It isn't
+// limited by the timeouts, as building an index on a large table can take a while.
+func (db *DB) Migrate(ctx context.Context) error {
+	return db.observe("migrate", time.Now(), db.migrate(ctx))
+}
+
+func (db *DB) migrate(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("while creating transaction: %s", err)
+	}
+
+	for _, m := range migrations {
+		if _, err := tx.ExecContext(ctx, m); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("while migrating (%s): %s", m, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("while committing migration: %s", err)
+	}
+	return nil
+}
@@ -5,186 +5,129 @@
 package mock_database
 
 import (
-	gomock "github.com/golang/mock/gomock"
+	context "context"
 	reflect "reflect"
+
+	database "github.com/dbyington/csv-crm-upload/database"
+	gomock "github.com/golang/mock/gomock"
 )
 
-// MockCustomerDB is a mock of CustomerDB interface
-type MockCustomerDB struct {
+// MockStore is a mock of Store interface.
+type MockStore struct {
 	ctrl     *gomock.Controller
-	recorder *MockCustomerDBMockRecorder
+	recorder *MockStoreMockRecorder
 }
 
-// MockCustomerDBMockRecorder is the mock recorder for MockCustomerDB
-type MockCustomerDBMockRecorder struct {
-	mock *MockCustomerDB
+// MockStoreMockRecorder is the mock recorder for MockStore.
+type MockStoreMockRecorder struct {
+	mock *MockStore
 }
 
-// NewMockCustomerDB creates a new mock instance
-func NewMockCustomerDB(ctrl *gomock.Controller) *MockCustomerDB {
-	mock := &MockCustomerDB{ctrl: ctrl}
-	mock.recorder = &MockCustomerDBMockRecorder{mock}
+// NewMockStore creates a new mock instance.
+func NewMockStore(ctrl *gomock.Controller) *MockStore {
+	mock := &MockStore{ctrl: ctrl}
+	mock.recorder = &MockStoreMockRecorder{mock}
 	return mock
 }
 
-// EXPECT returns an object that allows the caller to indicate expected use
-func (m *MockCustomerDB) EXPECT() *MockCustomerDBMockRecorder {
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 	return m.recorder
 }
 
-// NewCustomer mocks base method
-func (m *MockCustomerDB) NewCustomer(arg0 int64, arg1, arg2, arg3, arg4 string) *customer {
+// CopyCustomers mocks base method.
+func (m *MockStore) CopyCustomers(ctx context.Context, customers ...*database.Customer) ([]database.Conflict, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "NewCustomer", arg0, arg1, arg2, arg3, arg4)
-	ret0, _ := ret[0].(*customer)
-	return ret0
+	varargs := []interface{}{ctx}
+	for _, a := range customers {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "CopyCustomers", varargs...)
+	ret0, _ := ret[0].([]database.Conflict)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
-// NewCustomer indicates an expected call of NewCustomer
-func (mr *MockCustomerDBMockRecorder) NewCustomer(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+// CopyCustomers indicates an expected call of CopyCustomers.
+func (mr *MockStoreMockRecorder) CopyCustomers(ctx interface{}, customers ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewCustomer", reflect.TypeOf((*MockCustomerDB)(nil).NewCustomer), arg0, arg1, arg2, arg3, arg4)
+	varargs := append([]interface{}{ctx}, customers...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CopyCustomers", reflect.TypeOf((*MockStore)(nil).CopyCustomers), varargs...)
 }
 
-// SelectCustomersForUpload mocks base method
-func (m *MockCustomerDB) SelectCustomersForUpload() (*customers, error) {
+// InsertCustomers mocks base method.
+func (m *MockStore) InsertCustomers(ctx context.Context, customers ...*database.Customer) ([]database.Conflict, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SelectCustomersForUpload")
-	ret0, _ := ret[0].(*customers)
+	varargs := []interface{}{ctx}
+	for _, a := range customers {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "InsertCustomers", varargs...)
+	ret0, _ := ret[0].([]database.Conflict)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// SelectCustomersForUpload indicates an expected call of SelectCustomersForUpload
-func (mr *MockCustomerDBMockRecorder) SelectCustomersForUpload() *gomock.Call {
+// InsertCustomers indicates an expected call of InsertCustomers.
+func (mr *MockStoreMockRecorder) InsertCustomers(ctx interface{}, customers ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SelectCustomersForUpload", reflect.TypeOf((*MockCustomerDB)(nil).SelectCustomersForUpload))
-}
-
-// MockCustomer is a mock of Customer interface
-type MockCustomer struct {
-	ctrl     *gomock.Controller
-	recorder *MockCustomerMockRecorder
-}
-
-// MockCustomerMockRecorder is the mock recorder for MockCustomer
-type MockCustomerMockRecorder struct {
-	mock *MockCustomer
+	varargs := append([]interface{}{ctx}, customers...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertCustomers", reflect.TypeOf((*MockStore)(nil).InsertCustomers), varargs...)
 }
 
-// NewMockCustomer creates a new mock instance
-func NewMockCustomer(ctrl *gomock.Controller) *MockCustomer {
-	mock := &MockCustomer{ctrl: ctrl}
-	mock.recorder = &MockCustomerMockRecorder{mock}
-	return mock
-}
-
-// EXPECT returns an object that allows the caller to indicate expected use
-func (m *MockCustomer) EXPECT() *MockCustomerMockRecorder {
-	return m.recorder
-}
-
-// Insert mocks base method
-func (m *MockCustomer) Insert() error {
+// MarkUploadFailed mocks base method.
+func (m *MockStore) MarkUploadFailed(ctx context.Context, c *database.Customer, reason string, permanent bool) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Insert")
+	ret := m.ctrl.Call(m, "MarkUploadFailed", ctx, c, reason, permanent)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Insert indicates an expected call of Insert
-func (mr *MockCustomerMockRecorder) Insert() *gomock.Call {
+// MarkUploadFailed indicates an expected call of MarkUploadFailed.
+func (mr *MockStoreMockRecorder) MarkUploadFailed(ctx, c, reason, permanent interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*MockCustomer)(nil).Insert))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkUploadFailed", reflect.TypeOf((*MockStore)(nil).MarkUploadFailed), ctx, c, reason, permanent)
 }
 
-// Uploaded mocks base method
-func (m *MockCustomer) Uploaded() error {
+// MarkUploaded mocks base method.
+func (m *MockStore) MarkUploaded(ctx context.Context, c *database.Customer, crmID string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Uploaded")
+	ret := m.ctrl.Call(m, "MarkUploaded", ctx, c, crmID)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Uploaded indicates an expected call of Uploaded
-func (mr *MockCustomerMockRecorder) Uploaded() *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Uploaded", reflect.TypeOf((*MockCustomer)(nil).Uploaded))
-}
-
-// MockCustomers is a mock of Customers interface
-type MockCustomers struct {
-	ctrl     *gomock.Controller
-	recorder *MockCustomersMockRecorder
-}
-
-// MockCustomersMockRecorder is the mock recorder for MockCustomers
-type MockCustomersMockRecorder struct {
-	mock *MockCustomers
-}
-
-// NewMockCustomers creates a new mock instance
-func NewMockCustomers(ctrl *gomock.Controller) *MockCustomers {
-	mock := &MockCustomers{ctrl: ctrl}
-	mock.recorder = &MockCustomersMockRecorder{mock}
-	return mock
-}
-
-// EXPECT returns an object that allows the caller to indicate expected use
-func (m *MockCustomers) EXPECT() *MockCustomersMockRecorder {
-	return m.recorder
-}
-
-// Append mocks base method
-func (m *MockCustomers) Append(arg0 *customer) {
-	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Append", arg0)
-}
-
-// Append indicates an expected call of Append
-func (mr *MockCustomersMockRecorder) Append(arg0 interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Append", reflect.TypeOf((*MockCustomers)(nil).Append), arg0)
-}
-
-// Count mocks base method
-func (m *MockCustomers) Count() int {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Count")
-	ret0, _ := ret[0].(int)
-	return ret0
-}
-
-// Count indicates an expected call of Count
-func (mr *MockCustomersMockRecorder) Count() *gomock.Call {
+// MarkUploaded indicates an expected call of MarkUploaded.
+func (mr *MockStoreMockRecorder) MarkUploaded(ctx, c, crmID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Count", reflect.TypeOf((*MockCustomers)(nil).Count))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkUploaded", reflect.TypeOf((*MockStore)(nil).MarkUploaded), ctx, c, crmID)
 }
 
-// Insert mocks base method
-func (m *MockCustomers) Insert() error {
+// RecordAttempt mocks base method.
+func (m *MockStore) RecordAttempt(ctx context.Context, a database.UploadAttempt) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Insert")
+	ret := m.ctrl.Call(m, "RecordAttempt", ctx, a)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Insert indicates an expected call of Insert
-func (mr *MockCustomersMockRecorder) Insert() *gomock.Call {
+// RecordAttempt indicates an expected call of RecordAttempt.
+func (mr *MockStoreMockRecorder) RecordAttempt(ctx, a interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*MockCustomers)(nil).Insert))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordAttempt", reflect.TypeOf((*MockStore)(nil).RecordAttempt), ctx, a)
 }
 
-// List mocks base method
-func (m *MockCustomers) List() []*customer {
+// SelectCustomersForUploadAfter mocks base method.
+func (m *MockStore) SelectCustomersForUploadAfter(ctx context.Context, after, last int64, limit int) (database.Customers, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "List")
-	ret0, _ := ret[0].([]*customer)
-	return ret0
+	ret := m.ctrl.Call(m, "SelectCustomersForUploadAfter", ctx, after, last, limit)
+	ret0, _ := ret[0].(database.Customers)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
-// List indicates an expected call of List
-func (mr *MockCustomersMockRecorder) List() *gomock.Call {
+// SelectCustomersForUploadAfter indicates an expected call of SelectCustomersForUploadAfter.
+func (mr *MockStoreMockRecorder) SelectCustomersForUploadAfter(ctx, after, last, limit interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockCustomers)(nil).List))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SelectCustomersForUploadAfter", reflect.TypeOf((*MockStore)(nil).SelectCustomersForUploadAfter), ctx, after, last, limit)
 }
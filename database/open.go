@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+// The waits between attempts to reach a database that isn't ready yet, doubling from the first to the last.
+const (
+	firstReadyRetry = 100 * time.Millisecond
+	lastReadyRetry  = 5 * time.Second
+)
+
+// The sslmodes lib/pq supports.
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// Config is how to connect to Postgres: either a full DSN or its parts.
+type Config struct {
+	// DSN, if set, is used as it is in place of the parts.
+	DSN string
+	// Host is a host name, optionally with a port, or the directory of a unix socket.
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+	// SSLCert and SSLKey are a client certificate, SSLRootCert the CA the server's certificate is checked against.
+	SSLCert     string
+	SSLKey      string
+	SSLRootCert string
+
+	// MaxOpenConns and MaxIdleConns size the connection pool, 0 open connections for no limit. ConnMaxLifetime is how
+	// long a connection is reused for, 0 for as long as it works.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// ReadyTimeout is how long Open waits for the database to accept connections, 0 to try once.
+	ReadyTimeout time.Duration
+	// Timeouts bound each insert, select and update, see SetTimeouts.
+	Timeouts Timeouts
+}
+
+// Validate checks there is enough to connect with.
+func (c Config) Validate() error {
+	if c.DSN == "" {
+		switch {
+		case c.Host == "":
+			return fmt.Errorf("host is required")
+		case c.Name == "":
+			return fmt.Errorf("name is required")
+		case c.Port < 0 || c.Port > 65535:
+			return fmt.Errorf("port must be from 1 to 65535")
+		case c.SSLMode != "" && !validSSLMode(c.SSLMode):
+			return fmt.Errorf("sslmode must be one of %s, not %q", strings.Join(sslModes, ", "), c.SSLMode)
+		case (c.SSLCert == "") != (c.SSLKey == ""):
+			return fmt.Errorf("sslcert and sslkey must be given together")
+		}
+	}
+	t := c.Timeouts
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 || c.ConnMaxLifetime < 0 || c.ReadyTimeout < 0 ||
+		t.Insert < 0 || t.Select < 0 || t.Update < 0 {
+		return fmt.Errorf("pool settings and timeouts can't be negative")
+	}
+	return nil
+}
+
+func validSSLMode(mode string) bool {
+	for _, m := range sslModes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnString is the DSN, or a postgres:// URL built from the parts with each part escaped.
+func (c Config) ConnString() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+
+	u := url.URL{Scheme: "postgres", Path: "/" + c.Name}
+	q := url.Values{}
+	if strings.HasPrefix(c.Host, "/") {
+		// A unix socket can't be the host of a URL, lib/pq takes it as a parameter instead.
+		q.Set("host", c.Host)
+		if c.Port != 0 {
+			q.Set("port", strconv.Itoa(c.Port))
+		}
+	} else {
+		u.Host = c.Host
+		if _, _, err := net.SplitHostPort(c.Host); err != nil && c.Port != 0 {
+			u.Host = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+		}
+	}
+	if c.User != "" {
+		if c.Password != "" {
+			u.User = url.UserPassword(c.User, c.Password)
+		} else {
+			u.User = url.User(c.User)
+		}
+	}
+	for key, value := range map[string]string{
+		"sslmode":     c.SSLMode,
+		"sslcert":     c.SSLCert,
+		"sslkey":      c.SSLKey,
+		"sslrootcert": c.SSLRootCert,
+	} {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Open connects to the database, sizing the connection pool and waiting up to the ReadyTimeout, with backoff, for the
+// database to accept connections.
+func Open(c Config, log logging.Logger) (*DB, error) {
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("while opening database: %s", err)
+	}
+	d, err := sql.Open("postgres", c.ConnString())
+	if err != nil {
+		return nil, fmt.Errorf("while opening database: %s", err)
+	}
+	d.SetMaxOpenConns(c.MaxOpenConns)
+	d.SetMaxIdleConns(c.MaxIdleConns)
+	d.SetConnMaxLifetime(c.ConnMaxLifetime)
+
+	if err := waitReady(d.PingContext, c.ReadyTimeout, log); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	db := NewCustomerDB(d)
+	db.SetTimeouts(c.Timeouts)
+	db.SetLogger(log)
+	return db, nil
+}
+
+// waitReady pings until the database answers or the timeout has passed.
+func waitReady(ping func(context.Context) error, timeout time.Duration, log logging.Logger) error {
+	deadline := time.Now().Add(timeout)
+	wait := firstReadyRetry
+	for {
+		ctx, cancel := context.Background(), func() {}
+		if timeout > 0 {
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+		}
+		err := ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("while waiting for database: %s", err)
+		}
+		if wait > left {
+			wait = left
+		}
+		log.Warn("database not ready, retrying", logging.F("wait", wait.String()), logging.Err(err))
+		time.Sleep(wait)
+		if wait *= 2; wait > lastReadyRetry {
+			wait = lastReadyRetry
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dbyington/csv-crm-upload/cmd/csvreader"
+	"github.com/dbyington/csv-crm-upload/crm_server/mockcrm"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal/sender"
+)
+
+// How many rows each file the benchmarks import has.
+const benchmarkRows = 10000
+
+// The benchmarks compare importing a file a set at a time with bulk loading it with COPY, against the database in
+// E2E_DATABASE_URL:
+//
+//	E2E_DATABASE_URL=... go test -run '^$' -bench . ./e2e
+func BenchmarkImport(b *testing.B) {
+	for _, buffer := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("insert/buffer=%d", buffer), func(b *testing.B) { benchmarkImport(b, buffer, false, 0) })
+		b.Run(fmt.Sprintf("copy/buffer=%d", buffer), func(b *testing.B) { benchmarkImport(b, buffer, true, 0) })
+	}
+}
+
+// BenchmarkImportConflicts is BenchmarkImport with one row in every hundred reusing the id of the row before it, which
+// is left out of its set and reported.
+func BenchmarkImportConflicts(b *testing.B) {
+	for _, buffer := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("insert/buffer=%d", buffer), func(b *testing.B) { benchmarkImport(b, buffer, false, 100) })
+		b.Run(fmt.Sprintf("copy/buffer=%d", buffer), func(b *testing.B) { benchmarkImport(b, buffer, true, 100) })
+	}
+}
+
+// benchmarkImport imports a file of benchmarkRows new customers each time round, every conflictEvery'th of them a
+// duplicate if conflictEvery is positive.
+func benchmarkImport(b *testing.B, buffer int, useCopy bool, conflictEvery int) {
+	dsn := os.Getenv(DatabaseEnv)
+	if dsn == "" {
+		b.Skip(DatabaseEnv + " is not set")
+	}
+	h, err := newHarness(dsn, mockcrm.Scenario{}, logging.Nop(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		file := customersCSV(i*benchmarkRows, benchmarkRows, conflictEvery)
+		b.SetBytes(int64(len(file)))
+		r := csvreader.NewReader(h.store, bytes.NewReader(file), sender.NewNotifySender(), false, buffer)
+		r.SetLogger(logging.Nop())
+		r.SetCopy(useCopy)
+		b.StartTimer()
+
+		if err := r.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// customersCSV is a CSV file of n customers with ids from first+1, each with an email of its own. If conflictEvery is
+// positive every conflictEvery'th row has the same id as the row before it.
+func customersCSV(first, n, conflictEvery int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("id,first_name,last_name,email,phone\n")
+	for i := 1; i <= n; i++ {
+		id := first + i
+		if conflictEvery > 0 && i%conflictEvery == 0 {
+			id--
+		}
+		fmt.Fprintf(&buf, "%d,jon,doe,customer%d@example.com,+1 212 555 1234\n", id, first+i)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,325 @@
+//go:build chaos
+// +build chaos
+
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/crm_server/mockcrm"
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+const (
+	// The chance of the integrator being killed as the CRM receives each post, before and after it is stored.
+	killBeforeStoreRate = 0.002
+	killAfterStoreRate  = 0.002
+	// The longest the integrator runs before it is killed at random, and how many times the reader is.
+	maxIntegratorRun = 2 * time.Second
+	readerKills      = 5
+)
+
+// process is one of the services, run as a subprocess so it can be killed.
+type process struct {
+	name string
+	path string
+	args []string
+	env  []string
+	out  io.Writer
+
+	mutex  sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+	err    error
+	kills  int
+}
+
+func (p *process) start() error {
+	cmd := exec.Command(p.path, p.args...)
+	cmd.Env = append(os.Environ(), p.env...)
+	cmd.Stdout, cmd.Stderr = p.out, p.out
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("while starting %s: %s", p.name, err)
+	}
+
+	exited := make(chan struct{})
+	p.mutex.Lock()
+	p.cmd, p.exited, p.err = cmd, exited, nil
+	p.mutex.Unlock()
+	go func() {
+		err := cmd.Wait()
+		p.mutex.Lock()
+		p.err = err
+		p.mutex.Unlock()
+		close(exited)
+	}()
+	return nil
+}
+
+// kill kills the process, if it is running, and waits for it to exit. It reports whether it killed the process.
+func (p *process) kill() bool {
+	p.mutex.Lock()
+	cmd, exited := p.cmd, p.exited
+	p.mutex.Unlock()
+	if cmd == nil {
+		return false
+	}
+	select {
+	case <-exited:
+		return false
+	default:
+	}
+
+	killed := cmd.Process.Kill() == nil
+	<-exited
+	if killed {
+		p.mutex.Lock()
+		p.kills++
+		p.mutex.Unlock()
+	}
+	return killed
+}
+
+// wait waits for the process to exit, returning how it exited.
+func (p *process) wait() error {
+	p.mutex.Lock()
+	exited := p.exited
+	p.mutex.Unlock()
+	<-exited
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.err
+}
+
+func (p *process) killed() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.kills
+}
+
+// supervise restarts the process whenever it exits, until stop is closed.
+func supervise(p *process, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if err := p.start(); err != nil {
+				fmt.Fprintln(GinkgoWriter, err)
+				return
+			}
+			p.wait()
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+	return done
+}
+
+// chance reports true at the rate given, safely from the CRM's handlers.
+type chance struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func (c *chance) of(rate float64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.rand.Float64() < rate
+}
+
+func (c *chance) duration(max time.Duration) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Duration(c.rand.Int63n(int64(max)))
+}
+
+// dbEnv is the environment the services need to use the harness's schema in the database the DSN connects to.
+func dbEnv(dsn, schema string) []string {
+	return []string{"DATABASE_URL=" + dsn, "PGOPTIONS=-c search_path=" + schema}
+}
+
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func build(dir, name, pkg string) string {
+	path := filepath.Join(dir, name)
+	out, err := exec.Command("go", "build", "-o", path, pkg).CombinedOutput()
+	Expect(err).ToNot(HaveOccurred(), string(out))
+	return path
+}
+
+// postsByCustomer counts the posts the CRM received for each customer, by the customer's id.
+func postsByCustomer(payloads [][]byte) map[int64]int {
+	posts := make(map[int64]int, len(payloads))
+	for _, body := range payloads {
+		var c struct {
+			ID int64 `json:"id"`
+		}
+		Expect(json.Unmarshal(body, &c)).To(Succeed())
+		posts[c.ID]++
+	}
+	return posts
+}
+
+var _ = Describe("Chaos", func() {
+	var (
+		h          *Harness
+		bin        string
+		integrator *process
+		reader     *process
+		chances    *chance
+		// killedAfterStore counts the customers the CRM stored without the integrator hearing it had.
+		killedAfterStore int64
+	)
+
+	BeforeEach(func() {
+		h, integrator = nil, nil
+		dsn := os.Getenv(DatabaseEnv)
+		if dsn == "" {
+			Skip(DatabaseEnv + " is not set")
+		}
+
+		var err error
+		bin, err = ioutil.TempDir("", "chaos")
+		Expect(err).ToNot(HaveOccurred())
+		csvcrm := build(bin, "csvcrm", "github.com/dbyington/csv-crm-upload/cmd/csvcrm")
+
+		chances = &chance{rand: rand.New(rand.NewSource(GinkgoRandomSeed()))}
+		integrator = &process{name: "upload", path: csvcrm, args: []string{"upload"}, out: GinkgoWriter}
+		killedAfterStore = 0
+
+		// The CRM kills the integrator as it posts, both before the customer is stored and after, when the integrator
+		// has yet to hear the CRM accepted it and mark it uploaded.
+		h, err = newHarness(dsn, mockcrm.Scenario{}, logging.Nop(), func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if chances.of(killBeforeStoreRate) {
+					integrator.kill()
+					return
+				}
+				next.ServeHTTP(w, r)
+				if chances.of(killAfterStoreRate) && integrator.kill() {
+					atomic.AddInt64(&killedAfterStore, 1)
+				}
+			})
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		listenerAddr := freeAddr()
+		env := append(dbEnv(dsn, h.schema), "LOG_LEVEL=warn", "LOG_REDACT_PII=true")
+		integrator.env = append(env, "CRM_SERVER_ADDR="+h.crm.URL, "CRM_LISTENER_NETWORK=tcp",
+			"CRM_LISTENER_ADDR="+listenerAddr, "SIGNAL_MODE=rpc", "CRM_WORKER_ID=chaos", "CRM_METRICS_ADDR=",
+			"CRM_ADMIN_TOKEN=")
+		reader = &process{name: "import", path: csvcrm, env: env, out: GinkgoWriter,
+			args: []string{"import", "-filename=" + mockData, "-buffer=100", "-rpcaddr=" + listenerAddr, "-rpcwait=1s"}}
+	})
+
+	AfterEach(func() {
+		if integrator != nil {
+			integrator.kill()
+		}
+		if h != nil {
+			Expect(h.Close()).To(Succeed())
+		}
+		os.RemoveAll(bin)
+	})
+
+	It("should lose no customers and upload none twice however often the services are killed", func() {
+		want := readEmails(mockData)
+
+		stop := make(chan struct{})
+		supervised := supervise(integrator, stop)
+
+		By("killing the integrator at random while it runs")
+		calm := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-calm:
+					return
+				case <-time.After(chances.duration(maxIntegratorRun)):
+					integrator.kill()
+				}
+			}
+		}()
+
+		By("killing the reader part way through its import, then letting it finish")
+		for reader.killed() < readerKills {
+			Expect(reader.start()).To(Succeed())
+			time.Sleep(chances.duration(500 * time.Millisecond))
+			reader.kill()
+		}
+		Expect(reader.start()).To(Succeed())
+		Expect(reader.wait()).To(Succeed())
+
+		close(calm)
+		Expect(h.WaitUploaded(5 * time.Minute)).To(Succeed())
+		close(stop)
+		integrator.kill()
+		<-supervised
+		Expect(integrator.killed()).To(BeNumerically(">", 0))
+
+		By("every customer being imported once and uploaded with the CRM's id")
+		crmIDs := make(map[int64]string, len(want))
+		rows, err := h.DB.Query(`SELECT id, email, uploaded, dead_letter, COALESCE(crm_id, '') FROM customers;`)
+		Expect(err).ToNot(HaveOccurred())
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				id                   int64
+				email, crmID         string
+				uploaded, deadLetter bool
+			)
+			Expect(rows.Scan(&id, &email, &uploaded, &deadLetter, &crmID)).To(Succeed())
+			Expect(email).To(Equal(want[id]))
+			Expect(uploaded).To(BeTrue(), "customer %d wasn't uploaded", id)
+			Expect(deadLetter).To(BeFalse(), "customer %d was dead-lettered", id)
+			Expect(crmID).ToNot(BeEmpty(), "customer %d has no CRM id", id)
+			crmIDs[id] = crmID
+		}
+		Expect(rows.Err()).ToNot(HaveOccurred())
+		Expect(crmIDs).To(HaveLen(len(want)))
+
+		By("the CRM being sent each customer once")
+		for id, n := range postsByCustomer(h.CRM.Payloads()) {
+			Expect(n).To(Equal(1), "customer %d was posted %d times, the integrator was killed %d times after the CRM "+
+				"stored a customer", id, n, atomic.LoadInt64(&killedAfterStore))
+		}
+		stats := h.CRM.Stats()
+		Expect(stats.Duplicates).To(BeZero())
+		Expect(stats.Invalid).To(BeZero())
+		Expect(stats.Created).To(Equal(int64(len(want))))
+
+		customers := h.CRM.Customers()
+		Expect(customers).To(HaveLen(len(want)))
+		for _, c := range customers {
+			Expect(c.Email).To(Equal(want[c.ExternalID]))
+			Expect(c.ID).To(Equal(crmIDs[c.ExternalID]))
+		}
+	})
+})
@@ -0,0 +1,147 @@
+package e2e
+
+import (
+	"context"
+	"encoding/csv"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/crm_server/mockcrm"
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+)
+
+const mockData = "../assets/MOCK_DATA_6000.csv"
+
+// readEmails returns the email of every customer in the CSV file, by id.
+func readEmails(path string) map[int64]string {
+	f, err := os.Open(path)
+	Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	Expect(err).ToNot(HaveOccurred())
+	emails := make(map[int64]string, len(rows))
+	for _, row := range rows[1:] {
+		id, err := strconv.ParseInt(row[0], 10, 64)
+		Expect(err).ToNot(HaveOccurred())
+		emails[id] = row[3]
+	}
+	return emails
+}
+
+var _ = Describe("E2E", func() {
+	var h *Harness
+
+	BeforeEach(func() {
+		h = nil
+		dsn := os.Getenv(DatabaseEnv)
+		if dsn == "" {
+			Skip(DatabaseEnv + " is not set")
+		}
+
+		scenario := mockcrm.Scenario{
+			Seed: 42,
+			Faults: []mockcrm.Fault{
+				{Kind: "503", Rate: 0.1},
+				{Kind: "429", Rate: 0.03},
+				{Kind: mockcrm.FaultReset, Rate: 0.02},
+			},
+		}
+		var err error
+		h, err = New(dsn, scenario, logging.Nop())
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if h != nil {
+			Expect(h.Close()).To(Succeed())
+		}
+	})
+
+	It("should upload every customer exactly once", func() {
+		want := readEmails(mockData)
+		Expect(h.Import(mockData)).To(Succeed())
+		Expect(h.WaitUploaded(5 * time.Minute)).To(Succeed())
+
+		By("recording every customer as uploaded with the CRM's id")
+		crmIDs := make(map[int64]string, len(want))
+		rows, err := h.DB.Query(`SELECT id, email, uploaded, dead_letter, COALESCE(crm_id, '') FROM customers;`)
+		Expect(err).ToNot(HaveOccurred())
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				id                   int64
+				email, crmID         string
+				uploaded, deadLetter bool
+			)
+			Expect(rows.Scan(&id, &email, &uploaded, &deadLetter, &crmID)).To(Succeed())
+			Expect(email).To(Equal(want[id]))
+			Expect(uploaded).To(BeTrue(), "customer %d wasn't uploaded", id)
+			Expect(deadLetter).To(BeFalse(), "customer %d was dead-lettered", id)
+			Expect(crmID).ToNot(BeEmpty(), "customer %d has no CRM id", id)
+			crmIDs[id] = crmID
+		}
+		Expect(rows.Err()).ToNot(HaveOccurred())
+		Expect(crmIDs).To(HaveLen(len(want)))
+
+		By("the CRM receiving each customer once")
+		stats := h.CRM.Stats()
+		Expect(stats.Failed).To(BeNumerically(">", 0), "no faults were injected")
+		Expect(stats.Duplicates).To(BeZero())
+		Expect(stats.Invalid).To(BeZero())
+		Expect(h.CRM.Payloads()).To(HaveLen(len(want)))
+
+		customers := h.CRM.Customers()
+		Expect(customers).To(HaveLen(len(want)))
+		for _, c := range customers {
+			Expect(c.Email).To(Equal(want[c.ExternalID]))
+			Expect(c.ID).To(Equal(crmIDs[c.ExternalID]))
+		}
+	})
+
+	It("should upload customers found by a check for work", func() {
+		customers := database.NewCustomers(
+			database.NewCustomer(1, "jon", "doe", "jon.doe@mail.com", "+1 212 555 1234"),
+			database.NewCustomer(2, "jane", "doe", "jane.doe@mail.com", "+1 212 555 4321"))
+		// Inserted without a signal, so only a check for every customer waiting finds them.
+		_, err := h.store.InsertCustomers(context.Background(), customers...)
+		Expect(err).ToNot(HaveOccurred())
+
+		waiting, err := h.store.SelectCustomersForUploadAfter(context.Background(), math.MinInt64, math.MaxInt64, 10)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(waiting.IDs()).To(Equal([]int64{1, 2}))
+
+		h.Check()
+		Expect(h.WaitUploaded(time.Minute)).To(Succeed())
+		Expect(h.CRM.Customers()).To(HaveLen(2))
+	})
+
+	importTwice := func() {
+		want := readEmails(mockData)
+		Expect(h.Import(mockData)).To(Succeed())
+		Expect(h.Import(mockData)).To(Succeed())
+
+		var n int
+		Expect(h.DB.QueryRow(`SELECT count(*) FROM customers;`).Scan(&n)).To(Succeed())
+		Expect(n).To(Equal(len(want)))
+
+		Expect(h.WaitUploaded(5 * time.Minute)).To(Succeed())
+		Expect(h.CRM.Stats().Duplicates).To(BeZero())
+		Expect(h.CRM.Customers()).To(HaveLen(len(want)))
+	}
+
+	It("should leave out customers already imported", func() {
+		importTwice()
+	})
+
+	It("should bulk load with COPY, leaving out customers already imported", func() {
+		h.SetCopy(true)
+		importTwice()
+	})
+})
@@ -0,0 +1,251 @@
+// Package e2e runs the csvReader, the crmIntegrator and the mock CRM together in one process, against a real Postgres,
+// so tests can follow customers from a CSV file all the way to the CRM.
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/cmd/csvreader"
+	"github.com/dbyington/csv-crm-upload/crm/upload"
+	"github.com/dbyington/csv-crm-upload/crm_server/mockcrm"
+	"github.com/dbyington/csv-crm-upload/database"
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal/listener"
+	"github.com/dbyington/csv-crm-upload/signal/sender"
+)
+
+// DatabaseEnv names the variable holding the Postgres connection string the tests run against. They are skipped when
+// it isn't set.
+const DatabaseEnv = "E2E_DATABASE_URL"
+
+// The customers table as postgres/entrypoint-init.d creates it, which the integrator's migrations build on.
+const createCustomers = `CREATE TABLE customers (
+	id INTEGER NOT NULL UNIQUE,
+	first_name TEXT,
+	last_name TEXT,
+	email TEXT NOT NULL UNIQUE,
+	phone TEXT,
+	uploaded BOOLEAN DEFAULT false,
+	created_ts TIMESTAMPTZ DEFAULT NOW(),
+	modified_ts TIMESTAMPTZ DEFAULT NOW());
+CREATE INDEX upload_idx ON customers (uploaded);`
+
+const (
+	// How many rows the reader inserts at a time, as the csvReader does by default.
+	lineBuffer = 100
+	// How long the reader keeps trying to signal the integrator once it has finished.
+	signalWait = 5 * time.Second
+	// How long the integrator's listener has to start.
+	startTimeout = 5 * time.Second
+)
+
+// Harness is a csvReader, crmIntegrator and mock CRM wired together. Each harness has a schema of its own, dropped by
+// Close, so harnesses never see each other's customers.
+type Harness struct {
+	// CRM is the mock the integrator uploads to.
+	CRM *mockcrm.Server
+	// DB is connected to the harness's schema.
+	DB *sql.DB
+
+	admin    *sql.DB
+	schema   string
+	store    database.Store
+	crm      *httptest.Server
+	uploader interface {
+		Start() error
+		Stop()
+		Check()
+	}
+	listener *listener.Listener
+	stopped  chan error
+	copy     bool
+	log      logging.Logger
+}
+
+// New creates a schema for the harness in the database dsn connects to, starts the mock CRM with the scenario and
+// starts the integrator uploading to it.
+func New(dsn string, s mockcrm.Scenario, log logging.Logger) (*Harness, error) {
+	h, err := newHarness(dsn, s, log, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.startIntegrator(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// newHarness creates the harness's schema and starts the mock CRM, serving it through wrap if that is given.
+func newHarness(dsn string, s mockcrm.Scenario, log logging.Logger, wrap func(http.Handler) http.Handler) (*Harness, error) {
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("while opening database: %s", err)
+	}
+	h := &Harness{admin: admin, schema: "e2e_" + randomHex(8), stopped: make(chan error, 1), log: log}
+	if err := h.start(dsn, s, wrap); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Harness) start(dsn string, s mockcrm.Scenario, wrap func(http.Handler) http.Handler) error {
+	if _, err := h.admin.Exec(`CREATE SCHEMA ` + h.schema); err != nil {
+		return fmt.Errorf("while creating schema: %s", err)
+	}
+
+	schemaDSN, err := withSearchPath(dsn, h.schema)
+	if err != nil {
+		return err
+	}
+	if h.DB, err = sql.Open("postgres", schemaDSN); err != nil {
+		return fmt.Errorf("while opening database: %s", err)
+	}
+	if _, err := h.DB.Exec(createCustomers); err != nil {
+		return fmt.Errorf("while creating customers: %s", err)
+	}
+	db := database.NewCustomerDB(h.DB)
+	db.SetLogger(h.log)
+	if err := db.Migrate(context.Background()); err != nil {
+		return err
+	}
+	h.store = db
+
+	h.CRM = mockcrm.New(s)
+	h.CRM.SetLogger(h.log)
+	var handler http.Handler = h.CRM
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	h.crm = httptest.NewServer(handler)
+	return nil
+}
+
+// startIntegrator runs the integrator in process.
+func (h *Harness) startIntegrator() error {
+	u := upload.NewUploader("", h.crm.URL, mockcrm.CustomersPath, h.store)
+	u.SetLogger(h.log)
+	u.SetWorkerID("e2e")
+	h.listener = u.UseRPCListener("tcp", "127.0.0.1:0")
+	h.uploader = u
+	go func() { h.stopped <- u.Start() }()
+
+	deadline := time.Now().Add(startTimeout)
+	for h.listener.Addr() == nil {
+		select {
+		case err := <-h.stopped:
+			return fmt.Errorf("while starting integrator: %s", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			return errors.New("integrator didn't start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// SetCopy makes Import bulk load with COPY.
+func (h *Harness) SetCopy(useCopy bool) {
+	h.copy = useCopy
+}
+
+// Import reads the CSV file into the database as the csvReader does, signalling the integrator as it goes.
+func (h *Harness) Import(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := sender.NewLazySender(&sender.Dialer{Network: "tcp", Address: h.listener.Addr().String()}, signalWait)
+	r := csvreader.NewReader(h.store, f, s, false, lineBuffer)
+	r.SetLogger(h.log)
+	r.SetCopy(h.copy)
+	return r.Run()
+}
+
+// Check has the integrator check for every customer waiting to be uploaded, as it does without a signal.
+func (h *Harness) Check() {
+	h.uploader.Check()
+}
+
+// Pending counts the customers still waiting to be uploaded.
+func (h *Harness) Pending() (int, error) {
+	var n int
+	err := h.DB.QueryRow(`SELECT count(*) FROM customers WHERE NOT uploaded AND NOT dead_letter AND NOT skipped;`).
+		Scan(&n)
+	return n, err
+}
+
+// WaitUploaded waits up to timeout for every customer to be uploaded, or given up on.
+func (h *Harness) WaitUploaded(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := h.Pending()
+		if err != nil {
+			return fmt.Errorf("while counting pending customers: %s", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d customers still waiting after %s", n, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Close stops the integrator and the mock CRM and drops the harness's schema.
+func (h *Harness) Close() error {
+	if h.uploader != nil {
+		h.listener.Stop()
+		h.uploader.Stop()
+	}
+	if h.crm != nil {
+		h.crm.Close()
+	}
+	if h.DB != nil {
+		h.DB.Close()
+	}
+	defer h.admin.Close()
+	if _, err := h.admin.Exec(`DROP SCHEMA IF EXISTS ` + h.schema + ` CASCADE`); err != nil {
+		return fmt.Errorf("while dropping schema: %s", err)
+	}
+	return nil
+}
+
+// withSearchPath makes connections from dsn, either a URL or key=value pairs, use the schema.
+func withSearchPath(dsn, schema string) (string, error) {
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + schema, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", fmt.Errorf("while parsing %s: %s", DatabaseEnv, err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
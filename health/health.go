@@ -0,0 +1,159 @@
+// Package health serves liveness and readiness endpoints built from named checks, for supervisors such as docker
+// compose or kubernetes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The longest a single check may take before it is reported as failed.
+const defaultTimeout = 2 * time.Second
+
+// Check reports a problem with a dependency by returning an error. It should give up when ctx is done.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the body of a health response.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds the checks behind /healthz and /readyz. Liveness checks say whether the process is working at all
+// and should be restarted if not, readiness checks whether it can do useful work right now. Readiness includes the
+// liveness checks.
+type Checker struct {
+	mutex   sync.Mutex
+	live    []namedCheck
+	ready   []namedCheck
+	timeout time.Duration
+}
+
+func NewChecker() *Checker {
+	return &Checker{timeout: defaultTimeout}
+}
+
+// SetTimeout sets how long each check is given.
+func (c *Checker) SetTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+// Live adds a liveness check.
+func (c *Checker) Live(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.live = append(c.live, namedCheck{name, check})
+}
+
+// Ready adds a readiness check.
+func (c *Checker) Ready(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ready = append(c.ready, namedCheck{name, check})
+}
+
+// Healthz serves the liveness checks.
+func (c *Checker) Healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, false)
+	})
+}
+
+// Readyz serves the liveness and readiness checks.
+func (c *Checker) Readyz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, true)
+	})
+}
+
+// Mux is anything the endpoints can be mounted on, an *http.ServeMux or a signal listener say.
+type Mux interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// Handle mounts /healthz and /readyz.
+func (c *Checker) Handle(mux Mux) {
+	mux.Handle("/healthz", c.Healthz())
+	mux.Handle("/readyz", c.Readyz())
+}
+
+// Run runs the checks, all at once, and reports on them.
+func (c *Checker) Run(ctx context.Context, ready bool) Report {
+	c.mutex.Lock()
+	checks := append([]namedCheck(nil), c.live...)
+	if ready {
+		checks = append(checks, c.ready...)
+	}
+	c.mutex.Unlock()
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = c.run(ctx, check)
+		}(i, nc.check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for i, nc := range checks {
+		report.Checks[nc.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return Result{Status: StatusFail, Error: err.Error()}
+	}
+	return Result{Status: StatusOK}
+}
+
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, ready bool) {
+	report := c.Run(r.Context(), ready)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,76 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var (
+		c    *Checker
+		mux  *http.ServeMux
+		fail error
+	)
+
+	ok := func(ctx context.Context) error { return nil }
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	BeforeEach(func() {
+		fail = nil
+		c = NewChecker()
+		c.Live("listener", ok)
+		c.Ready("database", func(ctx context.Context) error { return fail })
+		mux = http.NewServeMux()
+		c.Handle(mux)
+	})
+
+	Context("when every check passes", func() {
+		It("should be healthy and ready", func() {
+			Expect(get("/healthz").Code).To(Equal(http.StatusOK))
+			w := get("/readyz")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(w.Body.String()).To(MatchJSON(`{"status":"ok","checks":{"database":{"status":"ok"},"listener":{"status":"ok"}}}`))
+		})
+	})
+
+	Context("when a readiness check fails", func() {
+		BeforeEach(func() {
+			fail = errors.New("connection refused")
+		})
+
+		It("should be healthy but not ready", func() {
+			Expect(get("/healthz").Code).To(Equal(http.StatusOK))
+			w := get("/readyz")
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(w.Body.String()).To(MatchJSON(`{"status":"fail","checks":{"database":{"status":"fail","error":"connection refused"},"listener":{"status":"ok"}}}`))
+		})
+	})
+
+	Context("when a check takes too long", func() {
+		BeforeEach(func() {
+			c.SetTimeout(10 * time.Millisecond)
+			c.Live("slow", func(ctx context.Context) error {
+				time.Sleep(time.Second)
+				return nil
+			})
+		})
+
+		It("should fail it", func() {
+			report := c.Run(context.Background(), false)
+			Expect(report.Status).To(Equal(StatusFail))
+			Expect(report.Checks["slow"]).To(Equal(Result{Status: StatusFail, Error: context.DeadlineExceeded.Error()}))
+		})
+	})
+})
@@ -0,0 +1,280 @@
+// Package logging is a small leveled, structured logger writing JSON or logfmt lines with a consistent set of field
+// names, and optionally redacting customers' personal details.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Field names shared by every package so log lines can be correlated.
+const (
+	JobID      = "job_id"
+	CustomerID = "customer_id"
+	Line       = "line"
+	Status     = "status"
+	Email      = "email"
+	Phone      = "phone"
+	Error      = "error"
+	Component  = "component"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, as used in configuration.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", s)
+}
+
+type Format int
+
+const (
+	LogfmtFormat Format = iota
+	JSONFormat
+)
+
+// ParseFormat parses "logfmt" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt":
+		return LogfmtFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return LogfmtFormat, fmt.Errorf("unknown log format %q", s)
+}
+
+// Field is a key and value attached to a log line.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F makes a Field.
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Err makes the error Field.
+func Err(err error) Field {
+	return Field{Error, err}
+}
+
+// Logger is what packages are given to log with.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	// With returns a Logger that adds the fields to every line.
+	With(fields ...Field) Logger
+}
+
+type Options struct {
+	Level  Level
+	Format Format
+	// RedactPII masks the email and phone fields.
+	RedactPII bool
+}
+
+type logger struct {
+	out    *output
+	opts   Options
+	fields []Field
+}
+
+// output is shared between a logger and those made from it with With, so lines are never interleaved.
+type output struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// now is replaced in tests to get predictable timestamps.
+var now = time.Now
+
+// New returns a Logger writing to w.
+func New(w io.Writer, opts Options) Logger {
+	return &logger{out: &output{w: w}, opts: opts}
+}
+
+// Default is used by packages that haven't been given a Logger: logfmt at info level to stderr, with PII redacted.
+func Default() Logger {
+	return New(os.Stderr, Options{Level: InfoLevel, Format: LogfmtFormat, RedactPII: true})
+}
+
+// Nop discards everything.
+func Nop() Logger {
+	return New(ioutil.Discard, Options{Level: ErrorLevel + 1})
+}
+
+func (l *logger) Debug(msg string, fields ...Field) { l.log(DebugLevel, msg, fields) }
+func (l *logger) Info(msg string, fields ...Field)  { l.log(InfoLevel, msg, fields) }
+func (l *logger) Warn(msg string, fields ...Field)  { l.log(WarnLevel, msg, fields) }
+func (l *logger) Error(msg string, fields ...Field) { l.log(ErrorLevel, msg, fields) }
+
+func (l *logger) With(fields ...Field) Logger {
+	return &logger{out: l.out, opts: l.opts, fields: append(append([]Field(nil), l.fields...), fields...)}
+}
+
+func (l *logger) log(level Level, msg string, fields []Field) {
+	if level < l.opts.Level {
+		return
+	}
+
+	all := make([]Field, 0, len(l.fields)+len(fields)+3)
+	all = append(all, Field{"time", now().UTC().Format(time.RFC3339Nano)}, Field{"level", level.String()},
+		Field{"msg", msg})
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	for i, f := range all {
+		all[i].Value = l.value(f)
+	}
+
+	var line []byte
+	if l.opts.Format == JSONFormat {
+		line = encodeJSON(all)
+	} else {
+		line = encodeLogfmt(all)
+	}
+
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	_, _ = l.out.w.Write(line)
+}
+
+// value normalises a field's value for encoding, redacting it if need be.
+func (l *logger) value(f Field) interface{} {
+	v := f.Value
+	switch t := v.(type) {
+	case error:
+		v = t.Error()
+	case fmt.Stringer:
+		v = t.String()
+	case time.Duration:
+		v = t.String()
+	}
+
+	if l.opts.RedactPII {
+		if s, ok := v.(string); ok {
+			switch f.Key {
+			case Email:
+				return RedactEmail(s)
+			case Phone:
+				return RedactPhone(s)
+			}
+		}
+	}
+	return v
+}
+
+// RedactEmail keeps the first character of the mailbox and the domain, j***@mail.com.
+func RedactEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// RedactPhone keeps only the last two digits, ***34.
+func RedactPhone(phone string) string {
+	var digits []rune
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) <= 2 {
+		return "***"
+	}
+	return "***" + string(digits[len(digits)-2:])
+}
+
+func encodeJSON(fields []Field) []byte {
+	// Later fields win, so a field given to a log call can override one added with With.
+	index := make(map[string]int, len(fields))
+	var keys []string
+	for i, f := range fields {
+		if _, ok := index[f.Key]; !ok {
+			keys = append(keys, f.Key)
+		}
+		index[f.Key] = i
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(fields[index[key]].Value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(fields[index[key]].Value))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func encodeLogfmt(fields []Field) []byte {
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(f.Value))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		s = t
+	default:
+		s = fmt.Sprint(t)
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
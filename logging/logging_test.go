@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logging", func() {
+	var (
+		b    *bytes.Buffer
+		opts Options
+		l    Logger
+	)
+
+	BeforeEach(func() {
+		now = func() time.Time { return time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC) }
+		b = new(bytes.Buffer)
+		opts = Options{Level: InfoLevel, Format: LogfmtFormat}
+	})
+
+	AfterEach(func() {
+		now = time.Now
+	})
+
+	JustBeforeEach(func() {
+		l = New(b, opts)
+	})
+
+	Context("logfmt", func() {
+		It("should write the message and fields", func() {
+			l.Info("skipping row", F(Line, 3), Err(errors.New("bad id")))
+			Expect(b.String()).To(Equal(`time=2019-08-01T12:00:00Z level=info msg="skipping row" line=3 error="bad id"` + "\n"))
+		})
+	})
+
+	Context("json", func() {
+		BeforeEach(func() {
+			opts.Format = JSONFormat
+		})
+
+		It("should write one object per line", func() {
+			l.Warn("post failed", F(Status, 503))
+			Expect(b.String()).To(Equal(`{"time":"2019-08-01T12:00:00Z","level":"warn","msg":"post failed","status":503}` + "\n"))
+		})
+	})
+
+	Context("levels", func() {
+		BeforeEach(func() {
+			opts.Level = WarnLevel
+		})
+
+		It("should drop lines below the level", func() {
+			l.Debug("debug")
+			l.Info("info")
+			Expect(b.String()).To(BeEmpty())
+			l.Error("error")
+			Expect(b.String()).To(ContainSubstring("level=error"))
+		})
+	})
+
+	Context(".With", func() {
+		It("should add the fields to every line", func() {
+			j := l.With(F(JobID, "abc"))
+			j.Info("one")
+			j.Info("two")
+			Expect(b.String()).To(Equal("time=2019-08-01T12:00:00Z level=info msg=one job_id=abc\n" +
+				"time=2019-08-01T12:00:00Z level=info msg=two job_id=abc\n"))
+		})
+	})
+
+	Context("redaction", func() {
+		Context("when enabled", func() {
+			BeforeEach(func() {
+				opts.RedactPII = true
+			})
+
+			It("should mask emails and phone numbers", func() {
+				l.Error("insert failed", F(Email, "jon.doe@mail.com"), F(Phone, "+1 212 555 1234"))
+				Expect(b.String()).To(ContainSubstring("email=j***@mail.com phone=***34"))
+				Expect(b.String()).ToNot(ContainSubstring("jon.doe"))
+			})
+		})
+
+		Context("when disabled", func() {
+			It("should log them as they are", func() {
+				l.Error("insert failed", F(Email, "jon.doe@mail.com"))
+				Expect(b.String()).To(ContainSubstring("email=jon.doe@mail.com"))
+			})
+		})
+	})
+
+	Context("ParseLevel", func() {
+		It("should parse level names", func() {
+			Expect(ParseLevel("DEBUG")).To(Equal(DebugLevel))
+			_, err := ParseLevel("loud")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("ParseFormat", func() {
+		It("should parse format names", func() {
+			Expect(ParseFormat("json")).To(Equal(JSONFormat))
+			_, err := ParseFormat("xml")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
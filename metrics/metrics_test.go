@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		r      *Registry
+		output func() string
+	)
+
+	BeforeEach(func() {
+		r = NewRegistry()
+		output = func() string {
+			b := new(bytes.Buffer)
+			_, err := r.WriteTo(b)
+			Expect(err).ToNot(HaveOccurred())
+			return b.String()
+		}
+	})
+
+	Context("Counter", func() {
+		It("should expose counts by label", func() {
+			c := r.NewCounter("posts_total", "Posts by code.", "code")
+			c.Inc("201")
+			c.Inc("201")
+			c.Add(3, "503")
+
+			Expect(c.Value("201")).To(Equal(float64(2)))
+			Expect(output()).To(Equal(`# HELP posts_total Posts by code.
+# TYPE posts_total counter
+posts_total{code="201"} 2
+posts_total{code="503"} 3
+`))
+		})
+
+		It("should expose an unlabelled counter before it is used", func() {
+			r.NewCounter("uploads_total", "Uploads.")
+			Expect(output()).To(ContainSubstring("uploads_total 0\n"))
+		})
+
+		It("should refuse to go down", func() {
+			c := r.NewCounter("uploads_total", "Uploads.")
+			Expect(func() { c.Add(-1) }).To(Panic())
+		})
+
+		It("should require a value for every label", func() {
+			c := r.NewCounter("posts_total", "Posts by code.", "code")
+			Expect(func() { c.Inc() }).To(Panic())
+		})
+
+		It("should escape label values", func() {
+			c := r.NewCounter("errors_total", "Errors.", "error")
+			c.Inc("say \"hi\"\n")
+			Expect(output()).To(ContainSubstring(`errors_total{error="say \"hi\"\n"} 1`))
+		})
+	})
+
+	Context("Gauge", func() {
+		It("should expose the current value", func() {
+			g := r.NewGauge("queue_depth", "Queue depth.")
+			g.Set(5)
+			g.Add(-2)
+			Expect(output()).To(ContainSubstring("# TYPE queue_depth gauge\nqueue_depth 3\n"))
+		})
+	})
+
+	Context("GaugeFunc", func() {
+		It("should read the value when collected", func() {
+			v := 1.0
+			r.NewGaugeFunc("things", "Things.", func() float64 { return v })
+			v = 2.5
+			Expect(output()).To(ContainSubstring("things 2.5\n"))
+		})
+	})
+
+	Context("Histogram", func() {
+		It("should expose cumulative buckets, sum and count", func() {
+			h := r.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "op")
+			h.Observe(0.05, "select")
+			h.Observe(0.5, "select")
+			h.Observe(2, "select")
+
+			Expect(h.Count("select")).To(Equal(uint64(3)))
+			Expect(output()).To(Equal(`# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="select",le="0.1"} 1
+latency_seconds_bucket{op="select",le="1"} 2
+latency_seconds_bucket{op="select",le="+Inf"} 3
+latency_seconds_sum{op="select"} 2.55
+latency_seconds_count{op="select"} 3
+`))
+		})
+	})
+
+	Context("Registry", func() {
+		It("should refuse duplicate names", func() {
+			r.NewCounter("uploads_total", "Uploads.")
+			Expect(func() { r.NewGauge("uploads_total", "Uploads.") }).To(Panic())
+		})
+
+		It("should serve the text format", func() {
+			r.NewCounter("uploads_total", "Uploads.")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(w.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+			Expect(w.Body.String()).To(ContainSubstring("uploads_total 0"))
+		})
+	})
+
+	Context("Rate", func() {
+		var (
+			rate *Rate
+			now  time.Time
+		)
+
+		BeforeEach(func() {
+			now = time.Unix(1000, 0)
+			rate = NewRate(10 * time.Second)
+			rate.now = func() time.Time { return now }
+		})
+
+		It("should average events over the window", func() {
+			rate.Mark(10)
+			now = now.Add(time.Second)
+			rate.Mark(10)
+			Expect(rate.PerSecond()).To(Equal(float64(2)))
+		})
+
+		It("should forget events older than the window", func() {
+			rate.Mark(10)
+			now = now.Add(10 * time.Second)
+			rate.Mark(5)
+			Expect(rate.PerSecond()).To(Equal(0.5))
+
+			now = now.Add(time.Hour)
+			Expect(rate.PerSecond()).To(Equal(float64(0)))
+		})
+	})
+})
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Rate counts events per second over a sliding window, for when a rate is wanted as a value itself rather than
+// derived from a counter at query time.
+type Rate struct {
+	mutex   sync.Mutex
+	buckets []int64
+	last    int64
+	now     func() time.Time
+}
+
+// NewRate returns a rate averaged over window, which is rounded down to whole seconds.
+func NewRate(window time.Duration) *Rate {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &Rate{buckets: make([]int64, seconds), now: time.Now}
+}
+
+// Mark records n events.
+func (r *Rate) Mark(n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.advance()
+	r.buckets[now%int64(len(r.buckets))] += int64(n)
+}
+
+// PerSecond returns the average number of events per second over the window.
+func (r *Rate) PerSecond() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.advance()
+	var total int64
+	for _, n := range r.buckets {
+		total += n
+	}
+	return float64(total) / float64(len(r.buckets))
+}
+
+// advance clears the buckets for any seconds that have passed since the last event and returns the current second.
+func (r *Rate) advance() int64 {
+	now := r.now().Unix()
+	size := int64(len(r.buckets))
+	from := r.last + 1
+	if now-r.last >= size {
+		from = now - size + 1
+	}
+	for s := from; s <= now; s++ {
+		r.buckets[s%size] = 0
+	}
+	if now > r.last {
+		r.last = now
+	}
+	return now
+}
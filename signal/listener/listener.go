@@ -2,48 +2,229 @@ package listener
 
 import (
 	"context"
-	"log"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"sync"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
 )
 
+// The permissions given to a unix socket unless SetSocketMode is used, only the owner may signal.
+const defaultSocketMode os.FileMode = 0600
+
+// Listener serves the signal RPC over HTTP. It owns its RPC server and mux rather than using the net/rpc and
+// net/http globals, so any number of listeners can run in a process and each can be stopped and started again.
 type Listener struct {
-	addr     string
-	signaler *Signaler
+	network    string
+	addr       string
+	signaler   *Signaler
+	handlers   *http.ServeMux
+	secret     string
+	tlsConfig  *tls.Config
+	socketMode os.FileMode
+	log        logging.Logger
+
+	mutex    sync.Mutex
 	server   *http.Server
+	listener net.Listener
 }
 
+// Signaler is the RPC receiver for signals. Signals are passed on to the channel without blocking; if the channel is
+// full the waiting payload is merged with the new one, so a signal is never dropped.
 type Signaler struct {
-	sig chan<- struct{}
+	mutex sync.Mutex
+	sig   chan signal.Payload
 }
 
-func NewListener(a string, s chan<- struct{}) *Listener {
+// NewListener returns a listener for the network, "tcp" or "unix", and address. For unix the address is the path of
+// the socket file.
+func NewListener(n, a string, s chan signal.Payload) *Listener {
 	return &Listener{
-		addr:     a,
-		server:   &http.Server{Addr: a},
-		signaler: &Signaler{sig: s},
+		network:    n,
+		addr:       a,
+		signaler:   &Signaler{sig: s},
+		handlers:   http.NewServeMux(),
+		socketMode: defaultSocketMode,
+		log:        logging.Default().With(logging.F(logging.Component, "listener")),
 	}
 }
 
+// SetLogger replaces the default logger.
+func (l *Listener) SetLogger(log logging.Logger) {
+	l.log = log.With(logging.F(logging.Component, "listener"))
+}
+
+// Handle mounts an extra HTTP handler, for health checks or metrics say, on the same port as the RPC. It must be
+// called before Start.
+func (l *Listener) Handle(pattern string, handler http.Handler) {
+	l.handlers.Handle(pattern, handler)
+}
+
+// RequireSecret makes the listener reject any sender that doesn't present the shared secret. It only guards the RPC,
+// not the handlers added with Handle.
+func (l *Listener) RequireSecret(secret string) {
+	l.secret = secret
+}
+
+// UseTLS serves over TLS. Senders must present a certificate signed by one of the config's ClientCAs.
+func (l *Listener) UseTLS(config *tls.Config) {
+	c := config.Clone()
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	l.tlsConfig = c
+}
+
+// SetSocketMode sets the permissions of the socket file when listening on a unix socket.
+func (l *Listener) SetSocketMode(mode os.FileMode) {
+	l.socketMode = mode
+}
+
+// Send is the original, empty signal. It is kept for senders that don't send a payload and asks for a full check.
 func (s *Signaler) Send(args, reply *struct{}) error {
+	return s.Notify(&signal.Payload{}, reply)
+}
+
+// Notify signals with a payload describing the customers that are ready.
+func (s *Signaler) Notify(args *signal.Payload, reply *struct{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p := *args
 	// Send in a select so that if the channel is not ready to receive, i.e is buffered but full, this will not block.
 	select {
-	case s.sig <- struct{}{}:
+	case s.sig <- p:
+		return nil
+	default:
+	}
+
+	// Take back whatever is waiting and replace it with the combination of both. The receiver may have taken it in
+	// the meantime, in which case there is room for ours on its own.
+	select {
+	case waiting := <-s.sig:
+		p = waiting.Merge(p)
+	default:
+	}
+	select {
+	case s.sig <- p:
 	default:
 	}
 	return nil
 }
 
+// Start serves until Stop is called, when it returns http.ErrServerClosed.
 func (l *Listener) Start() error {
-	// Any error returned here is not recoverable since it is programmatic.
-	if err := rpc.Register(l.signaler); err != nil {
-		log.Fatalf("while registering rpc: %s", err)
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(l.signaler); err != nil {
+		return fmt.Errorf("while registering rpc: %s", err)
 	}
-	rpc.HandleHTTP()
-	return l.server.ListenAndServe()
+
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, l.authenticate(rpcServer))
+	mux.Handle("/", l.handlers)
+
+	ln, err := l.listen()
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: mux}
+	l.mutex.Lock()
+	l.server = server
+	l.listener = ln
+	l.mutex.Unlock()
+
+	l.log.Info("listening for signals", logging.F("network", l.network), logging.F("addr", ln.Addr().String()),
+		logging.F("tls", l.tlsConfig != nil), logging.F("secret", l.secret != ""))
+
+	return server.Serve(ln)
 }
 
 func (l *Listener) Stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.server == nil {
+		return
+	}
+
 	// Not really concerned about errors during shutdown.
 	_ = l.server.Shutdown(context.Background())
+	l.server = nil
+	l.listener = nil
+}
+
+// Addr returns the address the listener is bound to, or nil if it isn't running.
+func (l *Listener) Addr() net.Addr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.listener == nil {
+		return nil
+	}
+	return l.listener.Addr()
+}
+
+// Ready reports whether the listener is accepting signals, for health checks.
+func (l *Listener) Ready(ctx context.Context) error {
+	if l.Addr() == nil {
+		return errors.New("not listening")
+	}
+	return nil
+}
+
+func (l *Listener) listen() (net.Listener, error) {
+	switch l.network {
+	case "unix":
+		// A socket left behind by a listener that didn't shut down cleanly would stop us binding.
+		if fi, err := os.Lstat(l.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(l.addr); err != nil {
+				return nil, fmt.Errorf("while removing stale socket: %s", err)
+			}
+		}
+
+		ln, err := net.Listen("unix", l.addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(l.addr, l.socketMode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("while setting socket permissions: %s", err)
+		}
+		return ln, nil
+	case "tcp":
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			return nil, err
+		}
+		if l.tlsConfig != nil {
+			ln = tls.NewListener(ln, l.tlsConfig)
+		}
+		return ln, nil
+	default:
+		return nil, fmt.Errorf("unsupported network %q", l.network)
+	}
+}
+
+// authenticate rejects signals without the shared secret, if one is required. Extra handlers are left open so
+// supervisors can reach health checks without it.
+func (l *Listener) authenticate(next http.Handler) http.Handler {
+	if l.secret == "" {
+		return next
+	}
+
+	want := []byte(signal.AuthScheme + l.secret)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			l.log.Warn("rejected unauthenticated request", logging.F("remote_addr", r.RemoteAddr),
+				logging.F("path", r.URL.Path))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
@@ -2,13 +2,15 @@ package listener
 
 import (
 	"context"
+	"io/ioutil"
 	"net/http"
 	"net/rpc"
-	"sync/atomic"
-	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
 )
 
 const addr = ":9876"
@@ -18,72 +20,210 @@ var _ = Describe("Listener", func() {
 		err     error
 		l       *Listener
 		s       *Signaler
-		sigChan chan struct{}
-		server  *http.Server
+		sigChan chan signal.Payload
 		testL   *Listener
 	)
 
+	// started runs the listener in the background and waits for it to accept RPC connections.
+	started := func(l *Listener) chan error {
+		startErr := make(chan error, 1)
+		go func() { startErr <- l.Start() }()
+		Eventually(l.Addr).ShouldNot(BeNil())
+		Eventually(func() error {
+			c, err := rpc.DialHTTP("tcp", l.Addr().String())
+			if err == nil {
+				c.Close()
+			}
+			return err
+		}).ShouldNot(HaveOccurred())
+		return startErr
+	}
+
 	BeforeEach(func() {
-		server = &http.Server{Addr: addr}
-		sigChan = make(chan struct{}, 1)
+		sigChan = make(chan signal.Payload, 1)
 		s = &Signaler{sig: sigChan}
 
 		l = &Listener{
-			addr:     addr,
-			signaler: s,
-			server:   server,
+			network:    "tcp",
+			addr:       addr,
+			signaler:   s,
+			handlers:   http.NewServeMux(),
+			socketMode: defaultSocketMode,
+			log:        logging.Nop(),
 		}
 	})
 
 	Context("NewListener", func() {
 		BeforeEach(func() {
-			testL = NewListener(addr, sigChan)
-			testL.signaler.sig <- struct{}{}
+			testL = NewListener("tcp", addr, sigChan)
+			testL.signaler.sig <- signal.Payload{}
 		})
 
 		It("should return a Listener", func() {
 			Expect(testL).ToNot(BeNil())
+			l.log = testL.log
 			Expect(testL).To(BeEquivalentTo(l))
 			Expect(sigChan).To(Receive())
 		})
 	})
 
 	Context(".Start", func() {
-		BeforeEach(func() {
-			go l.Start()
-		})
-
 		AfterEach(func() {
-			_ = l.server.Shutdown(context.Background())
+			l.Stop()
 		})
 
 		Context("with a good signaler", func() {
 			It("should register the signaler", func() {
-				_, err := rpc.DialHTTP("tcp", "localhost"+addr)
+				started(l)
+				c, err := rpc.DialHTTP("tcp", "localhost"+addr)
 				Expect(err).ToNot(HaveOccurred())
+				defer c.Close()
+				Expect(c.Call("Signaler.Notify", &signal.Payload{}, &struct{}{})).To(Succeed())
+				Expect(sigChan).To(Receive())
+			})
+		})
+
+		Context("with another listener in the process", func() {
+			var other *Listener
+
+			BeforeEach(func() {
+				other = NewListener("tcp", "localhost:0", make(chan signal.Payload, 1))
+			})
+
+			AfterEach(func() {
+				other.Stop()
+			})
+
+			It("should run both", func() {
+				started(l)
+				started(other)
+			})
+		})
+
+		Context("with an extra handler", func() {
+			BeforeEach(func() {
+				l.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte("ok"))
+				}))
+			})
+
+			It("should serve it alongside the RPC", func() {
+				started(l)
+				resp, err := http.Get("http://localhost" + addr + "/healthz")
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal("ok"))
 			})
 		})
 	})
 
-	Context(".Stop", func() {
-		var shutdown int32
-		BeforeEach(func() {
-			l.server.RegisterOnShutdown(func() { atomic.AddInt32(&shutdown, 1) })
-			go l.server.ListenAndServe()
+	Context(".Ready", func() {
+		AfterEach(func() {
+			l.Stop()
+		})
 
-			// Give the server a moment to start
-			time.Sleep(10 * time.Millisecond)
+		It("should only be ready while listening", func() {
+			Expect(l.Ready(context.Background())).To(MatchError("not listening"))
+			started(l)
+			Expect(l.Ready(context.Background())).To(Succeed())
+		})
+	})
+
+	Context(".Stop", func() {
+		var startErr chan error
 
+		BeforeEach(func() {
+			startErr = started(l)
 			l.Stop()
 		})
 
 		Context("when called", func() {
 			It("should stop the server", func() {
-				Expect(atomic.LoadInt32(&shutdown)).To(Equal(int32(1)))
+				Eventually(startErr).Should(Receive(Equal(http.ErrServerClosed)))
+				Expect(l.Addr()).To(BeNil())
+			})
+		})
+
+		Context("and started again", func() {
+			AfterEach(func() {
+				l.Stop()
+			})
+
+			It("should serve again", func() {
+				Eventually(startErr).Should(Receive())
+				started(l)
 			})
 		})
 	})
 
+	Context("NotifyListener", func() {
+		var (
+			n        *NotifyListener
+			startErr chan error
+		)
+
+		BeforeEach(func() {
+			// Nothing is listening here, so the listener will keep trying to connect.
+			n = NewNotifyListener("postgres://localhost:1/crm?sslmode=disable", "customers_inserted", sigChan)
+			startErr = make(chan error, 1)
+		})
+
+		Context("NewNotifyListener", func() {
+			It("should return a NotifyListener", func() {
+				Expect(n.connStr).To(Equal("postgres://localhost:1/crm?sslmode=disable"))
+				Expect(n.channel).To(Equal("customers_inserted"))
+				Expect(n.signaler).To(BeEquivalentTo(s))
+			})
+		})
+
+		Context(".Stop", func() {
+			BeforeEach(func() {
+				go func() { startErr <- n.Start() }()
+				Eventually(func() bool {
+					n.mutex.Lock()
+					defer n.mutex.Unlock()
+					return n.listener != nil
+				}).Should(BeTrue())
+				n.Stop()
+			})
+
+			It("should stop a listener still waiting for the database", func() {
+				Eventually(startErr).Should(Receive(HaveOccurred()))
+				Expect(sigChan).ToNot(Receive())
+				Expect(n.Ready(context.Background())).To(MatchError("not connected to the database"))
+			})
+		})
+	})
+
+	Context("LocalListener", func() {
+		var local *LocalListener
+
+		BeforeEach(func() {
+			local = NewLocalListener(sigChan)
+		})
+
+		It("should pass signals on, merging them while the channel is full", func() {
+			Expect(local.Signal(signal.ForIDs(1, 2))).To(Succeed())
+			Expect(local.Signal(signal.ForIDs(3))).To(Succeed())
+			Expect(local.Close()).To(Succeed())
+			Expect(sigChan).To(Receive(Equal(signal.ForIDs(1, 2, 3))))
+		})
+
+		It("should be ready from Start until Stop", func() {
+			Expect(local.Ready(context.Background())).To(MatchError("not started"))
+			startErr := make(chan error, 1)
+			go func() { startErr <- local.Start() }()
+			Eventually(func() error { return local.Ready(context.Background()) }).Should(Succeed())
+			Consistently(startErr).ShouldNot(Receive())
+
+			local.Stop()
+			Eventually(startErr).Should(Receive(BeNil()))
+			Expect(local.Ready(context.Background())).To(HaveOccurred())
+		})
+	})
+
 	Context("Signaler", func() {
 		Context(".Send", func() {
 			Context("when the channel is not blocked", func() {
@@ -99,13 +239,39 @@ var _ = Describe("Listener", func() {
 
 			Context("when the channel is full", func() {
 				BeforeEach(func() {
-					sigChan <- struct{}{}
+					sigChan <- signal.ForIDs(1, 2)
 					err = s.Send(&struct{}{}, &struct{}{})
 				})
 
 				It("should not be blocked", func() {
 					Expect(err).ToNot(HaveOccurred())
-					Expect(sigChan).To(Receive())
+					Expect(sigChan).To(Receive(Equal(signal.Payload{})))
+				})
+			})
+		})
+
+		Context(".Notify", func() {
+			Context("when the channel is not blocked", func() {
+				BeforeEach(func() {
+					err = s.Notify(&signal.Payload{JobID: "job", FirstID: 1, LastID: 5, Count: 5}, &struct{}{})
+				})
+
+				It("should send the payload on the channel", func() {
+					Expect(err).ToNot(HaveOccurred())
+					Expect(sigChan).To(Receive(Equal(signal.Payload{JobID: "job", FirstID: 1, LastID: 5, Count: 5})))
+				})
+			})
+
+			Context("when the channel is full", func() {
+				BeforeEach(func() {
+					sigChan <- signal.Payload{JobID: "job", FirstID: 1, LastID: 5, Count: 5}
+					err = s.Notify(&signal.Payload{JobID: "job", FirstID: 6, LastID: 8, Count: 3, Priority: 1}, &struct{}{})
+				})
+
+				It("should merge the payloads", func() {
+					Expect(err).ToNot(HaveOccurred())
+					Expect(sigChan).To(Receive(Equal(signal.Payload{JobID: "job", FirstID: 1, LastID: 8, Count: 8, Priority: 1})))
+					Expect(sigChan).ToNot(Receive())
 				})
 			})
 		})
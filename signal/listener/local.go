@@ -0,0 +1,73 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+// LocalListener takes signals from the same process, for when the reader and the CRM worker run together. It is also
+// the sender the reader signals with, so signals are passed over the channel without any network in between.
+type LocalListener struct {
+	signaler *Signaler
+
+	mutex   sync.Mutex
+	stop    chan struct{}
+	running bool
+}
+
+func NewLocalListener(s chan signal.Payload) *LocalListener {
+	return &LocalListener{signaler: &Signaler{sig: s}}
+}
+
+// Signal passes the payload to the worker, merging it with any waiting signal as the RPC listener does. Signals sent
+// before Start are waiting for the worker when it starts.
+func (l *LocalListener) Signal(p signal.Payload) error {
+	return l.signaler.Notify(&p, &struct{}{})
+}
+
+// SignalContext is Signal, which never blocks, unless ctx is already done.
+func (l *LocalListener) SignalContext(ctx context.Context, p signal.Payload) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.Signal(p)
+}
+
+// Close lets the listener stand in for a sender, it is a no-op as a reader closes its sender when its import is done.
+// Use Stop to stop the listener.
+func (l *LocalListener) Close() error {
+	return nil
+}
+
+// Start blocks until Stop is called.
+func (l *LocalListener) Start() error {
+	l.mutex.Lock()
+	stop := make(chan struct{})
+	l.stop, l.running = stop, true
+	l.mutex.Unlock()
+
+	<-stop
+	return nil
+}
+
+func (l *LocalListener) Stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.running {
+		close(l.stop)
+		l.running = false
+	}
+}
+
+// Ready reports whether the listener has been started, for health checks.
+func (l *LocalListener) Ready(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.running {
+		return errors.New("not started")
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+const (
+	minReconnectInterval = 10 * time.Second
+	maxReconnectInterval = time.Minute
+
+	// pq recommends pinging an idle listener connection so a dead connection is noticed and re-established.
+	pingInterval = 90 * time.Second
+)
+
+// NotifyListener receives signals from Postgres LISTEN/NOTIFY rather than RPC. Notifications are sent by the database
+// in the same transaction that inserts the customers, so they cannot be lost while the listener is connected, and on
+// (re)connecting it signals once to pick up anything inserted while it was not.
+type NotifyListener struct {
+	connStr  string
+	channel  string
+	signaler *Signaler
+	log      logging.Logger
+
+	mutex     sync.Mutex
+	listener  *pq.Listener
+	connected bool
+}
+
+func NewNotifyListener(connStr, channel string, s chan signal.Payload) *NotifyListener {
+	return &NotifyListener{
+		connStr:  connStr,
+		channel:  channel,
+		signaler: &Signaler{sig: s},
+		log:      logging.Default().With(logging.F(logging.Component, "notify_listener")),
+	}
+}
+
+// SetLogger replaces the default logger.
+func (l *NotifyListener) SetLogger(log logging.Logger) {
+	l.log = log.With(logging.F(logging.Component, "notify_listener"))
+}
+
+// Start listens on the channel, blocking until Stop is called.
+func (l *NotifyListener) Start() error {
+	pl := pq.NewListener(l.connStr, minReconnectInterval, maxReconnectInterval, l.event)
+	l.mutex.Lock()
+	l.listener = pl
+	l.mutex.Unlock()
+
+	// Listen blocks until the connection is established or the listener is closed.
+	if err := pl.Listen(l.channel); err != nil {
+		return err
+	}
+
+	// Anything committed before we were listening was never announced, so go look for it.
+	l.signal(nil)
+
+	for {
+		select {
+		case n, ok := <-pl.Notify:
+			if !ok {
+				return nil
+			}
+			// A nil notification is sent after a reconnect, when notifications may have been missed, which signals
+			// a full check.
+			l.signal(n)
+		case <-time.After(pingInterval):
+			go pl.Ping()
+		}
+	}
+}
+
+func (l *NotifyListener) Stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.listener != nil {
+		// Not really concerned about errors during shutdown.
+		_ = l.listener.Close()
+	}
+	l.connected = false
+}
+
+// Ready reports whether the listener is connected to the database, for health checks.
+func (l *NotifyListener) Ready(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.connected {
+		return errors.New("not connected to the database")
+	}
+	return nil
+}
+
+func (l *NotifyListener) signal(n *pq.Notification) {
+	p := &signal.Payload{}
+	if n != nil && n.Extra != "" {
+		if err := json.Unmarshal([]byte(n.Extra), p); err != nil {
+			l.log.Warn("ignoring bad notification payload", logging.F("payload", n.Extra), logging.Err(err))
+			p = &signal.Payload{}
+		}
+	}
+	_ = l.signaler.Notify(p, &struct{}{})
+}
+
+var listenerEvents = map[pq.ListenerEventType]string{
+	pq.ListenerEventConnected:               "connected",
+	pq.ListenerEventDisconnected:            "disconnected",
+	pq.ListenerEventReconnected:             "reconnected",
+	pq.ListenerEventConnectionAttemptFailed: "connection attempt failed",
+}
+
+func (l *NotifyListener) event(ev pq.ListenerEventType, err error) {
+	l.mutex.Lock()
+	l.connected = ev == pq.ListenerEventConnected || ev == pq.ListenerEventReconnected
+	l.mutex.Unlock()
+
+	if err != nil {
+		l.log.Warn("database listener "+listenerEvents[ev], logging.F("channel", l.channel), logging.Err(err))
+		return
+	}
+	l.log.Info("database listener "+listenerEvents[ev], logging.F("channel", l.channel))
+}
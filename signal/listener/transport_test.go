@@ -0,0 +1,202 @@
+package listener
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/logging"
+	"github.com/dbyington/csv-crm-upload/signal"
+	"github.com/dbyington/csv-crm-upload/signal/sender"
+)
+
+var _ = Describe("Listener transport", func() {
+	var (
+		l       *Listener
+		sigChan chan signal.Payload
+		dialer  *sender.Dialer
+	)
+
+	serve := func() {
+		go l.Start()
+		Eventually(l.Addr).ShouldNot(BeNil())
+	}
+
+	notify := func() error {
+		c, err := dialer.Dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return c.Call("Signaler.Notify", &signal.Payload{}, &struct{}{})
+	}
+
+	BeforeEach(func() {
+		sigChan = make(chan signal.Payload, 1)
+	})
+
+	AfterEach(func() {
+		l.Stop()
+	})
+
+	Context("on a unix socket", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "listener")
+			Expect(err).ToNot(HaveOccurred())
+
+			path := filepath.Join(dir, "signal.sock")
+			l = NewListener("unix", path, sigChan)
+			l.SetLogger(logging.Nop())
+			dialer = &sender.Dialer{Network: "unix", Address: path}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should only let the owner use the socket", func() {
+			serve()
+			fi, err := os.Stat(l.addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fi.Mode() & os.ModePerm).To(Equal(os.FileMode(0600)))
+		})
+
+		It("should receive signals", func() {
+			serve()
+			Expect(notify()).To(Succeed())
+			Expect(sigChan).To(Receive())
+		})
+
+		Context("with a stale socket file", func() {
+			BeforeEach(func() {
+				stale, err := net.Listen("unix", l.addr)
+				Expect(err).ToNot(HaveOccurred())
+				// Leave the file behind as a crashed listener would.
+				stale.(*net.UnixListener).SetUnlinkOnClose(false)
+				stale.Close()
+			})
+
+			It("should replace it", func() {
+				serve()
+				Expect(notify()).To(Succeed())
+			})
+		})
+	})
+
+	Context("on TCP with a shared secret", func() {
+		BeforeEach(func() {
+			l = NewListener("tcp", "localhost:0", sigChan)
+			l.SetLogger(logging.Nop())
+			l.RequireSecret("s3cret")
+			l.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			serve()
+			dialer = &sender.Dialer{Network: "tcp", Address: l.Addr().String()}
+		})
+
+		It("should accept the secret", func() {
+			dialer.Secret = "s3cret"
+			Expect(notify()).To(Succeed())
+			Expect(sigChan).To(Receive())
+		})
+
+		It("should reject a sender without the secret", func() {
+			Expect(notify()).To(MatchError("unexpected HTTP response: 401 Unauthorized"))
+			Expect(sigChan).ToNot(Receive())
+		})
+
+		It("should reject the wrong secret", func() {
+			dialer.Secret = "guess"
+			Expect(notify()).To(MatchError("unexpected HTTP response: 401 Unauthorized"))
+			Expect(sigChan).ToNot(Receive())
+		})
+
+		It("should leave extra handlers open", func() {
+			resp, err := http.Get("http://" + l.Addr().String() + "/healthz")
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("on TCP with mutual TLS", func() {
+		var serverTLS, clientTLS *tls.Config
+
+		BeforeEach(func() {
+			serverTLS, clientTLS = testTLS()
+			l = NewListener("tcp", "localhost:0", sigChan)
+			l.SetLogger(logging.Nop())
+			l.UseTLS(serverTLS)
+			serve()
+			dialer = &sender.Dialer{Network: "tcp", Address: l.Addr().String(), Timeout: time.Second}
+		})
+
+		It("should accept a client certificate signed by the CA", func() {
+			dialer.TLS = clientTLS
+			Expect(notify()).To(Succeed())
+			Expect(sigChan).To(Receive())
+		})
+
+		It("should reject a client without a certificate", func() {
+			dialer.TLS = &tls.Config{RootCAs: clientTLS.RootCAs}
+			Expect(notify()).ToNot(Succeed())
+			Expect(sigChan).ToNot(Receive())
+		})
+	})
+})
+
+// testTLS returns server and client configs with certificates for localhost signed by a throwaway CA.
+func testTLS() (*tls.Config, *tls.Config) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	ca, err = x509.ParseCertificate(caDER)
+	Expect(err).ToNot(HaveOccurred())
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	server := &tls.Config{Certificates: []tls.Certificate{issue(2, x509.ExtKeyUsageServerAuth)}, ClientCAs: pool}
+	client := &tls.Config{Certificates: []tls.Certificate{issue(3, x509.ExtKeyUsageClientAuth)}, RootCAs: pool}
+	return server, client
+}
@@ -0,0 +1,89 @@
+package sender
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+// The status net/rpc replies with once an HTTP CONNECT has been accepted.
+const rpcConnected = "200 Connected to Go RPC"
+
+// The default time allowed to connect to the listener, and for the listener to take a signal.
+const dialTimeout = 5 * time.Second
+
+// Dialer connects to the signal listener. It does what rpc.DialHTTP does, with a timeout, and optionally presents a
+// shared secret or a client certificate.
+type Dialer struct {
+	Network string
+	Address string
+
+	// Secret is sent to a listener that requires a shared secret.
+	Secret string
+	// TLS, if set, is used to connect to a TCP listener over TLS.
+	TLS *tls.Config
+	// Timeout is how long connecting may take, it defaults to 5 seconds. A LazySender also allows each signal as long.
+	Timeout time.Duration
+}
+
+// Dial connects to the listener.
+func (d *Dialer) Dial() (*rpc.Client, error) {
+	timeout := d.timeout()
+
+	var conn net.Conn
+	var err error
+	if d.TLS != nil && d.Network == "tcp" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, d.Network, d.Address, d.TLS)
+	} else {
+		conn, err = net.DialTimeout(d.Network, d.Address, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.connect(conn, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// connect makes the HTTP CONNECT request that hands the connection over to the RPC server.
+func (d *Dialer) connect(conn net.Conn, timeout time.Duration) error {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	req := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	if d.Secret != "" {
+		req += "Authorization: " + signal.AuthScheme + d.Secret + "\n"
+	}
+	if _, err := io.WriteString(conn, req+"\n"); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return err
+	}
+	if resp.Status != rpcConnected {
+		return errors.New("unexpected HTTP response: " + resp.Status)
+	}
+
+	// Clear the deadline, the connection is long lived.
+	return conn.SetDeadline(time.Time{})
+}
+
+func (d *Dialer) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return dialTimeout
+	}
+	return d.Timeout
+}
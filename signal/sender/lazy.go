@@ -0,0 +1,187 @@
+package sender
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+const (
+	minRetryInterval = 100 * time.Millisecond
+	maxRetryInterval = 5 * time.Second
+)
+
+// LazySender is a Signaler that doesn't need the listener to be up. It connects in the background, retrying with
+// backoff, and any signal that can't be delivered is remembered and sent as soon as a connection is made. Signals are
+// not queued, undelivered payloads are merged into a single pending signal covering all of them.
+type LazySender struct {
+	dialer *Dialer
+	wait   time.Duration
+
+	mutex     sync.Mutex
+	client    *rpc.Client
+	pending   *signal.Payload
+	delivered bool
+
+	lost    chan struct{}
+	retry   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewLazySender starts connecting to the listener using the dialer. wait is how long Close will keep trying to deliver
+// a pending signal before giving up.
+func NewLazySender(d *Dialer, wait time.Duration) *LazySender {
+	s := &LazySender{
+		dialer:  d,
+		wait:    wait,
+		lost:    make(chan struct{}, 1),
+		retry:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.connectLoop()
+
+	return s
+}
+
+// Signal sends the signal if connected, otherwise it is left pending until a connection is made. It never fails; use
+// Pending to find out whether the listener has been told.
+func (s *LazySender) Signal(p signal.Payload) error {
+	return s.SignalContext(context.Background(), p)
+}
+
+// SignalContext is Signal, leaving the signal pending if ctx is done before the listener has taken it.
+func (s *LazySender) SignalContext(ctx context.Context, p signal.Payload) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pending != nil {
+		p = s.pending.Merge(p)
+	}
+	s.pending = &p
+	s.flush(ctx)
+	return nil
+}
+
+// Pending reports whether there is a signal the listener hasn't received.
+func (s *LazySender) Pending() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.pending != nil
+}
+
+// Delivered reports whether the listener has received a signal.
+func (s *LazySender) Delivered() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.delivered
+}
+
+// Close gives any pending signal up to the configured wait to be delivered, then stops connecting and closes the
+// connection.
+func (s *LazySender) Close() error {
+	deadline := time.Now().Add(s.wait)
+	for s.Pending() && time.Now().Before(deadline) {
+		// Don't sit out the rest of a backoff interval, try again now.
+		select {
+		case s.retry <- struct{}{}:
+		default:
+		}
+		time.Sleep(minRetryInterval)
+	}
+
+	close(s.done)
+	<-s.stopped
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func (s *LazySender) connectLoop() {
+	defer close(s.stopped)
+
+	interval := minRetryInterval
+	for {
+		if s.connect() {
+			interval = minRetryInterval
+
+			// Stay connected until a call fails.
+			select {
+			case <-s.lost:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-s.retry:
+		case <-s.done:
+			return
+		}
+
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// connect dials the listener and delivers any pending signal, returning whether it is connected.
+func (s *LazySender) connect() bool {
+	c, err := s.dialer.Dial()
+	if err != nil {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// A connection lost before this one is of no interest to the new one, and would otherwise have connectLoop
+	// reconnect as soon as it is connected.
+	select {
+	case <-s.lost:
+	default:
+	}
+	if s.client != nil {
+		_ = s.client.Close()
+	}
+	s.client = c
+	s.flush(context.Background())
+	return s.client != nil
+}
+
+// flush sends a pending signal over the current connection, dropping the connection if the call fails or takes longer
+// than the dialer's timeout, as a listener that stops answering would otherwise hold up every signal. The mutex must be
+// held.
+func (s *LazySender) flush(ctx context.Context) {
+	if s.pending == nil || s.client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.dialer.timeout())
+	defer cancel()
+	if err := call(ctx, s.client, *s.pending); err != nil {
+		_ = s.client.Close()
+		s.client = nil
+		select {
+		case s.lost <- struct{}{}:
+		default:
+		}
+		return
+	}
+	s.pending = nil
+	s.delivered = true
+}
@@ -0,0 +1,247 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+type fakeSignaler struct {
+	count int32
+	last  atomic.Value
+}
+
+func (f *fakeSignaler) Notify(args *signal.Payload, reply *struct{}) error {
+	atomic.AddInt32(&f.count, 1)
+	f.last.Store(*args)
+	return nil
+}
+
+// stuckSignaler is a listener that stops answering.
+type stuckSignaler struct {
+	count   int32
+	release chan struct{}
+}
+
+func (s *stuckSignaler) Notify(args *signal.Payload, reply *struct{}) error {
+	atomic.AddInt32(&s.count, 1)
+	<-s.release
+	return nil
+}
+
+// failingSignaler is a listener that fails the first call it is sent.
+type failingSignaler struct {
+	count int32
+}
+
+func (f *failingSignaler) Notify(args *signal.Payload, reply *struct{}) error {
+	if atomic.AddInt32(&f.count, 1) == 1 {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (c *countingListener) Accept() (net.Conn, error) {
+	conn, err := c.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&c.accepted, 1)
+	}
+	return conn, err
+}
+
+// oldSignaler is a listener from before signals carried a payload.
+type oldSignaler struct {
+	count int32
+}
+
+func (o *oldSignaler) Send(args, reply *struct{}) error {
+	atomic.AddInt32(&o.count, 1)
+	return nil
+}
+
+var _ = Describe("LazySender", func() {
+	var (
+		l        *LazySender
+		listener net.Listener
+		signaler *fakeSignaler
+		addr     string
+	)
+
+	serve := func() {
+		var err error
+		listener, err = net.Listen("tcp", addr)
+		Expect(err).ToNot(HaveOccurred())
+
+		server := rpc.NewServer()
+		Expect(server.RegisterName("Signaler", signaler)).To(Succeed())
+		go http.Serve(listener, server)
+	}
+
+	received := func() int32 {
+		return atomic.LoadInt32(&signaler.count)
+	}
+
+	BeforeEach(func() {
+		signaler = &fakeSignaler{}
+
+		// Grab a free port, then let it go so nothing is listening on it yet.
+		ln, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		addr = ln.Addr().String()
+		ln.Close()
+		listener = nil
+	})
+
+	AfterEach(func() {
+		if listener != nil {
+			listener.Close()
+		}
+	})
+
+	Context("when the listener is up", func() {
+		BeforeEach(func() {
+			serve()
+			l = NewLazySender(&Dialer{Network: "tcp", Address: addr}, time.Second)
+		})
+
+		It("should deliver the signal", func() {
+			Expect(l.Signal(signal.Payload{})).To(Succeed())
+			Eventually(received).Should(Equal(int32(1)))
+			Eventually(l.Pending).Should(BeFalse())
+			Expect(l.Delivered()).To(BeTrue())
+			Expect(l.Close()).To(Succeed())
+		})
+	})
+
+	Context("when the listener is not up", func() {
+		BeforeEach(func() {
+			l = NewLazySender(&Dialer{Network: "tcp", Address: addr}, 200*time.Millisecond)
+		})
+
+		It("should keep the signal pending", func() {
+			Expect(l.Signal(signal.Payload{})).To(Succeed())
+			Expect(l.Close()).To(Succeed())
+			Expect(l.Pending()).To(BeTrue())
+			Expect(l.Delivered()).To(BeFalse())
+		})
+
+		Context("and comes up later", func() {
+			It("should deliver the pending signal once", func() {
+				Expect(l.Signal(signal.ForIDs(1, 2))).To(Succeed())
+				Expect(l.Signal(signal.ForIDs(3))).To(Succeed())
+				serve()
+
+				Eventually(l.Pending, 2*time.Second).Should(BeFalse())
+				Expect(received()).To(Equal(int32(1)))
+				Expect(signaler.last.Load()).To(Equal(signal.ForIDs(1, 2, 3)))
+				Expect(l.Close()).To(Succeed())
+			})
+		})
+	})
+
+	Context("when the listener doesn't accept payloads", func() {
+		var old *oldSignaler
+
+		BeforeEach(func() {
+			old = &oldSignaler{}
+			var err error
+			listener, err = net.Listen("tcp", addr)
+			Expect(err).ToNot(HaveOccurred())
+
+			server := rpc.NewServer()
+			Expect(server.RegisterName("Signaler", old)).To(Succeed())
+			go http.Serve(listener, server)
+
+			l = NewLazySender(&Dialer{Network: "tcp", Address: addr}, time.Second)
+		})
+
+		It("should fall back to an empty signal", func() {
+			Expect(l.Signal(signal.ForIDs(1))).To(Succeed())
+			Eventually(func() int32 { return atomic.LoadInt32(&old.count) }).Should(Equal(int32(1)))
+			Eventually(l.Pending).Should(BeFalse())
+			Expect(l.Close()).To(Succeed())
+		})
+	})
+
+	Context("when the first delivery of a pending signal fails", func() {
+		var (
+			failing  *failingSignaler
+			counting *countingListener
+		)
+
+		BeforeEach(func() {
+			failing = &failingSignaler{}
+			l = NewLazySender(&Dialer{Network: "tcp", Address: addr}, time.Second)
+		})
+
+		It("should deliver it over a new connection and stay connected", func() {
+			Expect(l.Signal(signal.ForIDs(1))).To(Succeed())
+
+			ln, err := net.Listen("tcp", addr)
+			Expect(err).ToNot(HaveOccurred())
+			counting = &countingListener{Listener: ln}
+			listener = counting
+			server := rpc.NewServer()
+			Expect(server.RegisterName("Signaler", failing)).To(Succeed())
+			go http.Serve(listener, server)
+
+			Eventually(l.Pending, 2*time.Second).Should(BeFalse())
+			Expect(atomic.LoadInt32(&failing.count)).To(Equal(int32(2)))
+			Consistently(func() int32 { return atomic.LoadInt32(&counting.accepted) }, 500*time.Millisecond).
+				Should(Equal(int32(2)))
+			Expect(l.Close()).To(Succeed())
+		})
+	})
+
+	Context("when the listener stops answering", func() {
+		var stuck *stuckSignaler
+
+		BeforeEach(func() {
+			stuck = &stuckSignaler{release: make(chan struct{})}
+			var err error
+			listener, err = net.Listen("tcp", addr)
+			Expect(err).ToNot(HaveOccurred())
+			server := rpc.NewServer()
+			Expect(server.RegisterName("Signaler", stuck)).To(Succeed())
+			go http.Serve(listener, server)
+			l = NewLazySender(&Dialer{Network: "tcp", Address: addr, Timeout: 100 * time.Millisecond}, 0)
+		})
+
+		AfterEach(func() {
+			close(stuck.release)
+		})
+
+		It("should give up on the signal after the timeout", func() {
+			Expect(l.Signal(signal.ForIDs(1))).To(Succeed())
+			Eventually(func() int32 { return atomic.LoadInt32(&stuck.count) }).Should(BeNumerically(">", 0))
+
+			start := time.Now()
+			Expect(l.Close()).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(l.Pending()).To(BeTrue())
+		})
+
+		It("should give up on the signal once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(l.SignalContext(ctx, signal.ForIDs(1))).To(Succeed())
+			Expect(l.Pending()).To(BeTrue())
+			Expect(l.Close()).To(Succeed())
+		})
+	})
+})
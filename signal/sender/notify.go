@@ -0,0 +1,29 @@
+package sender
+
+import (
+	"context"
+
+	"github.com/dbyington/csv-crm-upload/signal"
+)
+
+// NotifySender is the sending half of the Postgres LISTEN/NOTIFY signal. The NOTIFY itself is issued by the database
+// inside the insert transaction (see database.NotifyOn), so there is nothing left to send once the insert returns and
+// no running listener is required.
+type NotifySender struct{}
+
+func NewNotifySender() *NotifySender {
+	return &NotifySender{}
+}
+
+// Signal is a no-op, the notification was sent, with its own payload, when the customers were committed.
+func (s *NotifySender) Signal(signal.Payload) error {
+	return nil
+}
+
+func (s *NotifySender) SignalContext(context.Context, signal.Payload) error {
+	return nil
+}
+
+func (s *NotifySender) Close() error {
+	return nil
+}
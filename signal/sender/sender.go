@@ -1,9 +1,21 @@
 package sender
 
 import (
+	"context"
 	"net/rpc"
+	"strings"
+
+	"github.com/dbyington/csv-crm-upload/signal"
 )
 
+// Signaler is implemented by anything that can tell the CRM worker there are customers ready to upload.
+type Signaler interface {
+	Signal(signal.Payload) error
+	// SignalContext is Signal, giving up once ctx is done.
+	SignalContext(context.Context, signal.Payload) error
+	Close() error
+}
+
 type Sender struct {
 	client *rpc.Client
 }
@@ -12,15 +24,35 @@ func NewSender(c *rpc.Client) *Sender {
 	return &Sender{client: c}
 }
 
-func (s *Sender) Signal() error {
-	rec := &struct{}{}
-	if err := s.client.Call("Signaler.Send", struct{}{}, rec); err != nil {
-		return err
-	}
+func (s *Sender) Signal(p signal.Payload) error {
+	return s.SignalContext(context.Background(), p)
+}
 
-	return nil
+func (s *Sender) SignalContext(ctx context.Context, p signal.Payload) error {
+	return call(ctx, s.client, p)
 }
 
 func (s *Sender) Close() error {
 	return s.client.Close()
 }
+
+// call sends the payload, falling back to the original empty signal if the listener is too old to accept one.
+func call(ctx context.Context, c *rpc.Client, p signal.Payload) error {
+	err := callContext(ctx, c, "Signaler.Notify", &p)
+	if serverErr, ok := err.(rpc.ServerError); ok && strings.HasPrefix(string(serverErr), "rpc: can't find method") {
+		return callContext(ctx, c, "Signaler.Send", struct{}{})
+	}
+	return err
+}
+
+// callContext makes the call, returning ctx's error if it is done first. net/rpc can't cancel a call, so the reply to
+// an abandoned one is read and dropped whenever it arrives.
+func callContext(ctx context.Context, c *rpc.Client, method string, args interface{}) error {
+	call := c.Go(method, args, &struct{}{}, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
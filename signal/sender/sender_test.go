@@ -7,6 +7,8 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	"github.com/dbyington/csv-crm-upload/signal"
 )
 
 type buffer struct {
@@ -57,7 +59,15 @@ var _ = Describe("Sender", func() {
 	// this is also flagged Pending.
 	PContext(".Signal", func() {
 		It("should make the rpc call", func() {
-			Expect(s.Signal()).ToNot(HaveOccurred())
+			Expect(s.Signal(signal.Payload{})).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("NotifySender", func() {
+		It("should satisfy Signaler without needing a listener", func() {
+			var n Signaler = NewNotifySender()
+			Expect(n.Signal(signal.ForIDs(1))).To(Succeed())
+			Expect(n.Close()).To(Succeed())
 		})
 	})
 })
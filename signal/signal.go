@@ -0,0 +1,90 @@
+package signal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// AuthScheme prefixes the shared secret in the Authorization header a sender connects to the listener with.
+const AuthScheme = "Bearer "
+
+// Payload describes what changed when a signal is sent, so the CRM worker can fetch just those customers. The zero
+// Payload, which is also what older senders send, carries no range and means "check for all new customers".
+type Payload struct {
+	JobID    string `json:"job_id,omitempty"`
+	FirstID  int64  `json:"first_id,omitempty"`
+	LastID   int64  `json:"last_id,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// Ranged reports whether the payload describes a range of customer ids.
+func (p Payload) Ranged() bool {
+	return p.Count > 0 && p.FirstID <= p.LastID
+}
+
+// Merge combines two payloads into one that covers both. If either of them isn't ranged neither is the result. A
+// customer signalled in both is counted twice, so the merged Count is an upper bound, at most the size of the range.
+func (p Payload) Merge(o Payload) Payload {
+	m := Payload{Priority: p.Priority}
+	if o.Priority > m.Priority {
+		m.Priority = o.Priority
+	}
+	if p.JobID == o.JobID {
+		m.JobID = p.JobID
+	}
+	if !p.Ranged() || !o.Ranged() {
+		return m
+	}
+
+	m.FirstID, m.LastID, m.Count = p.FirstID, p.LastID, p.Count+o.Count
+	if o.FirstID < m.FirstID {
+		m.FirstID = o.FirstID
+	}
+	if o.LastID > m.LastID {
+		m.LastID = o.LastID
+	}
+	if n := m.LastID - m.FirstID + 1; int64(m.Count) > n {
+		m.Count = int(n)
+	}
+	return m
+}
+
+// ForIDs returns a payload covering the given customer ids.
+func ForIDs(ids ...int64) Payload {
+	var p Payload
+	for i, id := range ids {
+		if i == 0 {
+			p = Payload{FirstID: id, LastID: id, Count: 1}
+			continue
+		}
+		p = p.Merge(Payload{FirstID: id, LastID: id, Count: 1})
+	}
+	return p
+}
+
+// LoadTLS builds the TLS configuration shared by both ends of an mTLS signal connection: the certificate presented
+// to the other end and the CA used to verify the other end's certificate.
+func LoadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("while loading certificate: %s", err)
+	}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("while reading CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+	}, nil
+}
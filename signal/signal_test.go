@@ -0,0 +1,50 @@
+package signal
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Payload", func() {
+	Context("ForIDs", func() {
+		It("should cover all of the ids", func() {
+			Expect(ForIDs(5, 2, 9)).To(Equal(Payload{FirstID: 2, LastID: 9, Count: 3}))
+		})
+
+		It("should not be ranged without ids", func() {
+			Expect(ForIDs().Ranged()).To(BeFalse())
+		})
+	})
+
+	Context(".Merge", func() {
+		Context("with two ranged payloads", func() {
+			It("should cover both", func() {
+				a := Payload{JobID: "job", FirstID: 10, LastID: 20, Count: 11}
+				b := Payload{JobID: "job", FirstID: 1, LastID: 5, Count: 5, Priority: 2}
+				Expect(a.Merge(b)).To(Equal(Payload{JobID: "job", FirstID: 1, LastID: 20, Count: 16, Priority: 2}))
+			})
+
+			It("should count no more customers than the range holds", func() {
+				a := ForIDs(1, 2, 3)
+				Expect(a.Merge(a)).To(Equal(a))
+				Expect(a.Merge(ForIDs(3, 4))).To(Equal(Payload{FirstID: 1, LastID: 4, Count: 4}))
+			})
+		})
+
+		Context("with payloads from different jobs", func() {
+			It("should drop the job id", func() {
+				a := Payload{JobID: "one", FirstID: 1, LastID: 1, Count: 1}
+				b := Payload{JobID: "two", FirstID: 2, LastID: 2, Count: 1}
+				Expect(a.Merge(b).JobID).To(BeEmpty())
+			})
+		})
+
+		Context("with an empty payload", func() {
+			It("should ask for a full check", func() {
+				a := Payload{FirstID: 1, LastID: 1, Count: 1, Priority: 1}
+				Expect(a.Merge(Payload{})).To(Equal(Payload{Priority: 1}))
+				Expect(Payload{}.Merge(a).Ranged()).To(BeFalse())
+			})
+		})
+	})
+})